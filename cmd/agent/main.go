@@ -38,16 +38,23 @@ func main() {
 	cfg := agentutils.LoadAgentConfig()
 	wg := &sync.WaitGroup{}
 	metricsStore := metricsagent.NewRepo()
+	metricsStore.SetPipeline(cfg.Relabel)
+	if err := metricsStore.SetAggregations(cfg.Aggregations); err != nil {
+		log.Fatal().Err(err).Msg("bad aggregations config")
+	}
 	//for close programm by signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	//for additional metric RandomValue
 	rand.Seed(time.Now().UnixNano())
 	ctx, cancel := context.WithCancel(context.Background())
-	wg.Add(3)
-	go metricsagent.CollectRuntimeWorker(ctx, wg, cfg, metricsStore)
-	go metricsagent.CollectSystemWorker(ctx, wg, cfg, metricsStore)
+	metricsagent.StartCollectors(ctx, wg, cfg, metricsStore)
+	wg.Add(1)
 	go metricsagent.SendWorker(ctx, wg, cfg, metricsStore)
+	if cfg.StatusAddress != "" {
+		wg.Add(1)
+		go metricsagent.StatusWorker(ctx, wg, cfg, metricsStore)
+	}
 	<-sigChan
 	cancel()
 	wg.Wait()
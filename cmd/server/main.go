@@ -11,6 +11,7 @@ import (
 
 	"github.com/colzphml/yandex_project/internal/app/server"
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/scenarios"
 	"github.com/colzphml/yandex_project/internal/storage"
 	"github.com/rs/zerolog"
 )
@@ -35,6 +36,9 @@ func main() {
 	cfg := serverutils.LoadServerConfig()
 	log.Info().Dict("cfg", zerolog.Dict().
 		Str("ServerAddress", cfg.ServerAddress).
+		Str("ServerAddressGRPC", cfg.ServerAddressGRPC).
+		Bool("GRPCDisable", cfg.GRPCDisable).
+		Dur("SelfMetricsInterval", cfg.SelfMetricsInterval).
 		Dur("StoreInterval", cfg.StoreInterval).
 		Str("StoreFile", cfg.StoreFile).
 		Bool("Restore", cfg.Restore).
@@ -49,8 +53,14 @@ func main() {
 	//для "штатного" завершения сервера
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	if cfg.SelfMetricsInterval > 0 {
+		go scenarios.SelfMetricsWorker(ctx, repo, cfg)
+	}
 	srv := server.HTTPServer(ctx, cfg, repo)
-	grpcsrv := server.GRPCServer(ctx, cfg, repo)
+	// сервис проверки здоровья gRPC опрашивает хранилище до отмены контекста, поэтому контекст отменяется при остановке сервера gRPC
+	grpcCtx, stopGRPC := context.WithCancel(ctx)
+	defer stopGRPC()
+	grpcsrv := server.GRPCServer(grpcCtx, cfg, repo)
 	wg := &sync.WaitGroup{}
 Loop:
 	for {
@@ -70,12 +80,25 @@ Loop:
 				tickerSave.Stop()
 				cancel()
 			}()
-			wg.Add(1)
-			go func() {
-				grpcsrv.GracefulStop()
-				log.Info().Msg("grpc stopped")
-				wg.Done()
-			}()
+			if grpcsrv != nil {
+				wg.Add(1)
+				go func() {
+					// агенты держат потоки StreamSave открытыми, поэтому по истечении таймаута соединения закрываются принудительно
+					stopped := make(chan struct{})
+					go func() {
+						grpcsrv.GracefulStop()
+						close(stopped)
+					}()
+					select {
+					case <-stopped:
+					case <-ctxcancel.Done():
+						grpcsrv.Stop()
+					}
+					stopGRPC()
+					log.Info().Msg("grpc stopped")
+					wg.Done()
+				}()
+			}
 			if err := srv.Shutdown(ctxcancel); err != nil {
 				log.Error().Err(err).Msg("failed shutdown server")
 			}
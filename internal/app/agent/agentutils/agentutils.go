@@ -4,20 +4,25 @@ package agentutils
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/colzphml/yandex_project/internal/metrics"
 	"github.com/rs/zerolog"
 )
 
@@ -25,14 +30,83 @@ var log = zerolog.New(LogConfig()).With().Timestamp().Str("component", "agentuti
 
 // AgentConfig - конфигурация агента для старта.
 type AgentConfig struct {
-	Metrics           map[string]string // Описание метрик, собираемых из runtime
-	Key               string            `env:"KEY"`                              // Ключ для подписи данных
-	ServerAddress     string            `env:"ADDRESS" json:"address"`           // Адрес сервера обработки метрик
-	ServerAddressGRPC string            `env:"ADDRESS_GRPC" json:"address_grpc"` // Адрес, по которому будут доступны endpoints
-	ConfigFile        string            `env:"CONFIG"`                           // Адрес файла конфигурации в формате JSON
-	PollInterval      time.Duration     `env:"POLL_INTERVAL"`                    // Интервал сбора метрик агентом
-	ReportInterval    time.Duration     `env:"REPORT_INTERVAL"`                  // Интервал отправки данных на сервер
-	PublicKey         *rsa.PublicKey    // Публичный ключ
+	Metrics           map[string]string          // Описание метрик, собираемых из runtime
+	Key               string                     `env:"KEY"`                              // Ключ для подписи данных
+	ServerAddress     string                     `env:"ADDRESS" json:"address"`           // Адрес сервера обработки метрик
+	ServerAddressGRPC string                     `env:"ADDRESS_GRPC" json:"address_grpc"` // Адрес, по которому будут доступны endpoints
+	ConfigFile        string                     `env:"CONFIG"`                           // Адрес файла конфигурации в формате JSON
+	PollInterval      time.Duration              `env:"POLL_INTERVAL"`                    // Интервал сбора метрик агентом
+	ReportInterval    time.Duration              `env:"REPORT_INTERVAL"`                  // Интервал отправки данных на сервер
+	PublicKey         *rsa.PublicKey             // Публичный ключ
+	SignBatch         bool                       `env:"SIGN_BATCH" json:"sign_batch"`         // При true - подписывается все тело запроса целиком (заголовок HashSHA256), а не каждая метрика
+	StreamWindow      int                        `env:"STREAM_WINDOW" json:"stream_window"`   // Максимальное количество неподтвержденных сервером пакетов в потоке gRPC
+	StatusAddress     string                     `env:"STATUS_ADDRESS" json:"status_address"` // Адрес локального сервера статуса агента, пустая строка - сервер не запускается
+	Collectors        map[string]CollectorConfig `json:"collectors"`                          // Настройки коллекторов метрик по имени коллектора
+	EnabledCollectors string                     `env:"COLLECTORS" json:"-"`                  // Список включенных коллекторов через запятую. Если задан - остальные коллекторы выключаются
+	Aggregations      map[string][]string        `json:"aggregations"`                        // Агрегации gauge-метрик между отправками (min, max, mean, last, count, pNN) по имени метрики или шаблону имени
+	Relabel           *metrics.Pipeline          `json:"relabel"`                             // Правила обработки собранных метрик перед отправкой, nil - метрики не меняются
+}
+
+// CollectorConfig - настройки коллектора метрик агента.
+type CollectorConfig struct {
+	Enabled      bool            `json:"enabled"` // При true - коллектор запускается
+	PollInterval time.Duration   // Интервал сбора метрик коллектором, 0 - используется общий интервал PollInterval
+	Options      json.RawMessage `json:"options"` // Параметры, специфичные для коллектора
+}
+
+func (c *CollectorConfig) UnmarshalJSON(data []byte) error {
+	type CollectorConfigAlias CollectorConfig
+	AliasValue := &struct {
+		*CollectorConfigAlias
+		PollInterval string `json:"poll_interval"`
+	}{
+		CollectorConfigAlias: (*CollectorConfigAlias)(c),
+	}
+	if err := json.Unmarshal(data, AliasValue); err != nil {
+		return err
+	}
+	if AliasValue.PollInterval != "" {
+		dur, err := time.ParseDuration(AliasValue.PollInterval)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot parse time duration")
+			return err
+		}
+		c.PollInterval = dur
+	}
+	return nil
+}
+
+// CollectorInterval - интервал сбора метрик коллектором name.
+func (cfg *AgentConfig) CollectorInterval(name string) time.Duration {
+	if c, ok := cfg.Collectors[name]; ok && c.PollInterval > 0 {
+		return c.PollInterval
+	}
+	return cfg.PollInterval
+}
+
+// applyEnabledCollectors - включает коллекторы из списка EnabledCollectors и выключает остальные.
+func (cfg *AgentConfig) applyEnabledCollectors() {
+	if cfg.EnabledCollectors == "" {
+		return
+	}
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(cfg.EnabledCollectors, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			enabled[name] = true
+		}
+	}
+	if cfg.Collectors == nil {
+		cfg.Collectors = make(map[string]CollectorConfig)
+	}
+	for name, c := range cfg.Collectors {
+		c.Enabled = enabled[name]
+		cfg.Collectors[name] = c
+	}
+	for name := range enabled {
+		c := cfg.Collectors[name]
+		c.Enabled = true
+		cfg.Collectors[name] = c
+	}
 }
 
 func (cfg *AgentConfig) UnmarshalJSON(data []byte) error {
@@ -42,15 +116,27 @@ func (cfg *AgentConfig) UnmarshalJSON(data []byte) error {
 	type AgentConfigAlias AgentConfig
 	AliasValue := &struct {
 		*AgentConfigAlias
-		PublicKey      string `json:"crypto_key"`
-		PollInterval   string `json:"poll_interval"`
-		ReportInterval string `json:"report_interval"`
+		PublicKey      string                     `json:"crypto_key"`
+		PollInterval   string                     `json:"poll_interval"`
+		ReportInterval string                     `json:"report_interval"`
+		Collectors     map[string]json.RawMessage `json:"collectors"`
 	}{
 		AgentConfigAlias: (*AgentConfigAlias)(cfg),
 	}
 	if err := json.Unmarshal(data, AliasValue); err != nil {
 		return err
 	}
+	if len(AliasValue.Collectors) > 0 && cfg.Collectors == nil {
+		cfg.Collectors = make(map[string]CollectorConfig)
+	}
+	for name, raw := range AliasValue.Collectors {
+		// настройки из файла дополняют настройки по умолчанию: поля, которых нет в файле (например, enabled), не сбрасываются
+		c := cfg.Collectors[name]
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		cfg.Collectors[name] = c
+	}
 	if AliasValue.PublicKey != "" {
 		pk, err := getPublicKey(AliasValue.PublicKey)
 		if err != nil {
@@ -174,6 +260,28 @@ func (cfg *AgentConfig) flagsRead() {
 		}
 		return nil
 	})
+	flag.Func("status-address", "local agent status server address like <host>:<port>, disabled by default, example: -status-address \"127.0.0.1:9100\"", func(flagValue string) error {
+		if flagValue != "" {
+			cfg.StatusAddress = flagValue
+		}
+		return nil
+	})
+	flag.Func("collectors", "comma separated list of enabled collectors, others are disabled, example: -collectors \"runtime,system\"", func(flagValue string) error {
+		if flagValue != "" {
+			cfg.EnabledCollectors = flagValue
+		}
+		return nil
+	})
+	flag.Func("sign-batch", "true/false for sign whole request body instead of every metric, example: -sign-batch=true", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.ParseBool(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.SignBatch = value
+		}
+		return nil
+	})
 	flag.Parse()
 }
 
@@ -189,6 +297,11 @@ func LoadAgentConfig() *AgentConfig {
 		PollInterval:   time.Duration(2 * time.Second),
 		ReportInterval: time.Duration(10 * time.Second),
 		Key:            "",
+		StreamWindow:   4,
+		Collectors: map[string]CollectorConfig{
+			"runtime": {Enabled: true},
+			"system":  {Enabled: true},
+		},
 		Metrics: map[string]string{
 			"Alloc":         "gauge",
 			"BuckHashSys":   "gauge",
@@ -229,6 +342,7 @@ func LoadAgentConfig() *AgentConfig {
 		flag.Parse()
 		cfg.envRead()
 	}
+	cfg.applyEnabledCollectors()
 	return cfg
 }
 
@@ -248,24 +362,62 @@ func HTTPSend(client *http.Client, url string) error {
 	return nil
 }
 
-// HTTPSendJSON - производит отправку json-метрики (в виде []byte) на сервер по указанному URL.
-func HTTPSendJSON(client *http.Client, url string, postBody []byte) error {
+// StatusError - ответ сервера с неуспешным статусом.
+type StatusError struct {
+	Code       int           // Код статуса HTTP
+	Body       string        // Тело ответа
+	RetryAfter time.Duration // Время до повторного запроса из заголовка Retry-After, 0 - заголовка нет
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Body)
+}
+
+// parseRetryAfter - разбирает заголовок Retry-After: число секунд или дату HTTP.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// HTTPSendJSON - производит отправку json-метрики (в виде []byte) на сервер по указанному URL и возвращает тело ответа.
+//
+// Если передан hash - он отправляется в заголовке HashSHA256 как подпись всего тела запроса. При неуспешном статусе возвращается *StatusError.
+func HTTPSendJSON(client *http.Client, url string, postBody []byte, hash string) ([]byte, error) {
 	body := bytes.NewBuffer(postBody)
 	request, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("X-Real-IP", GetLocalIP())
+	if hash != "" {
+		request.Header.Set(metrics.HashHeader, hash)
+	}
 	response, err := client.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer response.Body.Close()
-	if response.StatusCode != 200 {
-		return err
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if response.StatusCode != http.StatusOK {
+		return respBody, &StatusError{
+			Code:       response.StatusCode,
+			Body:       strings.TrimSpace(string(respBody)),
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return respBody, nil
 }
 
 // LogConfig - настраивает формат логирования для zerolog.
@@ -277,6 +429,26 @@ func LogConfig() zerolog.ConsoleWriter {
 	return output
 }
 
+// EncryptRSA - шифрует данные публичным ключом по схеме RSA-OAEP (SHA-256).
+//
+// Данные, которые не помещаются в один блок, шифруются по частям: каждая часть занимает ровно pub.Size() байт.
+func EncryptRSA(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	step := pub.Size() - 2*sha256.Size - 2
+	var result []byte
+	for start := 0; start < len(data) || start == 0; start += step {
+		end := start + step
+		if end > len(data) {
+			end = len(data)
+		}
+		block, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data[start:end], nil)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, block...)
+	}
+	return result, nil
+}
+
 func getPublicKey(file string) (*rsa.PublicKey, error) {
 	byte, err := os.ReadFile(file)
 	if err != nil {
@@ -293,17 +465,25 @@ func getPublicKey(file string) (*rsa.PublicKey, error) {
 	return pk, nil
 }
 
+// GetLocalIP - адрес агента для заголовка X-Real-IP: первый адрес IPv4, кроме loopback, а если таких нет - первый глобальный адрес IPv6.
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return ""
 	}
+	var ipv6 string
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+		// link-local адреса IPv6 без зоны интерфейса не имеют смысла для сервера
+		if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+			ipv6 = ipnet.IP.String()
 		}
 	}
-	return ""
+	return ipv6
 }
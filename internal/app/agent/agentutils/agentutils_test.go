@@ -0,0 +1,27 @@
+package agentutils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalCollectors(t *testing.T) {
+	cfg := &AgentConfig{
+		Collectors: map[string]CollectorConfig{
+			"runtime": {Enabled: true},
+			"system":  {Enabled: true},
+		},
+	}
+	data := `{"collectors": {"runtime": {"poll_interval": "5s"}, "system": {"enabled": false}, "exec": {"enabled": true, "options": {"commands": []}}}}`
+	require.NoError(t, json.Unmarshal([]byte(data), cfg))
+
+	assert.True(t, cfg.Collectors["runtime"].Enabled, "partial override keeps the default enabled flag")
+	assert.Equal(t, 5*time.Second, cfg.Collectors["runtime"].PollInterval)
+	assert.False(t, cfg.Collectors["system"].Enabled)
+	assert.True(t, cfg.Collectors["exec"].Enabled)
+	assert.JSONEq(t, `{"commands": []}`, string(cfg.Collectors["exec"].Options))
+}
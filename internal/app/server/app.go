@@ -5,14 +5,18 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/colzphml/yandex_project/internal/scenarios/handlers"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
 	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
 	"github.com/colzphml/yandex_project/internal/middleware"
+	"github.com/colzphml/yandex_project/internal/scenarios"
 	cgrpc "github.com/colzphml/yandex_project/internal/scenarios/grpc"
 	"github.com/colzphml/yandex_project/internal/storage"
 	"github.com/go-chi/chi/v5"
@@ -25,25 +29,49 @@ func HTTPServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage
 	h := handlers.New(ctx, repo, cfg)
 	r := chi.NewRouter()
 	r.Use(middleware.GzipHandle)
+	r.Use(middleware.ClientIP(cfg))
 	r.Use(middleware.SubNet(cfg))
 	r.Use(chimiddleware.RequestID)
-	r.Use(chimiddleware.RealIP)
+	if !cfg.TrustPeer {
+		// RemoteAddr из заголовков (True-Client-IP, X-Real-IP, X-Forwarded-For) попадает только в журнал: подсети, частота запросов и квоты проверяются по адресу из ClientIP
+		r.Use(chimiddleware.RealIP)
+	}
 	r.Use(chimiddleware.Logger)
+	r.Use(middleware.Metrics)
 	r.Use(chimiddleware.Recoverer)
-	r.Post("/update/{metric_type}/{metric_name}/{metric_value}", h.SaveHandler)
-	r.Get("/value/{metric_type}/{metric_name}", h.GetValueHandler)
-	r.Route("/update", func(r chi.Router) {
-		r.Use(middleware.RSAHandler(cfg))
-		r.Post("/", h.SaveJSONHandler)
+	limiter := middleware.NewRateLimiter(cfg.RateLimits)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RateLimit(limiter, middleware.RouteGroupUpdate))
+		r.Post("/update/{metric_type}/{metric_name}/{metric_value}", h.SaveHandler)
+		r.Route("/update", func(r chi.Router) {
+			r.Use(middleware.RSAHandler(cfg))
+			r.Use(middleware.BodySign(cfg))
+			r.Post("/", h.SaveJSONHandler)
+		})
+		r.With(middleware.RSAHandler(cfg), middleware.BodySign(cfg)).Post("/updates/", h.SaveJSONArrayHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RateLimit(limiter, middleware.RouteGroupValue))
+		r.Get("/value/{metric_type}/{metric_name}", h.GetValueHandler)
+		r.Post("/value/", h.GetJSONValueHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RateLimit(limiter, middleware.RouteGroupRoot))
+		r.Get("/ping", h.PingHandler)
+		r.Get("/watch", h.WatchHandler)
+		if cfg.DebugEndpoints {
+			// отладочные маршруты раскрывают внутреннее состояние сервера, поэтому по умолчанию выключены
+			r.Get("/debug/metrics", h.SelfMetricsHandler)
+			r.Get("/debug/cardinality", h.CardinalityHandler)
+		}
+		r.Get("/", h.ListMetricsHandler)
 	})
-	r.Post("/updates/", h.SaveJSONArrayHandler)
-	r.Post("/value/", h.GetJSONValueHandler)
-	r.Get("/ping", h.PingHandler)
-	r.Get("/", h.ListMetricsHandler)
 	srv := &http.Server{
 		Addr:    cfg.ServerAddress,
 		Handler: r,
 	}
+	// подписки /watch и Watch не завершаются сами, поэтому при остановке сервера их каналы закрываются
+	srv.RegisterOnShutdown(scenarios.Updates.Close)
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("failed initialize server")
@@ -52,16 +80,39 @@ func HTTPServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage
 	return srv
 }
 
-func GRPCServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage.Repositorier) *grpc.Server {
-	listen, err := net.Listen("tcp", ":3200")
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed initialize gRPC server")
-	}
-	s := grpc.NewServer(grpc.UnaryInterceptor(middleware.SubNetGRPCInterceptor(cfg)))
+// healthInterval - интервал обновления статуса сервиса проверки здоровья gRPC.
+const healthInterval = 10 * time.Second
+
+// NewGRPCServer - создает сервер gRPC с сервисом метрик, сервисом проверки здоровья и, если включено, сервисом рефлексии.
+//
+// Статус сервиса проверки здоровья обновляется до отмены ctx, поэтому ctx нужно отменить при остановке сервера.
+func NewGRPCServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage.Repositorier) *grpc.Server {
+	s := grpc.NewServer(middleware.GRPCServerOptions(cfg)...)
 	pb.RegisterMetricsServer(s, &cgrpc.MetricsServer{
 		Cfg:  cfg,
 		Repo: repo,
 	})
+	healthServer := cgrpc.NewHealthServer(repo)
+	healthServer.Update(ctx)
+	go healthServer.Run(ctx, healthInterval)
+	healthpb.RegisterHealthServer(s, healthServer)
+	if cfg.GRPCReflection {
+		reflection.Register(s)
+	}
+	return s
+}
+
+// GRPCServer - запускает сервер gRPC на адресе cfg.ServerAddressGRPC. Если gRPC отключен - возвращает nil.
+func GRPCServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage.Repositorier) *grpc.Server {
+	if cfg.GRPCDisable {
+		log.Info().Msg("gRPC server disabled")
+		return nil
+	}
+	listen, err := net.Listen("tcp", cfg.ServerAddressGRPC)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed initialize gRPC server")
+	}
+	s := NewGRPCServer(ctx, cfg, repo)
 	go func() {
 		if err := s.Serve(listen); err != nil && err != grpc.ErrServerStopped {
 			log.Fatal().Err(err).Msg("failed initialize server")
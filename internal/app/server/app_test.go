@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/storage"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// brokenRepo - хранилище, которое всегда недоступно.
+type brokenRepo struct {
+	*filerepo.MetricRepo
+}
+
+func (r brokenRepo) Ping(ctx context.Context) error {
+	return errors.New("storage is not available")
+}
+
+type GRPCServerSuite struct {
+	suite.Suite
+	cfg      *serverutils.ServerConfig
+	repo     *filerepo.MetricRepo
+	listener *bufconn.Listener
+	srv      *grpc.Server
+	conn     *grpc.ClientConn
+	cancel   context.CancelFunc
+}
+
+func (suite *GRPCServerSuite) SetupTest() {
+	suite.cfg = &serverutils.ServerConfig{StoreInterval: time.Minute}
+	repo, err := filerepo.NewMetricRepo(suite.cfg)
+	suite.Require().NoError(err)
+	suite.repo = repo
+}
+
+func (suite *GRPCServerSuite) TearDownTest() {
+	if suite.conn != nil {
+		suite.conn.Close()
+		suite.conn = nil
+	}
+	if suite.srv != nil {
+		suite.srv.Stop()
+		suite.srv = nil
+	}
+	if suite.cancel != nil {
+		suite.cancel()
+		suite.cancel = nil
+	}
+}
+
+// start - запускает сервер gRPC поверх bufconn и подключается к нему.
+func (suite *GRPCServerSuite) start(repo storage.Repositorier) {
+	var ctx context.Context
+	ctx, suite.cancel = context.WithCancel(context.Background())
+	suite.listener = bufconn.Listen(1024 * 1024)
+	suite.srv = NewGRPCServer(ctx, suite.cfg, repo)
+	go suite.srv.Serve(suite.listener)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return suite.listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	suite.Require().NoError(err)
+	suite.conn = conn
+}
+
+func (suite *GRPCServerSuite) TestPing() {
+	suite.start(suite.repo)
+	resp, err := pb.NewMetricsClient(suite.conn).Ping(context.Background(), &pb.PingRequest{})
+	suite.NoError(err)
+	suite.True(resp.Ping)
+}
+
+func (suite *GRPCServerSuite) TestHealthServing() {
+	suite.start(suite.repo)
+	client := healthpb.NewHealthClient(suite.conn)
+	for _, service := range []string{"", pb.Metrics_ServiceDesc.ServiceName} {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		suite.NoError(err)
+		suite.Equal(healthpb.HealthCheckResponse_SERVING, resp.Status)
+	}
+}
+
+func (suite *GRPCServerSuite) TestHealthNotServing() {
+	suite.start(brokenRepo{MetricRepo: suite.repo})
+	resp, err := healthpb.NewHealthClient(suite.conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	suite.NoError(err)
+	suite.Equal(healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+}
+
+func (suite *GRPCServerSuite) TestReflectionEnabled() {
+	suite.cfg.GRPCReflection = true
+	suite.start(suite.repo)
+	stream, err := reflectionpb.NewServerReflectionClient(suite.conn).ServerReflectionInfo(context.Background())
+	suite.Require().NoError(err)
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	suite.Require().NoError(err)
+	resp, err := stream.Recv()
+	suite.Require().NoError(err)
+	var services []string
+	for _, v := range resp.GetListServicesResponse().Service {
+		services = append(services, v.Name)
+	}
+	suite.Contains(services, pb.Metrics_ServiceDesc.ServiceName)
+	suite.Contains(services, healthpb.Health_ServiceDesc.ServiceName)
+}
+
+func (suite *GRPCServerSuite) TestReflectionDisabled() {
+	suite.start(suite.repo)
+	stream, err := reflectionpb.NewServerReflectionClient(suite.conn).ServerReflectionInfo(context.Background())
+	suite.Require().NoError(err)
+	_, err = stream.Recv()
+	suite.Equal(codes.Unimplemented, status.Code(err))
+}
+
+func (suite *GRPCServerSuite) TestGRPCServerDisabled() {
+	suite.cfg.GRPCDisable = true
+	suite.Nil(GRPCServer(context.Background(), suite.cfg, suite.repo))
+}
+
+func (suite *GRPCServerSuite) TestGRPCServerAddress() {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	suite.cfg.ServerAddressGRPC = listen.Addr().String()
+	listen.Close()
+	var ctx context.Context
+	ctx, suite.cancel = context.WithCancel(context.Background())
+	suite.srv = GRPCServer(ctx, suite.cfg, suite.repo)
+	suite.Require().NotNil(suite.srv)
+	conn, err := grpc.Dial(suite.cfg.ServerAddressGRPC, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	suite.Require().NoError(err)
+	suite.conn = conn
+	resp, err := pb.NewMetricsClient(conn).Ping(context.Background(), &pb.PingRequest{}, grpc.WaitForReady(true))
+	suite.NoError(err)
+	suite.True(resp.Ping)
+}
+
+func TestGRPCServerSuite(t *testing.T) {
+	suite.Run(t, new(GRPCServerSuite))
+}
@@ -3,6 +3,7 @@
 package serverutils
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/colzphml/yandex_project/internal/metrics"
 	"github.com/rs/zerolog"
 )
 
@@ -24,25 +26,116 @@ var log = zerolog.New(LogConfig()).With().Timestamp().Str("component", "serverut
 
 // ServerConfig - конфигурация сервера для старта.
 type ServerConfig struct {
-	DBDSN             string          `env:"DATABASE_DSN" json:"database_dsn"`     // URL для подключения к Postgres
-	Key               string          `env:"KEY"`                                  // Ключ для подписи данных
-	ServerAddress     string          `env:"ADDRESS" json:"address"`               // Адрес, по которому будут доступны endpoints
-	ServerAddressGRPC string          `env:"ADDRESS_GRPC" json:"address_grpc"`     // Адрес, по которому будут доступны endpoints
-	StoreFile         string          `env:"STORE_FILE" json:"store_file"`         // Адрес файла для хранения метрик
-	ConfigFile        string          `env:"CONFIG"`                               // Адрес файла конфигурации в формате JSON
-	Restore           bool            `env:"RESTORE" json:"restore"`               // При true - значения метрик в памяти сервера восстановится из хранилища, при false - в памяти будет пустое хранилище
-	StoreInterval     time.Duration   `env:"STORE_INTERVAL" json:"store_interval"` // Интервал сохраниения данных при использовании файла как хранилища
-	PrivateKey        *rsa.PrivateKey // приватный ключ
-	TrustedSubnet     *net.IPNet      `json:"trusted_subnet"` // Подсеть доверенных адресов
+	DBDSN               string               `env:"DATABASE_DSN" json:"database_dsn"`     // URL для подключения к Postgres
+	Key                 string               `env:"KEY"`                                  // Ключ для подписи данных
+	ServerAddress       string               `env:"ADDRESS" json:"address"`               // Адрес, по которому будут доступны endpoints
+	ServerAddressGRPC   string               `env:"ADDRESS_GRPC" json:"address_grpc"`     // Адрес, по которому будут доступны endpoints
+	StoreFile           string               `env:"STORE_FILE" json:"store_file"`         // Адрес файла для хранения метрик
+	ConfigFile          string               `env:"CONFIG"`                               // Адрес файла конфигурации в формате JSON
+	Restore             bool                 `env:"RESTORE" json:"restore"`               // При true - значения метрик в памяти сервера восстановится из хранилища, при false - в памяти будет пустое хранилище
+	StoreInterval       time.Duration        `env:"STORE_INTERVAL" json:"store_interval"` // Интервал сохраниения данных при использовании файла как хранилища
+	PrivateKey          *rsa.PrivateKey      // приватный ключ
+	TrustedSubnet       *net.IPNet           `json:"trusted_subnet"`                                    // Подсеть доверенных адресов, добавляется к AllowedSubnets
+	AllowedSubnets      Subnets              `json:"allowed_subnets"`                                   // Подсети IPv4 и IPv6, из которых разрешены запросы, пустой список - разрешены все адреса
+	DeniedSubnets       Subnets              `json:"denied_subnets"`                                    // Подсети IPv4 и IPv6, из которых запросы запрещены, приоритетнее разрешенных
+	RouteAccess         map[string]Access    `json:"route_access"`                                      // Доступ к группам маршрутов update, value и root: свой список разрешенных подсетей заменяет общий, запрещенные подсети добавляются к общим
+	TrustPeer           bool                 `env:"TRUST_PEER" json:"trust_peer"`                       // При true - адрес клиента берется из соединения, а заголовок и метаданные X-Real-IP заменяются им
+	GRPCDisable         bool                 `env:"GRPC_DISABLE" json:"grpc_disable"`                   // При true - сервер gRPC не запускается
+	GRPCReflection      bool                 `env:"GRPC_REFLECTION" json:"grpc_reflection"`             // При true - включается сервис рефлексии gRPC
+	SelfMetricsInterval time.Duration        `env:"SELF_METRICS_INTERVAL" json:"self_metrics_interval"` // Интервал записи внутренних метрик сервера в хранилище, 0 - не записывать
+	DebugEndpoints      bool                 `env:"DEBUG_ENDPOINTS" json:"debug_endpoints"`             // При true - включаются отладочные маршруты /debug/*
+	Relabel             *metrics.Pipeline    `json:"relabel"`                                           // Правила обработки принятых метрик перед сохранением, nil - метрики сохраняются без изменений
+	MaxMetrics          int                  `env:"MAX_METRICS" json:"max_metrics"`                     // Максимальное количество разных метрик в хранилище, 0 - без ограничения
+	MaxClientMetrics    int                  `env:"MAX_CLIENT_METRICS" json:"max_client_metrics"`       // Максимальное количество разных метрик, созданных одним клиентом (адресом или подсетью), 0 - без ограничения
+	QuotaPrefixV4       int                  `env:"QUOTA_PREFIX_V4" json:"quota_prefix_v4"`             // Длина префикса подсети IPv4, адреса из которой считаются одним клиентом для MaxClientMetrics
+	QuotaPrefixV6       int                  `env:"QUOTA_PREFIX_V6" json:"quota_prefix_v6"`             // Длина префикса подсети IPv6, адреса из которой считаются одним клиентом для MaxClientMetrics
+	MaxIDLength         int                  `env:"MAX_ID_LENGTH" json:"max_id_length"`                 // Максимальная длина имени метрики (столбец id в БД - varchar(50))
+	RateLimits          map[string]RateLimit `json:"rate_limits"`                                       // Ограничения частоты запросов одного клиента по группам маршрутов: update, value и root (остальные маршруты)
+}
+
+// Subnets - список подсетей IPv4 и IPv6. В переменных окружения и флагах задается через запятую, в JSON - массивом строк.
+type Subnets []*net.IPNet
+
+// ParseSubnets - разбирает подсети в формате CIDR, перечисленные через запятую. Адрес без префикса считается подсетью из одного адреса.
+func ParseSubnets(value string) (Subnets, error) {
+	var result Subnets
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid subnet %q", item)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, subnet)
+	}
+	return result, nil
+}
+
+// Contains - проверяет, что адрес входит хотя бы в одну подсеть списка.
+func (s Subnets) Contains(ip net.IP) bool {
+	for _, subnet := range s {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Subnets) String() string {
+	items := make([]string, 0, len(s))
+	for _, subnet := range s {
+		items = append(items, subnet.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (s *Subnets) UnmarshalJSON(data []byte) error {
+	var items []string
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	parsed, err := ParseSubnets(strings.Join(items, ","))
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// Access - разрешенные и запрещенные подсети группы маршрутов.
+type Access struct {
+	Allow Subnets `json:"allow"` // Подсети, из которых разрешены запросы к группе, пустой список - действует общий AllowedSubnets
+	Deny  Subnets `json:"deny"`  // Подсети, из которых запросы к группе запрещены
+}
+
+// RateLimit - ограничение частоты запросов одного клиента: в среднем Rate запросов в секунду, но не больше Burst подряд.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // Запросов в секунду, 0 - без ограничения
+	Burst int     `json:"burst"` // Запас запросов подряд, по умолчанию - Rate, округленный вверх
 }
 
 func (cfg *ServerConfig) UnmarshalJSON(data []byte) error {
 	type ServerConfigAlias ServerConfig
 	AliasValue := &struct {
 		*ServerConfigAlias
-		PrivateKey    string `json:"crypto_key"`
-		StoreInterval string `json:"store_interval"`
-		TrustedSubnet string `json:"trusted_subnet"`
+		PrivateKey          string `json:"crypto_key"`
+		StoreInterval       string `json:"store_interval"`
+		TrustedSubnet       string `json:"trusted_subnet"`
+		SelfMetricsInterval string `json:"self_metrics_interval"`
 	}{
 		ServerConfigAlias: (*ServerConfigAlias)(cfg),
 	}
@@ -65,6 +158,14 @@ func (cfg *ServerConfig) UnmarshalJSON(data []byte) error {
 		}
 		cfg.StoreInterval = dur
 	}
+	if AliasValue.SelfMetricsInterval != "" {
+		dur, err := time.ParseDuration(AliasValue.SelfMetricsInterval)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot parse time duration")
+			return err
+		}
+		cfg.SelfMetricsInterval = dur
+	}
 	if AliasValue.TrustedSubnet != "" {
 		_, subnet, err := net.ParseCIDR(AliasValue.TrustedSubnet)
 		if err != nil {
@@ -113,6 +214,22 @@ func (cfg *ServerConfig) envRead() {
 		}
 		cfg.TrustedSubnet = subn
 	}
+	if allowed := os.Getenv("ALLOWED_SUBNETS"); allowed != "" {
+		subnets, err := ParseSubnets(allowed)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot parse allowed subnets")
+			return
+		}
+		cfg.AllowedSubnets = subnets
+	}
+	if denied := os.Getenv("DENIED_SUBNETS"); denied != "" {
+		subnets, err := ParseSubnets(denied)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot parse denied subnets")
+			return
+		}
+		cfg.DeniedSubnets = subnets
+	}
 }
 
 // flagsRead - считывает флаги запуска и заполняет структуру ServerConfig.
@@ -195,12 +312,104 @@ func (cfg *ServerConfig) flagsRead() {
 		}
 		return nil
 	})
+	flag.Func("allow", "allowed subnets separated by comma, IPv4 or IPv6, example: -allow \"192.168.1.0/24,fd00::/8\"", func(flagValue string) error {
+		if flagValue != "" {
+			subnets, err := ParseSubnets(flagValue)
+			if err != nil {
+				log.Error().Err(err).Msg("cannot parse allowed subnets")
+				return err
+			}
+			cfg.AllowedSubnets = subnets
+		}
+		return nil
+	})
+	flag.Func("deny", "denied subnets separated by comma, IPv4 or IPv6, example: -deny \"192.168.1.13,2001:db8::/32\"", func(flagValue string) error {
+		if flagValue != "" {
+			subnets, err := ParseSubnets(flagValue)
+			if err != nil {
+				log.Error().Err(err).Msg("cannot parse denied subnets")
+				return err
+			}
+			cfg.DeniedSubnets = subnets
+		}
+		return nil
+	})
+	flag.Func("trust-peer", "true/false for take client address from connection instead of X-Real-IP, example: -trust-peer=true", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.ParseBool(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.TrustPeer = value
+		}
+		return nil
+	})
 	flag.Func("g", "server gRPC address like <server>:<port>, example: -a \"127.0.0.1:8080\"", func(flagValue string) error {
 		if flagValue != "" {
 			cfg.ServerAddressGRPC = flagValue
 		}
 		return nil
 	})
+	flag.Func("grpc-disable", "true/false for disable gRPC server, example: -grpc-disable=true", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.ParseBool(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.GRPCDisable = value
+		}
+		return nil
+	})
+	flag.Func("grpc-reflection", "true/false for enable gRPC server reflection, example: -grpc-reflection=true", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.ParseBool(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.GRPCReflection = value
+		}
+		return nil
+	})
+	flag.Func("self-metrics-interval", "time duration for store server self metrics under prefix _server., 0 - disabled, example: -self-metrics-interval \"10s\"", func(flagValue string) error {
+		if flagValue != "" {
+			interval, err := time.ParseDuration(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.SelfMetricsInterval = interval
+		}
+		return nil
+	})
+	flag.Func("debug-endpoints", "true/false for enable debug endpoints /debug/*, example: -debug-endpoints=true", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.ParseBool(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.DebugEndpoints = value
+		}
+		return nil
+	})
+	flag.Func("max-metrics", "max distinct metrics in storage, 0 - unlimited, example: -max-metrics 10000", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.Atoi(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.MaxMetrics = value
+		}
+		return nil
+	})
+	flag.Func("max-client-metrics", "max distinct metrics created by one client address or subnet, 0 - unlimited, example: -max-client-metrics 500", func(flagValue string) error {
+		if flagValue != "" {
+			value, err := strconv.Atoi(flagValue)
+			if err != nil {
+				return err
+			}
+			cfg.MaxClientMetrics = value
+		}
+		return nil
+	})
 	flag.Parse()
 }
 
@@ -212,11 +421,15 @@ func (cfg *ServerConfig) flagsRead() {
 func LoadServerConfig() *ServerConfig {
 	//flags config
 	cfg := &ServerConfig{
-		ServerAddress: "127.0.0.1:8080",
-		StoreInterval: time.Duration(300 * time.Second),
-		StoreFile:     "./tmp/devops-metrics-db.json",
-		Restore:       false,
-		Key:           "",
+		ServerAddress:     "127.0.0.1:8080",
+		ServerAddressGRPC: ":3200",
+		StoreInterval:     time.Duration(300 * time.Second),
+		StoreFile:         "./tmp/devops-metrics-db.json",
+		Restore:           false,
+		Key:               "",
+		QuotaPrefixV4:     32,
+		QuotaPrefixV6:     128,
+		MaxIDLength:       50,
 	}
 	cfg.flagsRead()
 	//env config
@@ -239,6 +452,23 @@ func LogConfig() zerolog.ConsoleWriter {
 	return output
 }
 
+// DecryptRSA - расшифровывает данные, зашифрованные по схеме RSA-OAEP (SHA-256) по частям размером в один блок ключа.
+func DecryptRSA(pk *rsa.PrivateKey, data []byte) ([]byte, error) {
+	size := pk.Size()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, errors.New("encrypted data is not aligned to key size")
+	}
+	var result []byte
+	for start := 0; start < len(data); start += size {
+		block, err := pk.Decrypt(nil, data[start:start+size], &rsa.OAEPOptions{Hash: crypto.SHA256})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, block...)
+	}
+	return result, nil
+}
+
 func getPrivateKey(file string) (*rsa.PrivateKey, error) {
 	byte, err := os.ReadFile(file)
 	if err != nil {
@@ -11,6 +11,9 @@ import (
 	"strconv"
 )
 
+// HashHeader - имя заголовка HTTP (и ключа метаданных gRPC), в котором передается подпись всего тела запроса.
+const HashHeader = "HashSHA256"
+
 // Ошибки при работе с метриками
 var (
 	ErrUndefinedType = errors.New("type of metric undefined") // Тип метрики не определен
@@ -18,6 +21,41 @@ var (
 	ErrWrongType     = errors.New("metric have another type") // Обрабатываемая метрика должна иметь другой тип
 )
 
+// Статусы обработки отдельной метрики из пакета.
+const (
+	StatusAccepted      = "accepted"       // Метрика сохранена
+	StatusTypeConflict  = "type_conflict"  // Метрика уже сохранена с другим типом
+	StatusBadSignature  = "bad_signature"  // Подпись метрики не совпала
+	StatusParseError    = "parse_error"    // Метрику не удалось разобрать
+	StatusInternalError = "internal_error" // Ошибка хранилища, отправку можно повторить
+	StatusQuotaExceeded = "quota_exceeded" // Превышено ограничение на количество метрик
+)
+
+// ItemStatus - результат обработки отдельной метрики из пакета.
+type ItemStatus struct {
+	ID     string `json:"id"`              // имя метрики
+	MType  string `json:"type"`            // тип метрики
+	Status string `json:"status"`          // статус обработки
+	Error  string `json:"error,omitempty"` // описание ошибки
+}
+
+// BatchResult - результат обработки пакета метрик.
+type BatchResult struct {
+	Accepted int          `json:"accepted"` // количество сохраненных метрик
+	Rejected int          `json:"rejected"` // количество отклоненных метрик
+	Items    []ItemStatus `json:"items"`    // статусы по каждой метрике
+}
+
+// Add - добавляет в результат статус обработки метрики и пересчитывает счетчики.
+func (b *BatchResult) Add(item ItemStatus) {
+	if item.Status == StatusAccepted {
+		b.Accepted++
+	} else {
+		b.Rejected++
+	}
+	b.Items = append(b.Items, item)
+}
+
 // Metrics - структура, описывающая основные атрибуты метрики.
 type Metrics struct {
 	ID    string   `json:"id"`              // имя метрики
@@ -39,6 +77,39 @@ func (m *Metrics) ValueString() string {
 	}
 }
 
+// Validate - проверяет, что у метрики заполнены имя, известный тип и соответствующее типу значение.
+func (m *Metrics) Validate() error {
+	if m.ID == "" {
+		return ErrParseMetric
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return ErrParseMetric
+		}
+	case "counter":
+		if m.Delta == nil {
+			return ErrParseMetric
+		}
+	default:
+		return ErrUndefinedType
+	}
+	return nil
+}
+
+// Status - создает статус обработки метрики.
+func (m *Metrics) Status(status string, err error) ItemStatus {
+	result := ItemStatus{
+		ID:     m.ID,
+		MType:  m.MType,
+		Status: status,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
 // CalculateHash - рассчитывает hash для метрики.
 func (m *Metrics) CalculateHash(key string) ([]byte, error) {
 	var src string
@@ -50,7 +121,7 @@ func (m *Metrics) CalculateHash(key string) ([]byte, error) {
 	default:
 		return nil, ErrUndefinedType
 	}
-	hash, err := signData(src, key)
+	hash, err := signData([]byte(src), key)
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +156,32 @@ func (m *Metrics) CompareHash(key string) (bool, error) {
 	return true, nil
 }
 
-// signData - рассчитывает hash с ключем для строки.
-func signData(src, key string) ([]byte, error) {
+// SignBody - рассчитывает подпись тела запроса целиком и возвращает ее в виде hex-строки.
+func SignBody(body []byte, key string) (string, error) {
+	hash, err := signData(body, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+// CompareBodyHash - проверяет подпись тела запроса целиком.
+func CompareBodyHash(body []byte, key string, hash string) (bool, error) {
+	expected, err := signData(body, key)
+	if err != nil {
+		return false, err
+	}
+	data, err := hex.DecodeString(hash)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(expected, data), nil
+}
+
+// signData - рассчитывает hash с ключем для набора байт.
+func signData(src []byte, key string) ([]byte, error) {
 	h := hmac.New(sha256.New, []byte(key))
-	_, err := h.Write([]byte(src))
+	_, err := h.Write(src)
 	if err != nil {
 		return nil, err
 	}
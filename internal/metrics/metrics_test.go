@@ -310,6 +310,60 @@ func TestMetrics_CompareHash(t *testing.T) {
 	}
 }
 
+func TestCompareBodyHash(t *testing.T) {
+	body := []byte(`[{"id":"test","type":"gauge","value":7.77}]`)
+	hash, err := SignBody(body, "test")
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		body    []byte
+		key     string
+		hash    string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "Test #1: correct body hash",
+			body: body,
+			key:  "test",
+			hash: hash,
+			want: true,
+		},
+		{
+			name: "Test #2: body changed",
+			body: []byte(`[{"id":"test","type":"gauge","value":7.78}]`),
+			key:  "test",
+			hash: hash,
+			want: false,
+		},
+		{
+			name: "Test #3: another key",
+			body: body,
+			key:  "another",
+			hash: hash,
+			want: false,
+		},
+		{
+			name:    "Test #4: hash is not hex",
+			body:    body,
+			key:     "test",
+			hash:    "not hex",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CompareBodyHash(tt.body, tt.key, tt.hash)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
 func BenchmarkFillHash(b *testing.B) {
 	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	buf := make([]rune, 10)
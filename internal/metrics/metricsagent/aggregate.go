@@ -0,0 +1,142 @@
+package metricsagent
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// aggregation - агрегация значений gauge за период между отправками.
+type aggregation struct {
+	name string  // суффикс производной метрики: min, max, mean, last, count или pNN
+	p    float64 // перцентиль для pNN
+}
+
+// aggregationRule - агрегации для метрик с именем, подходящим под шаблон.
+type aggregationRule struct {
+	pattern string
+	aggs    []aggregation
+}
+
+// parseAggregation - разбирает агрегацию: min, max, mean, last, count или перцентиль pNN (например, p99 или p99.9).
+func parseAggregation(s string) (aggregation, error) {
+	switch s {
+	case "min", "max", "mean", "last", "count":
+		return aggregation{name: s}, nil
+	}
+	if strings.HasPrefix(s, "p") {
+		p, err := strconv.ParseFloat(s[1:], 64)
+		if err == nil && p > 0 && p <= 100 {
+			return aggregation{name: s, p: p}, nil
+		}
+	}
+	return aggregation{}, fmt.Errorf("unknown aggregation %q", s)
+}
+
+// SetAggregations - включает агрегацию gauge-метрик между отправками: для каждой метрики, имя которой совпадает с ключом rules или подходит под него как шаблон path.Match, при отправке добавляются производные метрики <name>.<aggregation> по всем значениям, собранным с прошлой отправки.
+//
+// Точное совпадение имени приоритетнее шаблона, из нескольких шаблонов выбирается первый по алфавиту.
+func (repo *MetricRepo) SetAggregations(rules map[string][]string) error {
+	var parsed []aggregationRule
+	for pattern, list := range rules {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("aggregation %s: %w", pattern, err)
+		}
+		rule := aggregationRule{pattern: pattern}
+		for _, s := range list {
+			agg, err := parseAggregation(s)
+			if err != nil {
+				return fmt.Errorf("aggregation %s: %w", pattern, err)
+			}
+			rule.aggs = append(rule.aggs, agg)
+		}
+		parsed = append(parsed, rule)
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].pattern < parsed[j].pattern
+	})
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.aggregations = parsed
+	repo.window = make(map[string][]float64)
+	return nil
+}
+
+// aggregationsFor - агрегации для метрики id, nil - метрика не агрегируется.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) aggregationsFor(id string) []aggregation {
+	for _, rule := range repo.aggregations {
+		if rule.pattern == id {
+			return rule.aggs
+		}
+	}
+	for _, rule := range repo.aggregations {
+		if ok, _ := path.Match(rule.pattern, id); ok {
+			return rule.aggs
+		}
+	}
+	return nil
+}
+
+// observe - запоминает значение gauge для агрегации, если для метрики настроены агрегации.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) observe(m metrics.Metrics) {
+	if len(repo.aggregations) == 0 || m.MType != "gauge" || m.Value == nil {
+		return
+	}
+	if repo.aggregationsFor(m.ID) == nil {
+		return
+	}
+	repo.window[m.ID] = append(repo.window[m.ID], *m.Value)
+}
+
+// aggregate - производные метрики по значениям, собранным с прошлой отправки. Собранные значения сбрасываются.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) aggregate() []metrics.Metrics {
+	var result []metrics.Metrics
+	for id, values := range repo.window {
+		for _, agg := range repo.aggregationsFor(id) {
+			result = append(result, gauge(id+"."+agg.name, aggregateValues(agg, values)))
+		}
+		delete(repo.window, id)
+	}
+	return result
+}
+
+// aggregateValues - значение агрегации agg по непустому набору значений. Перцентили считаются по ближайшему рангу.
+func aggregateValues(agg aggregation, values []float64) float64 {
+	switch agg.name {
+	case "last":
+		return values[len(values)-1]
+	case "count":
+		return float64(len(values))
+	case "mean":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	switch agg.name {
+	case "min":
+		return sorted[0]
+	case "max":
+		return sorted[len(sorted)-1]
+	}
+	rank := int(math.Ceil(agg.p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
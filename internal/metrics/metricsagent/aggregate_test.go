@@ -0,0 +1,84 @@
+package metricsagent
+
+import (
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetAggregations(t *testing.T) {
+	repo := NewRepo()
+	assert.NoError(t, repo.SetAggregations(nil))
+	assert.NoError(t, repo.SetAggregations(map[string][]string{"Alloc": {"min", "max", "p99.9"}}))
+	assert.Error(t, repo.SetAggregations(map[string][]string{"Alloc": {"median"}}))
+	assert.Error(t, repo.SetAggregations(map[string][]string{"Alloc": {"p0"}}))
+	assert.Error(t, repo.SetAggregations(map[string][]string{"[": {"max"}}))
+}
+
+func TestAggregations(t *testing.T) {
+	repo := NewRepo()
+	require.NoError(t, repo.SetAggregations(map[string][]string{
+		"Alloc":  {"min", "max", "mean", "last", "count", "p50"},
+		"Disk*":  {"max"},
+		"DiskIO": {"min"},
+	}))
+	for _, v := range []float64{3, 10, 2, 5} {
+		repo.Store([]metrics.Metrics{gauge("Alloc", v)})
+		repo.Accumulate([]metrics.Metrics{gauge("DiskUsed", v*2)})
+		repo.Store([]metrics.Metrics{gauge("DiskIO", v)})
+		repo.Store([]metrics.Metrics{gauge("HeapInuse", v)})
+	}
+	cfg := &agentutils.AgentConfig{}
+	got := make(map[string]float64)
+	for _, v := range repo.batch(cfg) {
+		got[v.ID] = *v.Value
+	}
+	assert.Equal(t, map[string]float64{
+		"Alloc":        5,
+		"Alloc.min":    2,
+		"Alloc.max":    10,
+		"Alloc.mean":   5,
+		"Alloc.last":   5,
+		"Alloc.count":  4,
+		"Alloc.p50":    3,
+		"DiskUsed":     10,
+		"DiskUsed.max": 20,
+		"DiskIO":       5,
+		"DiskIO.min":   2,
+		"HeapInuse":    5,
+	}, got)
+
+	// после отправки агрегации считаются заново, без новых значений не отправляются
+	for _, v := range repo.batch(cfg) {
+		assert.NotEqual(t, "Alloc.max", v.ID)
+	}
+	repo.Store([]metrics.Metrics{gauge("Alloc", 1)})
+	got = make(map[string]float64)
+	for _, v := range repo.batch(cfg) {
+		got[v.ID] = *v.Value
+	}
+	assert.Equal(t, 1.0, got["Alloc.max"])
+	assert.Equal(t, 1.0, got["Alloc.count"])
+}
+
+func TestRepoPipeline(t *testing.T) {
+	pipeline, err := metrics.NewPipeline([]metrics.RelabelRule{
+		{Action: metrics.RelabelDrop, Regex: "RandomValue"},
+		{Action: metrics.RelabelRename, Regex: "Alloc", Replacement: "HeapAllocated"},
+	})
+	require.NoError(t, err)
+	repo := NewRepo()
+	repo.SetPipeline(pipeline)
+	require.NoError(t, repo.SetAggregations(map[string][]string{"HeapAllocated": {"max"}}))
+	delta := int64(2)
+	repo.Store([]metrics.Metrics{gauge("Alloc", 3), gauge("RandomValue", 1)})
+	repo.Accumulate([]metrics.Metrics{{ID: "RandomValue", MType: "counter", Delta: &delta}, gauge("Alloc", 1)})
+	got := make(map[string]float64)
+	for _, v := range repo.batch(&agentutils.AgentConfig{}) {
+		got[v.ID] = *v.Value
+	}
+	assert.Equal(t, map[string]float64{"HeapAllocated": 1, "HeapAllocated.max": 3}, got)
+}
@@ -0,0 +1,67 @@
+package metricsagent
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// metricBuffer - потокобезопасный буфер метрик, полученных слушающим коллектором между сборами: счетчики суммируются, gauge заменяют предыдущее значение.
+type metricBuffer struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+}
+
+// newMetricBuffer - создает пустой буфер.
+func newMetricBuffer() *metricBuffer {
+	return &metricBuffer{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// add - проверяет метрику и учитывает ее до следующего сбора. Метрика с именем, уже занятым метрикой другого типа, и gauge со значением NaN или ±Inf отклоняются.
+func (b *metricBuffer) add(m metrics.Metrics) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	// NaN и ±Inf не кодируются в JSON, и отправка пакета с ними повторялась бы бесконечно
+	if m.MType == "gauge" && (math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0)) {
+		return fmt.Errorf("%w: gauge value is not finite", metrics.ErrParseMetric)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch m.MType {
+	case "counter":
+		if _, ok := b.gauges[m.ID]; ok {
+			return metrics.ErrWrongType
+		}
+		b.counters[m.ID] += *m.Delta
+	case "gauge":
+		if _, ok := b.counters[m.ID]; ok {
+			return metrics.ErrWrongType
+		}
+		b.gauges[m.ID] = *m.Value
+	}
+	return nil
+}
+
+// drain - возвращает накопленные метрики и очищает буфер.
+func (b *metricBuffer) drain() []metrics.Metrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := make([]metrics.Metrics, 0, len(b.counters)+len(b.gauges))
+	for name, v := range b.counters {
+		delta := v
+		result = append(result, metrics.Metrics{ID: name, MType: "counter", Delta: &delta})
+		delete(b.counters, name)
+	}
+	for name, v := range b.gauges {
+		result = append(result, gauge(name, v))
+		delete(b.gauges, name)
+	}
+	return result
+}
@@ -0,0 +1,228 @@
+package metricsagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// WorkerCollectPrefix - префикс имени воркера коллектора в статусе агента, за ним следует имя коллектора.
+const WorkerCollectPrefix = "collect "
+
+// Collector - источник метрик агента. Каждый вызов Collect возвращает текущие значения метрик, которые записываются в хранилище для отправки.
+//
+// Если сбор завершился частично, коллектор возвращает собранные метрики вместе с ошибкой.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]metrics.Metrics, error)
+}
+
+// Listener - коллектор, который в фоне принимает метрики от приложений. Run работает до отмены ctx.
+//
+// Счетчики, возвращаемые Collect слушающего коллектора, - приращения с прошлого сбора; они суммируются в хранилище до отправки.
+type Listener interface {
+	Collector
+	Run(ctx context.Context) error
+}
+
+// DeltaCollector - коллектор, который сам считает приращения счетчиков с прошлого сбора (например, по накопительным значениям внешнего источника).
+//
+// Такие счетчики, как и счетчики слушающих коллекторов, суммируются в хранилище до отправки.
+type DeltaCollector interface {
+	Collector
+	Deltas() bool
+}
+
+// accumulates - проверяет, что счетчики коллектора - приращения, а не текущие значения.
+func accumulates(c Collector) bool {
+	if _, ok := c.(Listener); ok {
+		return true
+	}
+	d, ok := c.(DeltaCollector)
+	return ok && d.Deltas()
+}
+
+// CollectorFactory - создает коллектор по конфигурации агента и параметрам коллектора из CollectorConfig.Options.
+type CollectorFactory func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error)
+
+var (
+	collectorsMu sync.RWMutex
+	collectors   = make(map[string]CollectorFactory)
+)
+
+// RegisterCollector - регистрирует фабрику коллектора под именем name. Вызывается из init() файла коллектора.
+func RegisterCollector(name string, factory CollectorFactory) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if _, ok := collectors[name]; ok {
+		panic("metricsagent: collector registered twice: " + name)
+	}
+	collectors[name] = factory
+}
+
+// Collectors - отсортированный список имен зарегистрированных коллекторов.
+func Collectors() []string {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	result := make([]string, 0, len(collectors))
+	for name := range collectors {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewCollector - создает зарегистрированный коллектор name.
+func NewCollector(name string, cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+	collectorsMu.RLock()
+	factory, ok := collectors[name]
+	collectorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown collector: %s", name)
+	}
+	return factory(cfg, options)
+}
+
+// decodeOptions - разбирает параметры коллектора в v. Пустые параметры оставляют значения по умолчанию, неизвестные поля считаются ошибкой.
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(bytes.TrimSpace(options)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(options))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// nameFilter - фильтр объектов коллектора (точек монтирования, устройств, интерфейсов) по шаблонам path.Match.
+//
+// Объект проходит фильтр, если одно из его имен подходит под один из шаблонов Include (или Include пуст) и ни одно не подходит под шаблоны Exclude.
+type nameFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// validate - проверяет синтаксис шаблонов фильтра.
+func (f nameFilter) validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad filter pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// match - проверяет, проходит ли фильтр объект с именами names.
+func (f nameFilter) match(names ...string) bool {
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			for _, name := range names {
+				if ok, _ := path.Match(pattern, name); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include) {
+		return false
+	}
+	return !matchAny(f.Exclude)
+}
+
+// labelRe - символы, недопустимые в метке имени метрики.
+var labelRe = regexp.MustCompile(`[^A-Za-z0-9_\-.]+`)
+
+// metricLabel - превращает имя объекта (точку монтирования, устройство, интерфейс) в метку для имени метрики, например "/var/lib" в "var_lib", а "/" в "root".
+func metricLabel(name string) string {
+	label := strings.Trim(labelRe.ReplaceAllString(name, "_"), "_")
+	if label == "" {
+		return "root"
+	}
+	return label
+}
+
+// gauge - создает метрику gauge. Через нее отправляются и накопительные счетчики (диск, сеть, процессы): значение counter сервер суммирует, а gauge заменяет.
+func gauge(id string, value float64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+// Store - записывает метрики в хранилище для отправки после правил обработки, заменяя предыдущие значения. Значения gauge с настроенными агрегациями запоминаются до отправки.
+func (repo *MetricRepo) Store(list []metrics.Metrics) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, v := range repo.pipeline.Apply(list) {
+		repo.db[v.ID] = v
+		repo.observe(v)
+	}
+}
+
+// CollectWorker - воркер, который спустя каждый интервал собирает метрики коллектора c и записывает их в хранилище. Отвечает за штатное завершение потока при остановке работы.
+func CollectWorker(ctx context.Context, wg *sync.WaitGroup, c Collector, interval time.Duration, repo *MetricRepo) {
+	defer wg.Done()
+	name := WorkerCollectPrefix + c.Name()
+	store := repo.Store
+	if accumulates(c) {
+		store = repo.Accumulate
+	}
+	tickerPoll := time.NewTicker(interval)
+	defer tickerPoll.Stop()
+	Stats.Register(name, interval)
+	for {
+		select {
+		case <-tickerPoll.C:
+			start := time.Now()
+			list, err := c.Collect(ctx)
+			store(list)
+			Stats.Observe(name, time.Since(start), err)
+			if err != nil {
+				log.Error().Err(err).Str("collector", c.Name()).Msg("failed collect metrics")
+			}
+		case <-ctx.Done():
+			log.Info().Str("collector", c.Name()).Msg("stopped collectWorker")
+			return
+		}
+	}
+}
+
+// StartCollectors - создает включенные в конфигурации коллекторы и запускает для каждого CollectWorker со своим интервалом, а для слушающих коллекторов еще и Run.
+//
+// Неизвестные и не созданные из-за ошибки в параметрах коллекторы пропускаются с записью в лог.
+func StartCollectors(ctx context.Context, wg *sync.WaitGroup, cfg *agentutils.AgentConfig, repo *MetricRepo) {
+	names := make([]string, 0, len(cfg.Collectors))
+	for name, c := range cfg.Collectors {
+		if c.Enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, err := NewCollector(name, cfg, cfg.Collectors[name].Options)
+		if err != nil {
+			log.Error().Err(err).Str("collector", name).Msg("failed create collector")
+			continue
+		}
+		interval := cfg.CollectorInterval(name)
+		log.Info().Str("collector", name).Dur("interval", interval).Msg("collector started")
+		if l, ok := c.(Listener); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.Run(ctx); err != nil {
+					log.Error().Err(err).Str("collector", l.Name()).Msg("listener stopped")
+				}
+			}()
+		}
+		wg.Add(1)
+		go CollectWorker(ctx, wg, c, interval, repo)
+	}
+}
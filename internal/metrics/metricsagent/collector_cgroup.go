@@ -0,0 +1,273 @@
+package metricsagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// cgroupUnlimited - значения лимита памяти cgroup v1 не меньше этого считаются отсутствием лимита.
+const cgroupUnlimited = 1 << 62
+
+// cgroupStats - значения, прочитанные из файлов cgroup. Отсутствующие файлы оставляют значения nil.
+type cgroupStats struct {
+	cpuUsage         *float64 // секунды
+	cpuPeriods       *float64
+	cpuThrottled     *float64
+	cpuThrottledTime *float64 // секунды
+	cpuLimit         *float64 // ядра
+	memoryUsage      *float64
+	memoryLimit      *float64
+	memoryOOMKills   *float64
+	ioReadBytes      *float64
+	ioWriteBytes     *float64
+	ioReadOps        *float64
+	ioWriteOps       *float64
+}
+
+// cgroupCollector - коллектор ресурсов контейнера по файлам cgroup v1 или v2: процессор, ограничение процессора, память и ввод-вывод.
+//
+// Версия определяется по содержимому Root. Если cgroup не найдены или отдельные файлы отсутствуют, соответствующие метрики не отправляются.
+type cgroupCollector struct {
+	Root string `json:"root"` // Каталог cgroup, по умолчанию /sys/fs/cgroup
+
+	now       func() time.Time
+	lastUsage float64
+	lastTime  time.Time
+}
+
+func init() {
+	RegisterCollector("cgroup", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &cgroupCollector{Root: "/sys/fs/cgroup", now: time.Now}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if c.version() == 0 {
+			log.Warn().Str("root", c.Root).Msg("cgroup not found, cgroup metrics disabled")
+		}
+		return c, nil
+	})
+}
+
+func (c *cgroupCollector) Name() string {
+	return "cgroup"
+}
+
+// version - версия cgroup в Root: 2, 1 или 0, если cgroup не найдены.
+func (c *cgroupCollector) version() int {
+	if _, err := os.Stat(filepath.Join(c.Root, "cgroup.controllers")); err == nil {
+		return 2
+	}
+	if _, err := os.Stat(filepath.Join(c.Root, "memory")); err == nil {
+		return 1
+	}
+	return 0
+}
+
+func (c *cgroupCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	var st cgroupStats
+	switch c.version() {
+	case 2:
+		st = readCgroupV2(c.Root)
+	case 1:
+		st = readCgroupV1(c.Root)
+	default:
+		return nil, nil
+	}
+	var result []metrics.Metrics
+	add := func(id string, v *float64) {
+		if v != nil {
+			result = append(result, gauge(id, *v))
+		}
+	}
+	add("CgroupCPUUsageSeconds", st.cpuUsage)
+	add("CgroupCPUPeriods", st.cpuPeriods)
+	add("CgroupCPUThrottledPeriods", st.cpuThrottled)
+	add("CgroupCPUThrottledSeconds", st.cpuThrottledTime)
+	add("CgroupCPULimit", st.cpuLimit)
+	add("CgroupMemoryUsage", st.memoryUsage)
+	add("CgroupMemoryLimit", st.memoryLimit)
+	add("CgroupMemoryOOMKills", st.memoryOOMKills)
+	add("CgroupIOReadBytes", st.ioReadBytes)
+	add("CgroupIOWriteBytes", st.ioWriteBytes)
+	add("CgroupIOReadOps", st.ioReadOps)
+	add("CgroupIOWriteOps", st.ioWriteOps)
+	if st.memoryUsage != nil && st.memoryLimit != nil && *st.memoryLimit > 0 {
+		result = append(result, gauge("CgroupMemoryUsedPercent", *st.memoryUsage / *st.memoryLimit * 100))
+	}
+	if st.cpuUsage != nil {
+		now := c.now()
+		if !c.lastTime.IsZero() && now.After(c.lastTime) && *st.cpuUsage >= c.lastUsage {
+			result = append(result, gauge("CgroupCPUPercent", (*st.cpuUsage-c.lastUsage)/now.Sub(c.lastTime).Seconds()*100))
+		}
+		c.lastUsage, c.lastTime = *st.cpuUsage, now
+	}
+	return result, nil
+}
+
+// readCgroupV2 - читает значения единой иерархии cgroup v2.
+func readCgroupV2(root string) cgroupStats {
+	var st cgroupStats
+	cpu := readKeyValues(filepath.Join(root, "cpu.stat"))
+	st.cpuUsage = scaled(cpu["usage_usec"], 1e-6)
+	st.cpuPeriods = cpu["nr_periods"]
+	st.cpuThrottled = cpu["nr_throttled"]
+	st.cpuThrottledTime = scaled(cpu["throttled_usec"], 1e-6)
+	if fields := strings.Fields(readString(filepath.Join(root, "cpu.max"))); len(fields) == 2 && fields[0] != "max" {
+		quota, errQ := strconv.ParseFloat(fields[0], 64)
+		period, errP := strconv.ParseFloat(fields[1], 64)
+		if errQ == nil && errP == nil && period > 0 {
+			limit := quota / period
+			st.cpuLimit = &limit
+		}
+	}
+	st.memoryUsage = readNumber(filepath.Join(root, "memory.current"))
+	st.memoryLimit = readNumber(filepath.Join(root, "memory.max"))
+	st.memoryOOMKills = readKeyValues(filepath.Join(root, "memory.events"))["oom_kill"]
+	// io.stat: "8:0 rbytes=1 wbytes=2 rios=3 wios=4 ..." по устройствам
+	io := make(map[string]*float64)
+	for _, line := range readLines(filepath.Join(root, "io.stat")) {
+		for _, field := range strings.Fields(line)[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				io[kv[0]] = sum(io[kv[0]], v)
+			}
+		}
+	}
+	st.ioReadBytes, st.ioWriteBytes, st.ioReadOps, st.ioWriteOps = io["rbytes"], io["wbytes"], io["rios"], io["wios"]
+	return st
+}
+
+// readCgroupV1 - читает значения иерархий контроллеров cgroup v1.
+func readCgroupV1(root string) cgroupStats {
+	var st cgroupStats
+	controller := func(names ...string) string {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+				return filepath.Join(root, name)
+			}
+		}
+		return filepath.Join(root, names[0])
+	}
+	cpuacct := controller("cpuacct", "cpu,cpuacct", "cpuacct,cpu")
+	cpu := controller("cpu", "cpu,cpuacct", "cpuacct,cpu")
+	st.cpuUsage = scaled(readNumber(filepath.Join(cpuacct, "cpuacct.usage")), 1e-9)
+	stat := readKeyValues(filepath.Join(cpu, "cpu.stat"))
+	st.cpuPeriods = stat["nr_periods"]
+	st.cpuThrottled = stat["nr_throttled"]
+	st.cpuThrottledTime = scaled(stat["throttled_time"], 1e-9)
+	quota := readNumber(filepath.Join(cpu, "cpu.cfs_quota_us"))
+	period := readNumber(filepath.Join(cpu, "cpu.cfs_period_us"))
+	if quota != nil && period != nil && *quota > 0 && *period > 0 {
+		limit := *quota / *period
+		st.cpuLimit = &limit
+	}
+	memory := filepath.Join(root, "memory")
+	st.memoryUsage = readNumber(filepath.Join(memory, "memory.usage_in_bytes"))
+	if limit := readNumber(filepath.Join(memory, "memory.limit_in_bytes")); limit != nil && *limit < cgroupUnlimited {
+		st.memoryLimit = limit
+	}
+	st.memoryOOMKills = readKeyValues(filepath.Join(memory, "memory.oom_control"))["oom_kill"]
+	// blkio: "8:0 Read 123" по устройствам, строки Total пропускаются
+	blkio := func(file string) (read, write *float64) {
+		for _, line := range readLines(filepath.Join(root, "blkio", file)) {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				continue
+			}
+			switch fields[1] {
+			case "Read":
+				read = sum(read, v)
+			case "Write":
+				write = sum(write, v)
+			}
+		}
+		return read, write
+	}
+	st.ioReadBytes, st.ioWriteBytes = blkio("blkio.throttle.io_service_bytes")
+	st.ioReadOps, st.ioWriteOps = blkio("blkio.throttle.io_serviced")
+	return st
+}
+
+// readString - содержимое файла без пробельных символов по краям, пустая строка - файла нет.
+func readString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readNumber - число из файла, nil - файла нет или в нем не число (например, "max").
+func readNumber(path string) *float64 {
+	v, err := strconv.ParseFloat(readString(path), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// readLines - непустые строки файла.
+func readLines(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// readKeyValues - значения из файла со строками "key value".
+func readKeyValues(path string) map[string]*float64 {
+	result := make(map[string]*float64)
+	for _, line := range readLines(path) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			result[fields[0]] = &v
+		}
+	}
+	return result
+}
+
+// scaled - значение v, умноженное на k.
+func scaled(v *float64, k float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	result := *v * k
+	return &result
+}
+
+// sum - прибавляет v к значению acc, которого может еще не быть.
+func sum(acc *float64, v float64) *float64 {
+	if acc == nil {
+		return &v
+	}
+	result := *acc + v
+	return &result
+}
@@ -0,0 +1,109 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectCgroup - собирает метрики cgroup из каталога root.
+func collectCgroup(t *testing.T, c Collector) map[string]float64 {
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	result := make(map[string]float64)
+	for _, v := range list {
+		result[v.ID] = *v.Value
+	}
+	return result
+}
+
+func TestCgroupCollector(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		want map[string]float64
+	}{
+		{
+			name: "Test #1: cgroup v2",
+			root: "testdata/cgroup/v2",
+			want: map[string]float64{
+				"CgroupCPUUsageSeconds":     2.5,
+				"CgroupCPUPeriods":          100,
+				"CgroupCPUThrottledPeriods": 10,
+				"CgroupCPUThrottledSeconds": 0.3,
+				"CgroupCPULimit":            0.5,
+				"CgroupMemoryUsage":         104857600,
+				"CgroupMemoryLimit":         209715200,
+				"CgroupMemoryUsedPercent":   50,
+				"CgroupMemoryOOMKills":      1,
+				"CgroupIOReadBytes":         1500,
+				"CgroupIOWriteBytes":        2000,
+				"CgroupIOReadOps":           15,
+				"CgroupIOWriteOps":          20,
+			},
+		},
+		{
+			name: "Test #2: cgroup v2 without limits",
+			root: "testdata/cgroup/v2-unlimited",
+			want: map[string]float64{
+				"CgroupMemoryUsage": 4096,
+			},
+		},
+		{
+			name: "Test #3: cgroup v1",
+			root: "testdata/cgroup/v1",
+			want: map[string]float64{
+				"CgroupCPUUsageSeconds":     3,
+				"CgroupCPUPeriods":          40,
+				"CgroupCPUThrottledPeriods": 4,
+				"CgroupCPUThrottledSeconds": 2,
+				"CgroupCPULimit":            2,
+				"CgroupMemoryUsage":         52428800,
+				"CgroupMemoryOOMKills":      2,
+				"CgroupIOReadBytes":         4096,
+				"CgroupIOWriteBytes":        8192,
+				"CgroupIOReadOps":           1,
+				"CgroupIOWriteOps":          2,
+			},
+		},
+		{
+			name: "Test #4: without cgroup",
+			root: "testdata/cgroup/absent",
+			want: map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := json.Marshal(map[string]string{"root": tt.root})
+			require.NoError(t, err)
+			c, err := NewCollector("cgroup", &agentutils.AgentConfig{}, options)
+			require.NoError(t, err)
+			got := collectCgroup(t, c)
+			assert.Len(t, got, len(tt.want))
+			for k, v := range tt.want {
+				assert.InDelta(t, v, got[k], 1e-9, k)
+			}
+		})
+	}
+}
+
+func TestCgroupCollectorCPUPercent(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu\n"), 0600))
+	stat := filepath.Join(root, "cpu.stat")
+	require.NoError(t, os.WriteFile(stat, []byte("usage_usec 1000000\n"), 0600))
+	now := time.Now()
+	c := &cgroupCollector{Root: root, now: func() time.Time { return now }}
+	assert.NotContains(t, collectCgroup(t, c), "CgroupCPUPercent")
+
+	require.NoError(t, os.WriteFile(stat, []byte("usage_usec 1500000\n"), 0600))
+	now = now.Add(2 * time.Second)
+	assert.InDelta(t, 25.0, collectCgroup(t, c)["CgroupCPUPercent"], 1e-9)
+}
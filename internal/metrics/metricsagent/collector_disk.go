@@ -0,0 +1,76 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// diskCollector - коллектор заполненности файловых систем и счетчиков ввода-вывода. Фильтр применяется к точке монтирования и имени устройства.
+type diskCollector struct {
+	nameFilter
+	All bool `json:"all"` // При true учитываются и виртуальные файловые системы (proc, sysfs и т.п.)
+}
+
+func init() {
+	RegisterCollector("disk", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &diskCollector{}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		return c, c.validate()
+	})
+}
+
+func (c *diskCollector) Name() string {
+	return "disk"
+}
+
+func (c *diskCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	var result []metrics.Metrics
+	var lastErr error
+	partitions, err := disk.PartitionsWithContext(ctx, c.All)
+	if err != nil {
+		lastErr = err
+	}
+	for _, p := range partitions {
+		if !c.match(p.Mountpoint, p.Device, path.Base(p.Device)) {
+			continue
+		}
+		usage, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		label := metricLabel(p.Mountpoint)
+		result = append(result,
+			gauge("DiskTotal."+label, float64(usage.Total)),
+			gauge("DiskUsed."+label, float64(usage.Used)),
+			gauge("DiskFree."+label, float64(usage.Free)),
+			gauge("DiskUsedPercent."+label, usage.UsedPercent),
+			gauge("DiskInodesUsedPercent."+label, usage.InodesUsedPercent),
+		)
+	}
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		lastErr = err
+	}
+	for name, io := range counters {
+		if !c.match(name, "/dev/"+name) {
+			continue
+		}
+		label := metricLabel(name)
+		result = append(result,
+			gauge("DiskReadBytes."+label, float64(io.ReadBytes)),
+			gauge("DiskWriteBytes."+label, float64(io.WriteBytes)),
+			gauge("DiskReadCount."+label, float64(io.ReadCount)),
+			gauge("DiskWriteCount."+label, float64(io.WriteCount)),
+			gauge("DiskIOTime."+label, float64(io.IoTime)),
+		)
+	}
+	return result, lastErr
+}
@@ -0,0 +1,204 @@
+package metricsagent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/metrics/metricsserver"
+)
+
+// ExecCommand - команда, которую запускает коллектор exec.
+type ExecCommand struct {
+	Name     string   `json:"name"`     // Имя команды в логах и в метрике Exec.<name>.Success
+	Command  []string `json:"command"`  // Путь к программе и аргументы
+	Interval string   `json:"interval"` // Интервал запуска, по умолчанию - интервал коллектора
+	Timeout  string   `json:"timeout"`  // Максимальное время работы, по умолчанию - интервал запуска
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// execCollector - коллектор, который запускает команды со своим интервалом и таймаутом и разбирает их вывод.
+//
+// Команда выводит строки "name type value" (пустые строки и строки с # пропускаются) или JSON-массив метрик в формате сервера. Счетчики из вывода - приращения с прошлого запуска. Результат запуска отправляется gauge Exec.<name>.Success: 1 - команда завершилась успешно и вывод разобран, 0 - нет.
+type execCollector struct {
+	Commands []ExecCommand `json:"commands"`
+	buf      *metricBuffer
+}
+
+func init() {
+	RegisterCollector("exec", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &execCollector{buf: newMetricBuffer()}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if len(c.Commands) == 0 {
+			return nil, errors.New("exec: no commands")
+		}
+		for i := range c.Commands {
+			if err := c.Commands[i].init(cfg.CollectorInterval("exec")); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	})
+}
+
+// init - проверяет команду и разбирает интервалы.
+func (e *ExecCommand) init(defaultInterval time.Duration) error {
+	if e.Name == "" || len(e.Command) == 0 {
+		return errors.New("exec: command name and command required")
+	}
+	e.interval = defaultInterval
+	if e.Interval != "" {
+		d, err := time.ParseDuration(e.Interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("exec %s: bad interval %q", e.Name, e.Interval)
+		}
+		e.interval = d
+	}
+	e.timeout = e.interval
+	if e.Timeout != "" {
+		d, err := time.ParseDuration(e.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("exec %s: bad timeout %q", e.Name, e.Timeout)
+		}
+		e.timeout = d
+	}
+	return nil
+}
+
+func (c *execCollector) Name() string {
+	return "exec"
+}
+
+func (c *execCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	return c.buf.drain(), nil
+}
+
+// Run - запускает каждую команду сразу и затем по ее интервалу до отмены ctx.
+func (c *execCollector) Run(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for _, cmd := range c.Commands {
+		wg.Add(1)
+		go func(cmd ExecCommand) {
+			defer wg.Done()
+			c.run(ctx, cmd)
+			ticker := time.NewTicker(cmd.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.run(ctx, cmd)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(cmd)
+	}
+	wg.Wait()
+	log.Info().Msg("stopped exec commands")
+	return nil
+}
+
+// run - однократно запускает команду и учитывает ее метрики.
+func (c *execCollector) run(ctx context.Context, cmd ExecCommand) {
+	list, err := runCommand(ctx, cmd)
+	if errors.Is(err, context.Canceled) {
+		// остановка агента - не ошибка команды, результат запуска не учитывается
+		log.Info().Str("command", cmd.Name).Msg("exec command canceled")
+		return
+	}
+	success := 1.0
+	if err != nil {
+		log.Error().Err(err).Str("command", cmd.Name).Msg("exec command failed")
+		success = 0
+	}
+	for _, m := range list {
+		if err := c.buf.add(m); err != nil {
+			log.Error().Err(err).Str("command", cmd.Name).Str("metric", m.ID).Msg("exec metric skipped")
+		}
+	}
+	c.buf.add(gauge("Exec."+metricLabel(cmd.Name)+".Success", success))
+}
+
+// runCommand - запускает команду с таймаутом и разбирает ее вывод.
+//
+// По таймауту или отмене ctx процесс команды завершается, а результат не ждет дочерних процессов, которые могут держать открытым вывод. При отмене ctx возвращается ошибка context.Canceled.
+func runCommand(ctx context.Context, cmd ExecCommand) ([]metrics.Metrics, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, cmd.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, cmd.Command[0], cmd.Command[1:]...)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+	select {
+	case err := <-done:
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timeout %v exceeded", cmd.timeout)
+			}
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	case <-ctx.Done():
+		// процесс уже завершен CommandContext
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		return nil, fmt.Errorf("timeout %v exceeded", cmd.timeout)
+	}
+	return parseExecOutput(stdout.Bytes())
+}
+
+// parseExecOutput - разбирает вывод команды: JSON-массив метрик или строки "name type value".
+func parseExecOutput(out []byte) ([]metrics.Metrics, error) {
+	out = bytes.TrimSpace(out)
+	if bytes.HasPrefix(out, []byte("[")) {
+		var result []metrics.Metrics
+		if err := json.Unmarshal(out, &result); err != nil {
+			return nil, err
+		}
+		for i := range result {
+			result[i].Hash = ""
+		}
+		return result, nil
+	}
+	var result []metrics.Metrics
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want \"name type value\", got %q", n, line)
+		}
+		m, err := metricsserver.ConvertToMetric(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		result = append(result, m)
+	}
+	return result, scanner.Err()
+}
@@ -0,0 +1,132 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExecOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "Test #1: lines",
+			out:  "# check\nqueue gauge 7.5\n\nerrors counter 2\n",
+			want: 2,
+		},
+		{
+			name: "Test #2: json",
+			out:  ` [{"id": "queue", "type": "gauge", "value": 7.5, "hash": "ignored"}]`,
+			want: 1,
+		},
+		{
+			name:    "Test #3: bad line",
+			out:     "queue 7.5",
+			wantErr: true,
+		},
+		{
+			name:    "Test #4: bad value",
+			out:     "errors counter 2.5",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExecOutput([]byte(tt.out))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, got, tt.want)
+			for _, v := range got {
+				assert.Empty(t, v.Hash)
+			}
+		})
+	}
+}
+
+func TestExecCollector(t *testing.T) {
+	options := json.RawMessage(`{"commands": [
+		{"name": "ok", "command": ["/bin/sh", "-c", "echo 'queue gauge 3'; echo 'errors counter 2'"]},
+		{"name": "slow", "command": ["/bin/sh", "-c", "sleep 5"], "timeout": "50ms"},
+		{"name": "fail", "command": ["/bin/sh", "-c", "echo boom >&2; exit 1"]},
+		{"name": "nan", "command": ["/bin/sh", "-c", "echo 'load gauge NaN'; echo 'ready gauge 1'"]}
+	]}`)
+	c, err := NewCollector("exec", &agentutils.AgentConfig{PollInterval: time.Second}, options)
+	require.NoError(t, err)
+	ec := c.(*execCollector)
+	for _, cmd := range ec.Commands {
+		ec.run(context.Background(), cmd)
+	}
+	ec.run(context.Background(), ec.Commands[0])
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	byID := make(map[string]metrics.Metrics)
+	for _, v := range list {
+		byID[v.ID] = v
+	}
+	assert.Equal(t, 3.0, *byID["queue"].Value)
+	assert.Equal(t, int64(4), *byID["errors"].Delta)
+	assert.Equal(t, 1.0, *byID["Exec.ok.Success"].Value)
+	assert.Equal(t, 0.0, *byID["Exec.slow.Success"].Value)
+	assert.Equal(t, 0.0, *byID["Exec.fail.Success"].Value)
+	assert.NotContains(t, byID, "load", "NaN gauge is skipped")
+	assert.Equal(t, 1.0, *byID["ready"].Value)
+
+	_, err = runCommand(context.Background(), ec.Commands[2])
+	assert.ErrorContains(t, err, "boom")
+
+	_, err = NewCollector("exec", &agentutils.AgentConfig{}, json.RawMessage(`{"commands": [{"name": "bad", "command": ["true"], "interval": "soon"}]}`))
+	assert.Error(t, err)
+}
+
+func TestExecCollectorRun(t *testing.T) {
+	options := json.RawMessage(`{"commands": [
+		{"name": "ok", "command": ["/bin/sh", "-c", "echo 'queue gauge 3'"]},
+		{"name": "slow", "command": ["/bin/sh", "-c", "sleep 5"], "timeout": "1m"}
+	]}`)
+	c, err := NewCollector("exec", &agentutils.AgentConfig{PollInterval: time.Hour}, options)
+	require.NoError(t, err)
+	ec := c.(*execCollector)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ec.Run(ctx)
+		close(done)
+	}()
+	var list []metrics.Metrics
+	require.Eventually(t, func() bool {
+		got, _ := c.Collect(context.Background())
+		list = append(list, got...)
+		return len(list) > 0
+	}, time.Second, 10*time.Millisecond, "commands run on start, without waiting for the interval")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("slow command is not stopped on cancel")
+	}
+	got, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	list = append(list, got...)
+	byID := make(map[string]metrics.Metrics)
+	for _, v := range list {
+		byID[v.ID] = v
+	}
+	assert.Equal(t, 1.0, *byID["Exec.ok.Success"].Value)
+	assert.NotContains(t, byID, "Exec.slow.Success", "canceled command is not a failure")
+
+	_, err = runCommand(ctx, ec.Commands[1])
+	assert.ErrorIs(t, err, context.Canceled)
+}
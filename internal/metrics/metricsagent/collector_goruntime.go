@@ -0,0 +1,198 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"strings"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// defaultQuantiles - квантили гистограмм, если в настройках выборки они не указаны.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// RuntimeSample - настройка выборки runtime/metrics, ключ выборки задается ключом в Samples.
+type RuntimeSample struct {
+	Name      string    `json:"name"`      // Имя метрики, по умолчанию получается из ключа: /sched/goroutines:goroutines - sched.goroutines.goroutines
+	Type      string    `json:"type"`      // gauge или counter, counter допустим только для накопительных целочисленных выборок
+	Quantiles []float64 `json:"quantiles"` // Квантили гистограммы в диапазоне (0, 1)
+}
+
+// goruntimeCollector - коллектор выборок пакета runtime/metrics, перечисленных в Samples.
+//
+// В отличие от runtime.ReadMemStats чтение не останавливает программу. Counter отправляются приращениями с прошлого сбора. Гистограммы (например, /sched/latencies:seconds или /gc/pauses:seconds) отправляются квантилями <name>.pNN по наблюдениям с прошлого сбора и счетчиком наблюдений <name>.count.
+type goruntimeCollector struct {
+	Samples map[string]RuntimeSample `json:"samples"`
+
+	samples []rtmetrics.Sample
+	last    map[string]uint64   // последние накопительные значения счетчиков
+	counts  map[string][]uint64 // последние накопительные значения корзин гистограмм
+}
+
+func init() {
+	RegisterCollector("goruntime", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &goruntimeCollector{
+			last:   make(map[string]uint64),
+			counts: make(map[string][]uint64),
+		}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// validate - проверяет, что выборки поддерживаются runtime, и заполняет значения по умолчанию.
+func (c *goruntimeCollector) validate() error {
+	if len(c.Samples) == 0 {
+		return errors.New("goruntime: no samples")
+	}
+	supported := make(map[string]rtmetrics.Description)
+	for _, d := range rtmetrics.All() {
+		supported[d.Name] = d
+	}
+	for key, s := range c.Samples {
+		d, ok := supported[key]
+		if !ok {
+			return fmt.Errorf("goruntime: unsupported sample %q", key)
+		}
+		if s.Name == "" {
+			s.Name = runtimeSampleName(key)
+		}
+		if s.Type == "" {
+			s.Type = "gauge"
+		}
+		switch {
+		case s.Type != "gauge" && s.Type != "counter":
+			return fmt.Errorf("goruntime %s: %w", key, metrics.ErrUndefinedType)
+		case s.Type == "counter" && (d.Kind != rtmetrics.KindUint64 || !d.Cumulative):
+			return fmt.Errorf("goruntime %s: counter requires cumulative integer sample", key)
+		}
+		if d.Kind == rtmetrics.KindFloat64Histogram {
+			if len(s.Quantiles) == 0 {
+				s.Quantiles = defaultQuantiles
+			}
+			for _, q := range s.Quantiles {
+				if q <= 0 || q >= 1 {
+					return fmt.Errorf("goruntime %s: bad quantile %v", key, q)
+				}
+			}
+		}
+		c.Samples[key] = s
+		c.samples = append(c.samples, rtmetrics.Sample{Name: key})
+	}
+	return nil
+}
+
+// runtimeSampleName - имя метрики по ключу выборки: /gc/heap/allocs:bytes - gc.heap.allocs.bytes.
+func runtimeSampleName(key string) string {
+	name := strings.NewReplacer("/", ".", ":", ".").Replace(strings.TrimPrefix(key, "/"))
+	return labelRe.ReplaceAllString(name, "_")
+}
+
+func (c *goruntimeCollector) Name() string {
+	return "goruntime"
+}
+
+func (c *goruntimeCollector) Deltas() bool {
+	return true
+}
+
+func (c *goruntimeCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	rtmetrics.Read(c.samples)
+	var result []metrics.Metrics
+	for _, sample := range c.samples {
+		s := c.Samples[sample.Name]
+		switch sample.Value.Kind() {
+		case rtmetrics.KindUint64:
+			v := sample.Value.Uint64()
+			if s.Type == "counter" {
+				result = append(result, c.counter(s.Name, v))
+				continue
+			}
+			result = append(result, gauge(s.Name, float64(v)))
+		case rtmetrics.KindFloat64:
+			result = append(result, gauge(s.Name, sample.Value.Float64()))
+		case rtmetrics.KindFloat64Histogram:
+			result = append(result, c.histogram(s, sample.Value.Float64Histogram())...)
+		default:
+			log.Warn().Str("sample", sample.Name).Msg("runtime sample not supported by this go version")
+		}
+	}
+	return result, nil
+}
+
+// counter - приращение накопительного значения с прошлого сбора. При первом сборе приращение нулевое.
+func (c *goruntimeCollector) counter(id string, value uint64) metrics.Metrics {
+	var delta int64
+	if last, ok := c.last[id]; ok && value >= last {
+		delta = int64(value - last)
+	}
+	c.last[id] = value
+	return metrics.Metrics{ID: id, MType: "counter", Delta: &delta}
+}
+
+// histogram - квантили и число наблюдений гистограммы с прошлого сбора. Если новых наблюдений нет, квантили не отправляются.
+func (c *goruntimeCollector) histogram(s RuntimeSample, h *rtmetrics.Float64Histogram) []metrics.Metrics {
+	last := c.counts[s.Name]
+	counts := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, v := range h.Counts {
+		counts[i] = v
+		if len(last) == len(h.Counts) && v >= last[i] {
+			counts[i] = v - last[i]
+		}
+		total += counts[i]
+	}
+	first := last == nil
+	c.counts[s.Name] = append(last[:0], h.Counts...)
+	if first {
+		// наблюдения до запуска агента не относятся к интервалу сбора
+		total = 0
+	}
+	count := int64(total)
+	result := []metrics.Metrics{{ID: s.Name + ".count", MType: "counter", Delta: &count}}
+	if total == 0 {
+		return result
+	}
+	for _, q := range s.Quantiles {
+		name := s.Name + quantileSuffix(q)
+		result = append(result, gauge(name, histogramQuantile(q, counts, h.Buckets, total)))
+	}
+	return result
+}
+
+// quantileSuffix - суффикс имени метрики квантиля q в процентах: 0.5 - .p50, 0.999 - .p99.9. Процент округляется до 4 знаков, иначе 0.07*100 дает .p7.000000000000001.
+func quantileSuffix(q float64) string {
+	return ".p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+}
+
+// histogramQuantile - оценка квантиля q по корзинам с линейной интерполяцией внутри корзины. Бесконечные границы крайних корзин заменяются соседней конечной границей.
+func histogramQuantile(q float64, counts []uint64, buckets []float64, total uint64) float64 {
+	rank := q * float64(total)
+	var seen uint64
+	for i, n := range counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lo, hi := buckets[i], buckets[i+1]
+		switch {
+		case math.IsInf(lo, -1):
+			return hi
+		case math.IsInf(hi, 1):
+			return lo
+		}
+		return lo + (hi-lo)*(rank-float64(seen))/float64(n)
+	}
+	return buckets[len(buckets)-1]
+}
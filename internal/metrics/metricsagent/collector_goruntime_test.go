@@ -0,0 +1,107 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoruntimeCollectorOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+	}{
+		{name: "Test #1: no samples", options: `{}`},
+		{name: "Test #2: unsupported sample", options: `{"samples": {"/another:bytes": {}}}`},
+		{name: "Test #3: wrong type", options: `{"samples": {"/sched/goroutines:goroutines": {"type": "another"}}}`},
+		{name: "Test #4: counter of not cumulative sample", options: `{"samples": {"/sched/goroutines:goroutines": {"type": "counter"}}}`},
+		{name: "Test #5: bad quantile", options: `{"samples": {"/gc/pauses:seconds": {"quantiles": [1.5]}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCollector("goruntime", &agentutils.AgentConfig{}, json.RawMessage(tt.options))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGoruntimeCollector(t *testing.T) {
+	c, err := NewCollector("goruntime", &agentutils.AgentConfig{}, json.RawMessage(`{"samples": {
+		"/sched/goroutines:goroutines": {"name": "NumGoroutine"},
+		"/gc/cycles/total:gc-cycles": {"type": "counter"},
+		"/gc/pauses:seconds": {"name": "GCPause", "quantiles": [0.5, 0.99]}
+	}}`))
+	require.NoError(t, err)
+	collect := func() map[string]metrics.Metrics {
+		list, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		result := make(map[string]metrics.Metrics)
+		for _, v := range list {
+			result[v.ID] = v
+		}
+		return result
+	}
+	first := collect()
+	assert.Greater(t, *first["NumGoroutine"].Value, 0.0)
+	assert.Equal(t, int64(0), *first["gc.cycles.total.gc-cycles"].Delta)
+	assert.Equal(t, int64(0), *first["GCPause.count"].Delta)
+	assert.NotContains(t, first, "GCPause.p50")
+
+	runtime.GC()
+	runtime.GC()
+	second := collect()
+	assert.GreaterOrEqual(t, *second["gc.cycles.total.gc-cycles"].Delta, int64(2))
+	assert.GreaterOrEqual(t, *second["GCPause.count"].Delta, int64(2))
+	require.Contains(t, second, "GCPause.p50")
+	require.Contains(t, second, "GCPause.p99")
+	assert.LessOrEqual(t, *second["GCPause.p50"].Value, *second["GCPause.p99"].Value)
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	buckets := []float64{math.Inf(-1), 0, 10, 20, math.Inf(1)}
+	tests := []struct {
+		name   string
+		q      float64
+		counts []uint64
+		want   float64
+	}{
+		{name: "Test #1: interpolation", q: 0.5, counts: []uint64{0, 4, 4, 0}, want: 10},
+		{name: "Test #2: inside bucket", q: 0.75, counts: []uint64{0, 4, 4, 0}, want: 15},
+		{name: "Test #3: infinite upper bound", q: 0.99, counts: []uint64{0, 0, 1, 1}, want: 20},
+		{name: "Test #4: infinite lower bound", q: 0.1, counts: []uint64{1, 1, 0, 0}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var total uint64
+			for _, v := range tt.counts {
+				total += v
+			}
+			assert.InDelta(t, tt.want, histogramQuantile(tt.q, tt.counts, buckets, total), 1e-9)
+		})
+	}
+}
+
+func TestQuantileSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		q    float64
+		want string
+	}{
+		{name: "Test #1: median", q: 0.5, want: ".p50"},
+		{name: "Test #2: inexact product", q: 0.07, want: ".p7"},
+		{name: "Test #3: fraction of percent", q: 0.999, want: ".p99.9"},
+		{name: "Test #4: small fraction of percent", q: 0.9999, want: ".p99.99"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, quantileSuffix(tt.q))
+		})
+	}
+}
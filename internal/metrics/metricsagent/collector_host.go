@@ -0,0 +1,89 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// hostCollector - коллектор без параметров, который собирает метрики функцией collect.
+type hostCollector struct {
+	name    string
+	collect func(ctx context.Context) ([]metrics.Metrics, error)
+}
+
+// registerHostCollector - регистрирует коллектор без параметров.
+func registerHostCollector(name string, collect func(ctx context.Context) ([]metrics.Metrics, error)) {
+	RegisterCollector(name, func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		if err := decodeOptions(options, &struct{}{}); err != nil {
+			return nil, err
+		}
+		return hostCollector{name: name, collect: collect}, nil
+	})
+}
+
+func init() {
+	registerHostCollector("load", collectLoadMetrics)
+	registerHostCollector("swap", collectSwapMetrics)
+	registerHostCollector("processes", collectProcessCountMetrics)
+}
+
+func (c hostCollector) Name() string {
+	return c.name
+}
+
+func (c hostCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	return c.collect(ctx)
+}
+
+// collectLoadMetrics - средняя загрузка системы за 1, 5 и 15 минут.
+func collectLoadMetrics(ctx context.Context) ([]metrics.Metrics, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []metrics.Metrics{
+		gauge("Load1", avg.Load1),
+		gauge("Load5", avg.Load5),
+		gauge("Load15", avg.Load15),
+	}, nil
+}
+
+// collectSwapMetrics - заполненность файла подкачки.
+func collectSwapMetrics(ctx context.Context) ([]metrics.Metrics, error) {
+	swap, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []metrics.Metrics{
+		gauge("SwapTotal", float64(swap.Total)),
+		gauge("SwapUsed", float64(swap.Used)),
+		gauge("SwapFree", float64(swap.Free)),
+		gauge("SwapUsedPercent", swap.UsedPercent),
+	}, nil
+}
+
+// collectProcessCountMetrics - количество процессов в системе, а также выполняющихся и заблокированных процессов, если система их сообщает.
+func collectProcessCountMetrics(ctx context.Context) ([]metrics.Metrics, error) {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []metrics.Metrics{gauge("ProcessCount", float64(len(pids)))}
+	misc, err := load.MiscWithContext(ctx)
+	if err != nil {
+		// не все системы сообщают состояние процессов, количество процессов отправляется без него
+		log.Debug().Err(err).Msg("failed get processes state")
+		return result, nil
+	}
+	result = append(result,
+		gauge("ProcessRunning", float64(misc.ProcsRunning)),
+		gauge("ProcessBlocked", float64(misc.ProcsBlocked)),
+	)
+	return result, nil
+}
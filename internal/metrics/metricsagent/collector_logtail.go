@@ -0,0 +1,325 @@
+package metricsagent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// tailHeadSize - сколько первых байт файла используется как его отпечаток для проверки после перезапуска агента, что файл не был заменен.
+const tailHeadSize = 256
+
+// TailRule - правило, превращающее совпавшие строки журнала в метрику.
+//
+// Для counter каждое совпадение увеличивает счетчик на 1 или на целое значение группы (?P<value>...), если она есть. Остальные группы counter не учитываются, их можно использовать для выбора строк. Для gauge значение берется из группы value, а если ее нет - из первой группы.
+type TailRule struct {
+	Name  string `json:"name"`  // Имя метрики
+	Regex string `json:"regex"` // Регулярное выражение для строки
+	Type  string `json:"type"`  // counter или gauge
+	re    *regexp.Regexp
+	group int // номер группы со значением, 0 - значения нет
+}
+
+// tailValueGroup - имя группы регулярного выражения со значением метрики.
+const tailValueGroup = "value"
+
+// TailFile - файл журнала и правила для его строк.
+type TailFile struct {
+	Path  string     `json:"path"`
+	Rules []TailRule `json:"rules"`
+}
+
+// tailOffset - сохраняемая позиция в файле и отпечаток его начала.
+type tailOffset struct {
+	Offset   int64  `json:"offset"`
+	HeadLen  int64  `json:"head_len"`
+	HeadHash string `json:"head_hash"`
+}
+
+// tailState - открытый файл журнала и позиция после последней полностью прочитанной строки.
+type tailState struct {
+	f      *os.File
+	offset int64
+}
+
+// logtailCollector - коллектор, который читает новые строки журналов и считает по ним метрики.
+//
+// Переименование файла при ротации определяется по смене файла по пути: открытый файл дочитывается, затем открывается новый с начала. Усечение файла определяется по размеру меньше позиции. Позиции сохраняются в StateFile и восстанавливаются после перезапуска агента, если начало файла не изменилось.
+//
+// Позиции сохраняются в Collect, когда приращения переданы в хранилище агента, а не после их отправки серверу: приращения, не отправленные до остановки агента, теряются, но строки не учитываются повторно после перезапуска.
+type logtailCollector struct {
+	Files     []TailFile `json:"files"`
+	StateFile string     `json:"state_file"` // Файл для сохранения позиций, пустая строка - позиции не сохраняются
+	FromStart bool       `json:"from_start"` // При true файл без сохраненной позиции читается с начала, иначе - только новые строки
+
+	saved map[string]tailOffset
+	open  map[string]*tailState
+}
+
+func init() {
+	RegisterCollector("logtail", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &logtailCollector{open: make(map[string]*tailState)}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		saved, err := loadTailOffsets(c.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		c.saved = saved
+		return c, nil
+	})
+}
+
+// validate - проверяет файлы и правила и компилирует регулярные выражения.
+func (c *logtailCollector) validate() error {
+	if len(c.Files) == 0 {
+		return errors.New("logtail: no files")
+	}
+	for i := range c.Files {
+		file := &c.Files[i]
+		if file.Path == "" || len(file.Rules) == 0 {
+			return errors.New("logtail: file path and rules required")
+		}
+		for j := range file.Rules {
+			rule := &file.Rules[j]
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return fmt.Errorf("logtail %s: %w", rule.Name, err)
+			}
+			rule.re = re
+			rule.group = re.SubexpIndex(tailValueGroup)
+			if rule.group < 0 {
+				rule.group = 0
+				if rule.Type == "gauge" && re.NumSubexp() > 0 {
+					rule.group = 1
+				}
+			}
+			switch {
+			case rule.Name == "":
+				return fmt.Errorf("logtail %s: rule name required", file.Path)
+			case rule.Type == "gauge" && re.NumSubexp() == 0:
+				return fmt.Errorf("logtail %s: gauge rule needs a capture group", rule.Name)
+			case rule.Type != "gauge" && rule.Type != "counter":
+				return fmt.Errorf("logtail %s: %w", rule.Name, metrics.ErrUndefinedType)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *logtailCollector) Name() string {
+	return "logtail"
+}
+
+func (c *logtailCollector) Deltas() bool {
+	return true
+}
+
+func (c *logtailCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	buf := newMetricBuffer()
+	var lastErr error
+	for _, file := range c.Files {
+		err := c.tail(file.Path, func(line string) {
+			for _, rule := range file.Rules {
+				if m, ok := rule.apply(line); ok {
+					buf.add(m)
+				}
+			}
+		})
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if err := c.saveOffsets(); err != nil {
+		lastErr = err
+	}
+	return buf.drain(), lastErr
+}
+
+// apply - превращает строку в метрику, если строка подходит под правило.
+func (r TailRule) apply(line string) (metrics.Metrics, bool) {
+	match := r.re.FindStringSubmatch(line)
+	if match == nil {
+		return metrics.Metrics{}, false
+	}
+	if r.Type == "gauge" {
+		value, err := strconv.ParseFloat(match[r.group], 64)
+		if err != nil {
+			return metrics.Metrics{}, false
+		}
+		return gauge(r.Name, value), true
+	}
+	delta := int64(1)
+	if r.group > 0 {
+		v, err := strconv.ParseInt(match[r.group], 10, 64)
+		if err != nil {
+			return metrics.Metrics{}, false
+		}
+		delta = v
+	}
+	return metrics.Metrics{ID: r.Name, MType: "counter", Delta: &delta}, true
+}
+
+// tail - передает в handle новые полные строки файла path. Учитывает ротацию и усечение файла.
+func (c *logtailCollector) tail(path string, handle func(line string)) error {
+	st, ok := c.open[path]
+	if !ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		st = &tailState{f: f, offset: c.startOffset(path, f)}
+		c.open[path] = st
+	}
+	if err := st.read(handle); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		// файл переименован, а новый еще не создан - открытый файл дочитывается на следующем сборе
+		return nil
+	}
+	cur, err := st.f.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !os.SameFile(fi, cur):
+		log.Info().Str("file", path).Msg("log file rotated")
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		st.f.Close()
+		st.f, st.offset = f, 0
+	case fi.Size() < st.offset:
+		log.Info().Str("file", path).Msg("log file truncated")
+		st.offset = 0
+	default:
+		return nil
+	}
+	return st.read(handle)
+}
+
+// startOffset - позиция, с которой читается только что открытый файл: сохраненная, если начало файла не изменилось, иначе - начало или конец файла.
+func (c *logtailCollector) startOffset(path string, f *os.File) int64 {
+	if saved, ok := c.saved[path]; ok {
+		fi, err := f.Stat()
+		if err == nil && saved.Offset <= fi.Size() {
+			if hash, err := headHash(f, saved.HeadLen); err == nil && hash == saved.HeadHash {
+				return saved.Offset
+			}
+		}
+		log.Info().Str("file", path).Msg("log file changed since last run, reading from start")
+		return 0
+	}
+	if c.FromStart {
+		return 0
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// read - читает полные строки с позиции offset. Неполная последняя строка дочитывается на следующем сборе.
+func (st *tailState) read(handle func(line string)) error {
+	if _, err := st.f.Seek(st.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(st.f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st.offset += int64(len(line))
+		handle(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// headHash - отпечаток первых n байт файла.
+func headHash(f *os.File, n int64) (string, error) {
+	head := make([]byte, n)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(head)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// saveOffsets - сохраняет позиции открытых файлов в StateFile.
+func (c *logtailCollector) saveOffsets() error {
+	if c.StateFile == "" {
+		return nil
+	}
+	for path, st := range c.open {
+		headLen := st.offset
+		if headLen > tailHeadSize {
+			headLen = tailHeadSize
+		}
+		hash, err := headHash(st.f, headLen)
+		if err != nil {
+			return err
+		}
+		c.saved[path] = tailOffset{Offset: st.offset, HeadLen: headLen, HeadHash: hash}
+	}
+	data, err := json.Marshal(c.saved)
+	if err != nil {
+		return err
+	}
+	// запись через временный файл, чтобы при остановке агента во время записи не потерять позиции
+	tmp, err := os.CreateTemp(filepath.Dir(c.StateFile), filepath.Base(c.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.StateFile)
+}
+
+// loadTailOffsets - читает сохраненные позиции. Отсутствие файла - не ошибка.
+func loadTailOffsets(path string) (map[string]tailOffset, error) {
+	result := make(map[string]tailOffset)
+	if path == "" {
+		return result, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("logtail: bad state file: %w", err)
+	}
+	return result, nil
+}
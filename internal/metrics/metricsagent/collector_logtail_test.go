@@ -0,0 +1,126 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appendFile - дописывает строки в файл журнала.
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestLogtailCollector(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "app.log")
+	stateFile := filepath.Join(dir, "state.json")
+	appendFile(t, logFile, "ERROR old line\n")
+	options, err := json.Marshal(map[string]interface{}{
+		"state_file": stateFile,
+		"files": []map[string]interface{}{{
+			"path": logFile,
+			"rules": []map[string]string{
+				{"name": "app.errors", "regex": "ERROR", "type": "counter"},
+				{"name": "app.bytes", "regex": `bytes=(?P<value>\d+)`, "type": "counter"},
+				{"name": "app.requests", "regex": `(GET|POST) /`, "type": "counter"},
+				{"name": "app.latency", "regex": `latency=([0-9.]+)`, "type": "gauge"},
+			},
+		}},
+	})
+	require.NoError(t, err)
+	newCollector := func() Collector {
+		c, err := NewCollector("logtail", &agentutils.AgentConfig{}, options)
+		require.NoError(t, err)
+		return c
+	}
+	collect := func(c Collector) map[string]metrics.Metrics {
+		list, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		byID := make(map[string]metrics.Metrics)
+		for _, v := range list {
+			byID[v.ID] = v
+		}
+		return byID
+	}
+
+	c := newCollector()
+	assert.True(t, accumulates(c))
+	assert.Empty(t, collect(c), "existing lines are skipped")
+
+	appendFile(t, logFile, "ERROR one\nINFO latency=1.5 bytes=10\nERROR two bytes=5\nINFO GET /a\nINFO POST /b\nINFO latency=2.5 partial")
+	byID := collect(c)
+	assert.Equal(t, int64(2), *byID["app.errors"].Delta)
+	assert.Equal(t, int64(15), *byID["app.bytes"].Delta)
+	assert.Equal(t, int64(2), *byID["app.requests"].Delta, "counter without value group counts matches")
+	assert.Equal(t, 1.5, *byID["app.latency"].Value)
+
+	appendFile(t, logFile, "\n")
+	byID = collect(c)
+	assert.Equal(t, 2.5, *byID["app.latency"].Value)
+
+	// ротация: старый файл дописан после переименования, новый создан заново
+	require.NoError(t, os.Rename(logFile, logFile+".1"))
+	appendFile(t, logFile+".1", "ERROR before rotate\n")
+	appendFile(t, logFile, "ERROR after rotate\n")
+	byID = collect(c)
+	assert.Equal(t, int64(2), *byID["app.errors"].Delta)
+
+	// усечение
+	require.NoError(t, os.WriteFile(logFile, []byte("ERROR truncated\n"), 0600))
+	byID = collect(c)
+	assert.Equal(t, int64(1), *byID["app.errors"].Delta)
+
+	// перезапуск агента: чтение продолжается с сохраненной позиции
+	appendFile(t, logFile, "ERROR while stopped\n")
+	c = newCollector()
+	byID = collect(c)
+	assert.Equal(t, int64(1), *byID["app.errors"].Delta)
+
+	// файл заменен, пока агент не работал: чтение с начала
+	require.NoError(t, os.WriteFile(logFile, []byte("INFO replaced file here\nERROR new\n"), 0600))
+	c = newCollector()
+	byID = collect(c)
+	assert.Equal(t, int64(1), *byID["app.errors"].Delta)
+}
+
+func TestLogtailCollectorValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+	}{
+		{
+			name:    "Test #1: no files",
+			options: `{"files": []}`,
+		},
+		{
+			name:    "Test #2: gauge without group",
+			options: `{"files": [{"path": "a.log", "rules": [{"name": "a", "regex": "a", "type": "gauge"}]}]}`,
+		},
+		{
+			name:    "Test #3: unknown type",
+			options: `{"files": [{"path": "a.log", "rules": [{"name": "a", "regex": "a", "type": "set"}]}]}`,
+		},
+		{
+			name:    "Test #4: bad regex",
+			options: `{"files": [{"path": "a.log", "rules": [{"name": "a", "regex": "(", "type": "counter"}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCollector("logtail", &agentutils.AgentConfig{}, json.RawMessage(tt.options))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// netCollector - коллектор счетчиков сетевых интерфейсов. Фильтр применяется к имени интерфейса.
+type netCollector struct {
+	nameFilter
+}
+
+func init() {
+	RegisterCollector("net", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &netCollector{}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		return c, c.validate()
+	})
+}
+
+func (c *netCollector) Name() string {
+	return "net"
+}
+
+func (c *netCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	var result []metrics.Metrics
+	for _, v := range counters {
+		if !c.match(v.Name) {
+			continue
+		}
+		label := metricLabel(v.Name)
+		result = append(result,
+			gauge("NetBytesSent."+label, float64(v.BytesSent)),
+			gauge("NetBytesRecv."+label, float64(v.BytesRecv)),
+			gauge("NetPacketsSent."+label, float64(v.PacketsSent)),
+			gauge("NetPacketsRecv."+label, float64(v.PacketsRecv)),
+			gauge("NetErrIn."+label, float64(v.Errin)),
+			gauge("NetErrOut."+label, float64(v.Errout)),
+			gauge("NetDropIn."+label, float64(v.Dropin)),
+			gauge("NetDropOut."+label, float64(v.Dropout)),
+		)
+	}
+	return result, nil
+}
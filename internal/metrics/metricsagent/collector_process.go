@@ -0,0 +1,210 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ProcessMatch - описание отслеживаемой группы процессов. Задается одно из полей Exe, PidFile или Cmdline.
+type ProcessMatch struct {
+	Name    string `json:"name"`     // Имя группы в именах метрик
+	Exe     string `json:"exe"`      // Точное имя процесса
+	PidFile string `json:"pid_file"` // Файл с PID процесса
+	Cmdline string `json:"cmdline"`  // Регулярное выражение для командной строки процесса
+	cmdline *regexp.Regexp
+}
+
+// processCollector - коллектор метрик отслеживаемых процессов: загрузка процессора, занятая память, открытые файлы, потоки и время работы.
+//
+// Если под описание подходят несколько процессов, значения суммируются, а время работы берется у самого старого процесса.
+type processCollector struct {
+	Processes []ProcessMatch `json:"processes"`
+	// known - процессы, найденные при прошлом сборе. Загрузка процессора считается с прошлого сбора, поэтому объекты процессов переиспользуются.
+	known map[int32]*process.Process
+}
+
+func init() {
+	RegisterCollector("process", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &processCollector{known: make(map[int32]*process.Process)}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		return c, c.validate()
+	})
+}
+
+// validate - проверяет описания процессов и компилирует регулярные выражения.
+func (c *processCollector) validate() error {
+	if len(c.Processes) == 0 {
+		return errors.New("no processes to watch")
+	}
+	for i := range c.Processes {
+		m := &c.Processes[i]
+		if m.Name == "" {
+			return errors.New("process name is empty")
+		}
+		set := 0
+		for _, v := range []string{m.Exe, m.PidFile, m.Cmdline} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("process %s: exactly one of exe, pid_file, cmdline must be set", m.Name)
+		}
+		if m.Cmdline != "" {
+			re, err := regexp.Compile(m.Cmdline)
+			if err != nil {
+				return fmt.Errorf("process %s: %w", m.Name, err)
+			}
+			m.cmdline = re
+		}
+	}
+	return nil
+}
+
+func (c *processCollector) Name() string {
+	return "process"
+}
+
+func (c *processCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	var all []*process.Process
+	var lastErr error
+	for _, m := range c.Processes {
+		if m.PidFile != "" {
+			continue
+		}
+		var err error
+		all, err = process.ProcessesWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	known := make(map[int32]*process.Process)
+	// stats - значения процессов за этот сбор: процесс, подходящий под несколько описаний, опрашивается один раз, иначе вторая группа получит загрузку процессора около 0
+	stats := make(map[int32]processStats)
+	var result []metrics.Metrics
+	for _, m := range c.Processes {
+		procs, err := c.find(ctx, m, all)
+		if err != nil {
+			lastErr = err
+		}
+		var cpu, rss, fds, threads, uptime float64
+		now := time.Now()
+		for _, p := range procs {
+			st, ok := stats[p.Pid]
+			if !ok {
+				if old, ok := c.known[p.Pid]; ok && sameProcess(ctx, old, p) {
+					p = old
+				}
+				known[p.Pid] = p
+				st = readProcessStats(ctx, p)
+				stats[p.Pid] = st
+			}
+			cpu += st.cpu
+			rss += st.rss
+			fds += st.fds
+			threads += st.threads
+			if st.created > 0 {
+				if d := now.Sub(time.UnixMilli(st.created)).Seconds(); d > uptime {
+					uptime = d
+				}
+			}
+		}
+		prefix := "Process." + metricLabel(m.Name) + "."
+		result = append(result,
+			gauge(prefix+"Count", float64(len(procs))),
+			gauge(prefix+"CPUPercent", cpu),
+			gauge(prefix+"RSS", rss),
+			gauge(prefix+"OpenFDs", fds),
+			gauge(prefix+"Threads", threads),
+			gauge(prefix+"Uptime", uptime),
+		)
+	}
+	c.known = known
+	return result, lastErr
+}
+
+// processStats - значения одного процесса за сбор. Недоступные значения равны 0.
+type processStats struct {
+	cpu     float64
+	rss     float64
+	fds     float64
+	threads float64
+	created int64 // Время запуска в миллисекундах Unix
+}
+
+// readProcessStats - считывает значения процесса p. Загрузка процессора считается с прошлого вызова для того же объекта процесса.
+func readProcessStats(ctx context.Context, p *process.Process) processStats {
+	var st processStats
+	if v, err := p.PercentWithContext(ctx, 0); err == nil {
+		st.cpu = v
+	}
+	if v, err := p.MemoryInfoWithContext(ctx); err == nil {
+		st.rss = float64(v.RSS)
+	}
+	if v, err := p.NumFDsWithContext(ctx); err == nil {
+		st.fds = float64(v)
+	}
+	if v, err := p.NumThreadsWithContext(ctx); err == nil {
+		st.threads = float64(v)
+	}
+	if v, err := p.CreateTimeWithContext(ctx); err == nil {
+		st.created = v
+	}
+	return st
+}
+
+// find - находит процессы, подходящие под описание m, среди всех процессов системы all.
+func (c *processCollector) find(ctx context.Context, m ProcessMatch, all []*process.Process) ([]*process.Process, error) {
+	if m.PidFile != "" {
+		data, err := os.ReadFile(m.PidFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: bad pid file: %w", m.Name, err)
+		}
+		p, err := process.NewProcessWithContext(ctx, int32(pid))
+		if errors.Is(err, process.ErrorProcessNotRunning) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*process.Process{p}, nil
+	}
+	var result []*process.Process
+	for _, p := range all {
+		if m.Exe != "" {
+			if name, err := p.NameWithContext(ctx); err == nil && name == m.Exe {
+				result = append(result, p)
+			}
+			continue
+		}
+		if cmdline, err := p.CmdlineWithContext(ctx); err == nil && m.cmdline.MatchString(cmdline) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// sameProcess - проверяет, что процессы с одинаковым PID - один и тот же процесс, а не новый процесс с переиспользованным PID.
+func sameProcess(ctx context.Context, a, b *process.Process) bool {
+	ta, errA := a.CreateTimeWithContext(ctx)
+	tb, errB := b.CreateTimeWithContext(ctx)
+	return errA == nil && errB == nil && ta == tb
+}
@@ -0,0 +1,46 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessCollectorOverlappingGroups(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0o644))
+	options, err := json.Marshal(map[string]interface{}{
+		"processes": []map[string]string{
+			{"name": "first", "pid_file": pidFile},
+			{"name": "second", "pid_file": pidFile},
+		},
+	})
+	require.NoError(t, err)
+	c, err := NewCollector("process", &agentutils.AgentConfig{}, options)
+	require.NoError(t, err)
+
+	_, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	// загрузка процессора считается с прошлого сбора, поэтому между сборами процесс занимает процессор
+	for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); {
+	}
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	got := make(map[string]float64)
+	for _, v := range list {
+		got[v.ID] = *v.Value
+	}
+	assert.Equal(t, 1.0, got["Process.first.Count"])
+	assert.Equal(t, 1.0, got["Process.second.Count"])
+	assert.Greater(t, got["Process.first.CPUPercent"], 0.0)
+	assert.Equal(t, got["Process.first.CPUPercent"], got["Process.second.CPUPercent"])
+	assert.Equal(t, got["Process.first.RSS"], got["Process.second.RSS"])
+}
@@ -0,0 +1,306 @@
+package metricsagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// promAccept - форматы, которые коллектор запрашивает у цели.
+const promAccept = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.9"
+
+// promMaxBody - максимальный размер ответа цели.
+const promMaxBody = 16 << 20
+
+// promSample - значение одного ряда из ответа цели.
+type promSample struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+// parsePromLine - разбирает строку значения текстового формата Prometheus/OpenMetrics вида name{label="value",...} value [timestamp] [# exemplar]. Exemplar OpenMetrics отбрасывается.
+func parsePromLine(line string) (promSample, error) {
+	var s promSample
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("bad sample line: %q", line)
+	}
+	s.name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		var err error
+		s.labels, rest, err = parsePromLabels(rest[1:])
+		if err != nil {
+			return s, fmt.Errorf("bad sample line %q: %w", line, err)
+		}
+	}
+	// exemplar начинается после значения с " # ", поэтому он отрезается только после разбора меток, в значениях которых может быть "#"
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("bad sample line: %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("bad sample value: %q", line)
+	}
+	s.value = value
+	return s, nil
+}
+
+// parsePromLabels - разбирает метки до закрывающей скобки и возвращает остаток строки.
+func parsePromLabels(line string) ([][2]string, string, error) {
+	var labels [][2]string
+	for {
+		line = strings.TrimLeft(line, " \t,")
+		if line == "" {
+			return nil, "", errors.New("unclosed labels")
+		}
+		if line[0] == '}' {
+			return labels, line[1:], nil
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 || len(line) < eq+2 || line[eq+1] != '"' {
+			return nil, "", errors.New("bad label")
+		}
+		key := strings.TrimSpace(line[:eq])
+		var value strings.Builder
+		j := eq + 2
+		for ; j < len(line) && line[j] != '"'; j++ {
+			if line[j] == '\\' && j+1 < len(line) {
+				j++
+				if line[j] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(line[j])
+		}
+		if j == len(line) {
+			return nil, "", errors.New("unclosed label value")
+		}
+		labels = append(labels, [2]string{key, value.String()})
+		line = line[j+1:]
+	}
+}
+
+// promFamilyType - тип семейства ряда name по объявлениям # TYPE. Для рядов _total, _sum, _count, _bucket и _created возвращается семейство без суффикса.
+func promFamilyType(types map[string]string, name string) (family, suffix, kind string) {
+	if kind, ok := types[name]; ok {
+		return name, "", kind
+	}
+	for _, suffix := range []string{"_total", "_sum", "_count", "_bucket", "_created"} {
+		if base := strings.TrimSuffix(name, suffix); base != name {
+			if kind, ok := types[base]; ok {
+				return base, suffix, kind
+			}
+		}
+	}
+	return name, "", "untyped"
+}
+
+// PromTarget - цель, с которой коллектор забирает метрики.
+type PromTarget struct {
+	URL           string `json:"url"`            // Адрес страницы с метриками
+	Prefix        string `json:"prefix"`         // Префикс, добавляемый к именам метрик
+	FlattenLabels bool   `json:"flatten_labels"` // При true метки добавляются к имени метрики, иначе ряды с одинаковым именем суммируются
+}
+
+// prometheusCollector - коллектор, который забирает метрики в текстовом формате Prometheus/OpenMetrics с настроенных целей.
+//
+// Counter (и _sum, _count у histogram и summary) отправляются приращениями с прошлого сбора, gauge и untyped - текущим значением. Корзины histogram и квантили summary отправляются только при FlattenLabels.
+type prometheusCollector struct {
+	Targets []PromTarget `json:"targets"`
+	Timeout string       `json:"timeout"` // Таймаут запроса к цели, по умолчанию 5s
+
+	client *http.Client
+	last   map[string]float64 // последние накопительные значения счетчиков
+	carry  map[string]float64 // дробные остатки приращений счетчиков
+}
+
+func init() {
+	RegisterCollector("prometheus", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &prometheusCollector{
+			Timeout: "5s",
+			last:    make(map[string]float64),
+			carry:   make(map[string]float64),
+		}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if len(c.Targets) == 0 {
+			return nil, errors.New("prometheus: no targets")
+		}
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: %w", err)
+		}
+		c.client = &http.Client{Timeout: timeout}
+		return c, nil
+	})
+}
+
+func (c *prometheusCollector) Name() string {
+	return "prometheus"
+}
+
+func (c *prometheusCollector) Deltas() bool {
+	return true
+}
+
+func (c *prometheusCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	var result []metrics.Metrics
+	var lastErr error
+	for _, target := range c.Targets {
+		list, err := c.scrape(ctx, target)
+		if err != nil {
+			log.Error().Err(err).Str("target", target.URL).Msg("failed scrape target")
+			lastErr = err
+			continue
+		}
+		result = append(result, list...)
+	}
+	return result, lastErr
+}
+
+// scrape - забирает и разбирает метрики одной цели.
+func (c *prometheusCollector) scrape(ctx context.Context, target PromTarget) ([]metrics.Metrics, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", promAccept)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	counters, gauges, err := parsePromText(io.LimitReader(resp.Body, promMaxBody), target)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]metrics.Metrics, 0, len(counters)+len(gauges))
+	for id, v := range gauges {
+		result = append(result, gauge(id, v))
+	}
+	for id, v := range counters {
+		delta := c.delta(id, v)
+		result = append(result, metrics.Metrics{ID: id, MType: "counter", Delta: &delta})
+	}
+	return result, nil
+}
+
+// delta - приращение счетчика id с прошлого сбора. При первом сборе приращение нулевое, при сбросе счетчика целью приращение равно текущему значению.
+func (c *prometheusCollector) delta(id string, value float64) int64 {
+	last, ok := c.last[id]
+	c.last[id] = value
+	switch {
+	case !ok:
+		return 0
+	case value < last:
+		c.carry[id] += value
+	default:
+		c.carry[id] += value - last
+	}
+	delta := math.Trunc(c.carry[id])
+	c.carry[id] -= delta
+	return int64(delta)
+}
+
+// parsePromText - разбирает ответ цели в накопительные значения счетчиков и значения gauge по именам метрик агента. Неразобранные строки пропускаются, их количество логируется.
+func parsePromText(r io.Reader, target PromTarget) (counters, gauges map[string]float64, err error) {
+	counters = make(map[string]float64)
+	gauges = make(map[string]float64)
+	types := make(map[string]string)
+	var skipped int
+	var skipErr error
+	defer func() {
+		if skipped > 0 {
+			log.Warn().Err(skipErr).Str("target", target.URL).Int("lines", skipped).Msg("prometheus lines skipped")
+		}
+	}()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		s, err := parsePromLine(line)
+		if err != nil {
+			// одна неразобранная строка не должна отменять сбор остальных метрик цели
+			if skipped == 0 {
+				skipErr = err
+			}
+			skipped++
+			continue
+		}
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		_, suffix, kind := promFamilyType(types, s.name)
+		if suffix == "_created" {
+			continue
+		}
+		id := target.Prefix + s.name
+		if target.FlattenLabels {
+			id += flattenLabels(s.labels)
+		} else if suffix == "_bucket" || (kind == "summary" && suffix == "") {
+			// корзины и квантили без меток не имеют смысла
+			continue
+		}
+		switch {
+		case kind == "counter",
+			(kind == "histogram" || kind == "summary") && suffix != "":
+			counters[id] += s.value
+		default:
+			gauges[id] += s.value
+		}
+	}
+	return counters, gauges, scanner.Err()
+}
+
+// flattenLabels - превращает метки в суффикс имени метрики, например {method="GET",code="200"} в ".code_200.method_GET".
+func flattenLabels(labels [][2]string) string {
+	sorted := make([][2]string, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+	var b strings.Builder
+	for _, l := range sorted {
+		if l[1] == "" {
+			continue
+		}
+		b.WriteString(".")
+		b.WriteString(l[0])
+		b.WriteString("_")
+		b.WriteString(strings.Trim(labelRe.ReplaceAllString(l[1], "_"), "_"))
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePromLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    promSample
+		wantErr bool
+	}{
+		{
+			name: "Test #1: without labels",
+			line: "go_goroutines 12",
+			want: promSample{name: "go_goroutines", value: 12},
+		},
+		{
+			name: "Test #2: labels with escapes and timestamp",
+			line: `http_requests_total{method="GET",path="/a\"b,c}"} 3 1665000000000`,
+			want: promSample{name: "http_requests_total", labels: [][2]string{{"method", "GET"}, {"path", `/a"b,c}`}}, value: 3},
+		},
+		{
+			name:    "Test #3: unclosed labels",
+			line:    `http_requests_total{method="GET" 3`,
+			wantErr: true,
+		},
+		{
+			name:    "Test #4: without value",
+			line:    "go_goroutines",
+			wantErr: true,
+		},
+		{
+			name: "Test #5: openmetrics exemplar",
+			line: `http_requests_total{path="/#a # b"} 3 1665000000.123 # {trace_id="oHg5SJYRHA0"} 1 1665000000.1`,
+			want: promSample{name: "http_requests_total", labels: [][2]string{{"path", "/#a # b"}}, value: 3},
+		},
+		{
+			name: "Test #6: exemplar without labels",
+			line: `latency_seconds_count 5 # {trace_id="a"} 0.2`,
+			want: promSample{name: "latency_seconds_count", value: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+const promPage = `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} %d
+http_requests_total{method="POST",code="500"} 2.5
+http_requests_total_created{method="GET",code="200"} 1665000000
+# TYPE queue_size gauge
+queue_size 7
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 4
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 0.7
+latency_seconds_count 5 # {trace_id="oHg5SJYRHA0"} 0.3 1665000000.1
+broken_line{method="GET" 1
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.99"} 0.2
+rpc_seconds_sum NaN
+rpc_seconds_count 3
+process_start_time_seconds 1665000000
+# EOF
+`
+
+func TestPrometheusCollector(t *testing.T) {
+	requests := 10
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Accept"), "text/plain")
+		fmt.Fprintf(rw, promPage, requests)
+	}))
+	defer srv.Close()
+	options, err := json.Marshal(map[string]interface{}{
+		"targets": []PromTarget{
+			{URL: srv.URL, Prefix: "app."},
+			{URL: srv.URL, Prefix: "flat.", FlattenLabels: true},
+		},
+	})
+	require.NoError(t, err)
+	c, err := NewCollector("prometheus", &agentutils.AgentConfig{}, options)
+	require.NoError(t, err)
+	assert.True(t, accumulates(c))
+
+	collect := func() map[string]metrics.Metrics {
+		list, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		byID := make(map[string]metrics.Metrics)
+		for _, v := range list {
+			byID[v.ID] = v
+		}
+		return byID
+	}
+	byID := collect()
+	assert.Equal(t, "counter", byID["app.http_requests_total"].MType)
+	assert.Equal(t, int64(0), *byID["app.http_requests_total"].Delta)
+	assert.Equal(t, 7.0, *byID["app.queue_size"].Value)
+	assert.Equal(t, 1665000000.0, *byID["app.process_start_time_seconds"].Value)
+	assert.Contains(t, byID, "app.latency_seconds_count", "exemplar is ignored")
+	assert.NotContains(t, byID, "app.broken_line", "unparsable line is skipped, other lines are collected")
+	assert.NotContains(t, byID, "app.latency_seconds_bucket")
+	assert.NotContains(t, byID, "app.rpc_seconds")
+	assert.NotContains(t, byID, "app.rpc_seconds_sum")
+	assert.NotContains(t, byID, "app.http_requests_total_created")
+	assert.Contains(t, byID, "flat.http_requests_total.code_200.method_GET")
+	assert.Contains(t, byID, "flat.latency_seconds_bucket.le_Inf")
+	assert.Equal(t, 0.2, *byID["flat.rpc_seconds.quantile_0.99"].Value)
+
+	requests = 15
+	byID = collect()
+	assert.Equal(t, int64(5), *byID["app.http_requests_total"].Delta)
+	assert.Equal(t, int64(5), *byID["flat.http_requests_total.code_200.method_GET"].Delta)
+	assert.Equal(t, int64(0), *byID["flat.http_requests_total.code_500.method_POST"].Delta)
+
+	// сброс счетчика целью: приращение равно текущему значению суммы рядов 3 + 2.5, дробная часть переносится
+	requests = 3
+	byID = collect()
+	assert.Equal(t, int64(5), *byID["app.http_requests_total"].Delta)
+	assert.Equal(t, int64(3), *byID["flat.http_requests_total.code_200.method_GET"].Delta)
+
+	_, err = NewCollector("prometheus", &agentutils.AgentConfig{}, json.RawMessage(`{"targets": []}`))
+	assert.Error(t, err)
+}
+
+func TestPrometheusCollectorTargetDown(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	c, err := NewCollector("prometheus", &agentutils.AgentConfig{}, json.RawMessage(`{"targets": [{"url": "`+srv.URL+`"}]}`))
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	assert.Error(t, err)
+}
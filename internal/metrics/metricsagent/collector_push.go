@@ -0,0 +1,198 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/metrics/metricsserver"
+	"github.com/go-chi/chi/v5"
+)
+
+// pushMaxBody - максимальный размер тела запроса к локальному API.
+const pushMaxBody = 1 << 20
+
+// pushCollector - коллектор, который принимает метрики от приложений через локальный HTTP API и сокет Unix в формате сервера.
+//
+// Подпись метрик от приложений не требуется и не проверяется: агент подписывает метрики своим ключом при отправке. Счетчики суммируются, gauge заменяют предыдущее значение.
+type pushCollector struct {
+	HTTP   string `json:"http"`   // Адрес HTTP, пустая строка - не слушать HTTP
+	Socket string `json:"socket"` // Путь к сокету Unix, пустая строка - не слушать сокет
+
+	buf   *metricBuffer
+	mu    sync.Mutex
+	addrs []net.Addr
+}
+
+func init() {
+	RegisterCollector("push", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := newPushCollector()
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if c.HTTP == "" && c.Socket == "" {
+			return nil, errors.New("push: http address or socket required")
+		}
+		return c, nil
+	})
+}
+
+// newPushCollector - создает коллектор локального API с параметрами по умолчанию.
+func newPushCollector() *pushCollector {
+	return &pushCollector{
+		HTTP: "127.0.0.1:8081",
+		buf:  newMetricBuffer(),
+	}
+}
+
+func (c *pushCollector) Name() string {
+	return "push"
+}
+
+func (c *pushCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	return c.buf.drain(), nil
+}
+
+// pushStatus - статус обработки метрики локальным API.
+func pushStatus(m metrics.Metrics, err error) metrics.ItemStatus {
+	switch {
+	case err == nil:
+		return m.Status(metrics.StatusAccepted, nil)
+	case errors.Is(err, metrics.ErrWrongType):
+		return m.Status(metrics.StatusTypeConflict, err)
+	default:
+		return m.Status(metrics.StatusParseError, err)
+	}
+}
+
+// writeStatus - пишет ответ локального API: текст для принятой метрики или статус обработки m в JSON с кодом 400.
+func writeStatus(rw http.ResponseWriter, m metrics.Metrics, err error) {
+	if err != nil {
+		js, jsErr := json.Marshal(pushStatus(m, err))
+		if jsErr != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write(js)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("Metric saved"))
+}
+
+// Handler - маршруты локального API: POST [/update/{metric_type}/{metric_name}/{metric_value}], POST [/update/] и POST [/updates/].
+func (c *pushCollector) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(rw, r.Body, pushMaxBody)
+			next.ServeHTTP(rw, r)
+		})
+	})
+	r.Post("/update/{metric_type}/{metric_name}/{metric_value}", func(rw http.ResponseWriter, r *http.Request) {
+		m, err := metricsserver.ConvertToMetric(chi.URLParam(r, "metric_name"), chi.URLParam(r, "metric_type"), chi.URLParam(r, "metric_value"))
+		if err == nil {
+			err = c.buf.add(m)
+		}
+		writeStatus(rw, m, err)
+	})
+	r.Post("/update/", func(rw http.ResponseWriter, r *http.Request) {
+		var m metrics.Metrics
+		err := json.NewDecoder(r.Body).Decode(&m)
+		if err == nil {
+			err = c.buf.add(m)
+		}
+		writeStatus(rw, m, err)
+	})
+	r.Post("/updates/", func(rw http.ResponseWriter, r *http.Request) {
+		var raw []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			writeStatus(rw, metrics.Metrics{}, err)
+			return
+		}
+		var result metrics.BatchResult
+		for _, v := range raw {
+			var m metrics.Metrics
+			err := json.Unmarshal(v, &m)
+			if err == nil {
+				err = c.buf.add(m)
+			}
+			result.Add(pushStatus(m, err))
+		}
+		js, err := json.Marshal(result)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(js)
+	})
+	return r
+}
+
+// Run - принимает метрики на адресе HTTP и сокете Unix до отмены ctx.
+func (c *pushCollector) Run(ctx context.Context) error {
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	if c.HTTP != "" {
+		ln, err := net.Listen("tcp", c.HTTP)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if c.Socket != "" {
+		// сокет, оставшийся от предыдущего запуска агента, мешает слушать тот же путь
+		if fi, err := os.Stat(c.Socket); err == nil && fi.Mode().Type() == fs.ModeSocket {
+			os.Remove(c.Socket)
+		}
+		ln, err := net.Listen("unix", c.Socket)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	srv := &http.Server{Handler: c.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	wg := sync.WaitGroup{}
+	for _, ln := range listeners {
+		c.setAddr(ln.Addr())
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Str("addr", ln.Addr().String()).Msg("failed serve push api")
+			}
+		}(ln)
+	}
+	log.Info().Str("http", c.HTTP).Str("socket", c.Socket).Msg("push api started")
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	wg.Wait()
+	log.Info().Msg("stopped push api")
+	return nil
+}
+
+// setAddr - запоминает фактический адрес слушателя.
+func (c *pushCollector) setAddr(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs = append(c.addrs, addr)
+}
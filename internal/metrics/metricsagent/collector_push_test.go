@@ -0,0 +1,144 @@
+package metricsagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushHandler(t *testing.T) {
+	c := newPushCollector()
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "Test #1: url counter",
+			url:        "/update/counter/requests/2",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Test #2: json counter with hash",
+			url:        "/update/",
+			body:       `{"id": "requests", "type": "counter", "delta": 3, "hash": "ignored"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Test #3: json without value",
+			url:        "/update/",
+			body:       `{"id": "queue", "type": "gauge"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   metrics.StatusParseError,
+		},
+		{
+			name:       "Test #4: url unknown type",
+			url:        "/update/histogram/queue/1",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   metrics.StatusParseError,
+		},
+		{
+			name:       "Test #5: url NaN gauge",
+			url:        "/update/gauge/queue/NaN",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   metrics.StatusParseError,
+		},
+		{
+			name:       "Test #6: url infinite gauge",
+			url:        "/update/gauge/queue/-Inf",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   metrics.StatusParseError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(srv.URL+tt.url, "application/json", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantCode != "" {
+				var status metrics.ItemStatus
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+				assert.Equal(t, tt.wantCode, status.Status)
+			}
+		})
+	}
+
+	resp, err := http.Post(srv.URL+"/updates/", "application/json", bytes.NewBufferString(
+		`[{"id": "queue", "type": "gauge", "value": 7.5}, {"id": "requests", "type": "gauge", "value": 1}, {"id": "", "type": "gauge", "value": 1}]`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result metrics.BatchResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 1, result.Accepted)
+	assert.Equal(t, 2, result.Rejected)
+	assert.Equal(t, metrics.StatusTypeConflict, result.Items[1].Status)
+
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	byID := make(map[string]metrics.Metrics)
+	for _, v := range list {
+		byID[v.ID] = v
+	}
+	require.Len(t, byID, 2)
+	assert.Equal(t, int64(5), *byID["requests"].Delta)
+	assert.Empty(t, byID["requests"].Hash)
+	assert.Equal(t, 7.5, *byID["queue"].Value)
+	list, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestPushSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	options, err := json.Marshal(map[string]string{"http": "", "socket": socket})
+	require.NoError(t, err)
+	c, err := NewCollector("push", &agentutils.AgentConfig{}, options)
+	require.NoError(t, err)
+	pc := c.(*pushCollector)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, pc.Run(ctx))
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	require.Eventually(t, func() bool {
+		resp, err := client.Post("http://agent/update/gauge/queue/3", "text/plain", nil)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, 3.0, *list[0].Value)
+}
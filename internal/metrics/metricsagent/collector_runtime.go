@@ -0,0 +1,96 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// getRuntimeMetric - получает из runtime значение метрики fieldName и возвращает его с типом fieldType.
+func getRuntimeMetric(m *runtime.MemStats, fieldName string, fieldType string) (metrics.Metrics, error) {
+	var result metrics.Metrics
+	result.ID = fieldName
+	result.MType = fieldType
+	r := reflect.ValueOf(m)
+	if r.Kind() == reflect.Ptr {
+		r = r.Elem()
+	}
+	f := r.FieldByName(fieldName)
+	if !f.IsValid() {
+		return metrics.Metrics{}, errors.New("runtime not have this variable:" + fieldName + ", check config file")
+	}
+	switch t := r.FieldByName(fieldName).Type().Name(); {
+	case strings.Contains(t, "int") && fieldType == "gauge":
+		var v float64
+		v = float64(f.Uint())
+		result.Value = &v
+		return result, nil
+	case strings.Contains(t, "int") && fieldType == "counter":
+		var v int64
+		v = int64(f.Uint())
+		result.Delta = &v
+		return result, nil
+	case strings.Contains(t, "float") && fieldType == "gauge":
+		var v float64
+		v = float64(f.Float())
+		result.Value = &v
+		return result, nil
+	case strings.Contains(t, "float") && fieldType == "counter":
+		var v int64
+		v = int64(f.Float())
+		result.Delta = &v
+		return result, nil
+	default:
+		return metrics.Metrics{}, errors.New("not know type of variable: " + fieldType + ", check config file")
+	}
+}
+
+// collectRuntimeMetrics - считывает метрики из Runtime согласно описанию из конфига.
+//
+// Так же добавляет 2 метрики: Количество запросов PollCount - counter, Слуучайное число RandomValue - gauge.
+func collectRuntimeMetrics(metricsDescr map[string]string, runtime *runtime.MemStats, inc int64) []metrics.Metrics {
+	result := make([]metrics.Metrics, 0, len(metricsDescr)+2)
+	for k, v := range metricsDescr {
+		value, err := getRuntimeMetric(runtime, k, v)
+		if err != nil {
+			log.Error().Err(err).Msg("failed collect metric")
+			continue
+		}
+		result = append(result, value)
+	}
+	result = append(result, metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &inc})
+	randomValue := rand.Float64()
+	result = append(result, metrics.Metrics{ID: "RandomValue", MType: "gauge", Value: &randomValue})
+	return result
+}
+
+// runtimeCollector - коллектор метрик runtime.MemStats, перечисленных в AgentConfig.Metrics.
+type runtimeCollector struct {
+	metricsDescr map[string]string
+	runtimeState runtime.MemStats
+	pollCounter  int64
+}
+
+func init() {
+	RegisterCollector("runtime", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		return &runtimeCollector{metricsDescr: cfg.Metrics}, nil
+	})
+}
+
+func (c *runtimeCollector) Name() string {
+	return "runtime"
+}
+
+func (c *runtimeCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	runtime.ReadMemStats(&c.runtimeState)
+	result := collectRuntimeMetrics(c.metricsDescr, &c.runtimeState, c.pollCounter)
+	c.pollCounter++
+	return result, nil
+}
@@ -0,0 +1,323 @@
+package metricsagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// statsdMaxPacket - максимальный размер UDP-пакета StatsD.
+const statsdMaxPacket = 65535
+
+// statsdSample - одно значение строки протокола StatsD.
+type statsdSample struct {
+	name     string
+	value    float64
+	set      string  // значение для типа s
+	kind     string  // c, g, ms, h или s
+	rate     float64 // частота выборки, 1 - без выборки
+	relative bool    // для gauge: значение со знаком изменяет текущее
+}
+
+// parseStatsD - разбирает строку протокола StatsD вида name:value|type[|@rate][|#tags]. Теги игнорируются.
+func parseStatsD(line string) (statsdSample, error) {
+	s := statsdSample{rate: 1}
+	parts := strings.Split(line, "|")
+	i := strings.LastIndex(parts[0], ":")
+	if i <= 0 || len(parts) < 2 {
+		return s, fmt.Errorf("bad statsd line: %q", line)
+	}
+	s.name = parts[0][:i]
+	parts[0] = parts[0][i+1:]
+	s.kind = parts[1]
+	for _, p := range parts[2:] {
+		if strings.HasPrefix(p, "@") {
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return s, fmt.Errorf("bad statsd sample rate: %q", line)
+			}
+			s.rate = rate
+		}
+	}
+	switch s.kind {
+	case "s":
+		s.set = parts[0]
+		return s, nil
+	case "c", "g", "ms", "h":
+	default:
+		return s, fmt.Errorf("unknown statsd type: %q", line)
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return s, fmt.Errorf("bad statsd value: %q", line)
+	}
+	// приращение счетчика отправляется как int64, поэтому значения вне его диапазона не принимаются
+	if d := value / s.rate; s.kind == "c" && (d < math.MinInt64 || d >= math.MaxInt64) {
+		return s, fmt.Errorf("statsd counter out of range: %q", line)
+	}
+	s.value = value
+	s.relative = s.kind == "g" && (parts[0][0] == '+' || parts[0][0] == '-')
+	return s, nil
+}
+
+// statsdCollector - коллектор, который принимает метрики по протоколу StatsD на UDP- и TCP-порту и агрегирует их до сбора.
+//
+// Счетчики отправляются приращениями, таймеры - gauge .mean, .min, .max, .pN и счетчиком .count за интервал сбора, множества - gauge с количеством уникальных значений за интервал. Gauge сохраняют значение между интервалами.
+type statsdCollector struct {
+	UDP         string    `json:"udp"`         // Адрес UDP, пустая строка - не слушать UDP
+	TCP         string    `json:"tcp"`         // Адрес TCP, пустая строка - не слушать TCP
+	Prefix      string    `json:"prefix"`      // Префикс, добавляемый к именам метрик
+	Percentiles []float64 `json:"percentiles"` // Перцентили таймеров
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string][]float64
+	timerN   map[string]float64 // количество значений таймера с учетом частоты выборки
+	sets     map[string]map[string]struct{}
+	carry    map[string]float64 // дробные остатки приращений счетчиков с частотой выборки
+	addrs    []net.Addr
+}
+
+func init() {
+	RegisterCollector("statsd", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := newStatsdCollector()
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		if c.UDP == "" && c.TCP == "" {
+			return nil, errors.New("statsd: udp or tcp address required")
+		}
+		for _, p := range c.Percentiles {
+			if p <= 0 || p >= 100 {
+				return nil, fmt.Errorf("statsd: bad percentile %v", p)
+			}
+		}
+		return c, nil
+	})
+}
+
+// newStatsdCollector - создает коллектор StatsD с параметрами по умолчанию.
+func newStatsdCollector() *statsdCollector {
+	return &statsdCollector{
+		UDP:         "127.0.0.1:8125",
+		Percentiles: []float64{90},
+		counters:    make(map[string]float64),
+		gauges:      make(map[string]float64),
+		timers:      make(map[string][]float64),
+		timerN:      make(map[string]float64),
+		sets:        make(map[string]map[string]struct{}),
+		carry:       make(map[string]float64),
+	}
+}
+
+func (c *statsdCollector) Name() string {
+	return "statsd"
+}
+
+// add - учитывает значение в агрегатах.
+func (c *statsdCollector) add(s statsdSample) {
+	name := c.Prefix + s.name
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch s.kind {
+	case "c":
+		c.counters[name] += s.value / s.rate
+	case "g":
+		if s.relative {
+			c.gauges[name] += s.value
+		} else {
+			c.gauges[name] = s.value
+		}
+	case "ms", "h":
+		c.timers[name] = append(c.timers[name], s.value)
+		c.timerN[name] += 1 / s.rate
+	case "s":
+		set, ok := c.sets[name]
+		if !ok {
+			set = make(map[string]struct{})
+			c.sets[name] = set
+		}
+		set[s.set] = struct{}{}
+	}
+}
+
+// handle - разбирает пакет или строку из нескольких строк протокола.
+func (c *statsdCollector) handle(data string) {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseStatsD(line)
+		if err != nil {
+			log.Debug().Err(err).Msg("statsd line skipped")
+			continue
+		}
+		c.add(s)
+	}
+}
+
+func (c *statsdCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []metrics.Metrics
+	counter := func(id string, value float64) {
+		// с частотой выборки приращение дробное: целая часть отправляется, а остаток переносится в следующий сбор
+		value += c.carry[id]
+		whole := math.Trunc(value)
+		if rest := value - whole; rest != 0 {
+			c.carry[id] = rest
+		} else {
+			delete(c.carry, id)
+		}
+		if whole != 0 {
+			delta := int64(whole)
+			result = append(result, metrics.Metrics{ID: id, MType: "counter", Delta: &delta})
+		}
+	}
+	for name, v := range c.counters {
+		counter(name, v)
+		delete(c.counters, name)
+	}
+	for name, v := range c.gauges {
+		result = append(result, gauge(name, v))
+	}
+	for name, samples := range c.timers {
+		sort.Float64s(samples)
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+		result = append(result,
+			gauge(name+".mean", sum/float64(len(samples))),
+			gauge(name+".min", samples[0]),
+			gauge(name+".max", samples[len(samples)-1]),
+		)
+		for _, p := range c.Percentiles {
+			rank := int(math.Ceil(p/100*float64(len(samples)))) - 1
+			result = append(result, gauge(name+".p"+strconv.FormatFloat(p, 'f', -1, 64), samples[rank]))
+		}
+		counter(name+".count", c.timerN[name])
+		delete(c.timers, name)
+		delete(c.timerN, name)
+	}
+	for name, set := range c.sets {
+		result = append(result, gauge(name, float64(len(set))))
+		delete(c.sets, name)
+	}
+	return result, nil
+}
+
+// Run - принимает метрики на адресах UDP и TCP до отмены ctx.
+func (c *statsdCollector) Run(ctx context.Context) error {
+	var conn net.PacketConn
+	var ln net.Listener
+	var err error
+	if c.UDP != "" {
+		if conn, err = net.ListenPacket("udp", c.UDP); err != nil {
+			return err
+		}
+		defer conn.Close()
+		c.setAddr(conn.LocalAddr())
+	}
+	if c.TCP != "" {
+		if ln, err = net.Listen("tcp", c.TCP); err != nil {
+			return err
+		}
+		defer ln.Close()
+		c.setAddr(ln.Addr())
+	}
+	wg := sync.WaitGroup{}
+	if conn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveUDP(conn)
+		}()
+	}
+	if ln != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveTCP(ctx, ln)
+		}()
+	}
+	log.Info().Str("udp", c.UDP).Str("tcp", c.TCP).Msg("statsd listener started")
+	<-ctx.Done()
+	if conn != nil {
+		conn.Close()
+	}
+	if ln != nil {
+		ln.Close()
+	}
+	wg.Wait()
+	log.Info().Msg("stopped statsd listener")
+	return nil
+}
+
+// setAddr - запоминает фактический адрес слушателя.
+func (c *statsdCollector) setAddr(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs = append(c.addrs, addr)
+}
+
+// serveUDP - читает пакеты до закрытия соединения.
+func (c *statsdCollector) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("failed read statsd packet")
+			}
+			return
+		}
+		c.handle(string(buf[:n]))
+	}
+}
+
+// serveTCP - принимает соединения до закрытия слушателя. Каждое соединение передает строки протокола, разделенные переводом строки.
+func (c *statsdCollector) serveTCP(ctx context.Context, ln net.Listener) {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("failed accept statsd connection")
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				c.handle(scanner.Text())
+			}
+		}()
+	}
+}
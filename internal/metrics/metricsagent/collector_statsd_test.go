@@ -0,0 +1,191 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    statsdSample
+		wantErr bool
+	}{
+		{
+			name: "Test #1: counter with sample rate",
+			line: "app.requests:2|c|@0.5",
+			want: statsdSample{name: "app.requests", value: 2, kind: "c", rate: 0.5},
+		},
+		{
+			name: "Test #2: relative gauge with tags",
+			line: "app.queue:-3|g|#env:prod",
+			want: statsdSample{name: "app.queue", value: -3, kind: "g", rate: 1, relative: true},
+		},
+		{
+			name: "Test #3: set",
+			line: "app.users:alice|s",
+			want: statsdSample{name: "app.users", set: "alice", kind: "s", rate: 1},
+		},
+		{
+			name:    "Test #4: unknown type",
+			line:    "app.requests:1|x",
+			wantErr: true,
+		},
+		{
+			name:    "Test #5: bad value",
+			line:    "app.requests:one|c",
+			wantErr: true,
+		},
+		{
+			name:    "Test #6: without type",
+			line:    "app.requests:1",
+			wantErr: true,
+		},
+		{
+			name:    "Test #7: NaN gauge",
+			line:    "app.queue:NaN|g",
+			wantErr: true,
+		},
+		{
+			name:    "Test #8: infinite counter",
+			line:    "app.requests:Inf|c",
+			wantErr: true,
+		},
+		{
+			name:    "Test #9: counter out of int64 range",
+			line:    "app.requests:1e19|c",
+			wantErr: true,
+		},
+		{
+			name:    "Test #10: counter out of int64 range with sample rate",
+			line:    "app.requests:5e18|c|@0.1",
+			wantErr: true,
+		},
+		{
+			name: "Test #11: large gauge",
+			line: "app.size:1e19|g",
+			want: statsdSample{name: "app.size", value: 1e19, kind: "g", rate: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStatsD(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStatsdCollect(t *testing.T) {
+	c := newStatsdCollector()
+	c.Percentiles = []float64{50, 99}
+	c.handle("req:1|c\nreq:1|c|@0.1\nqueue:10|g\nqueue:+5|g\nusers:a|s\nusers:b|s\nusers:a|s\nbad line")
+	for i := 1; i <= 10; i++ {
+		c.add(statsdSample{name: "latency", value: float64(i), kind: "ms", rate: 1})
+	}
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	byID := make(map[string]metrics.Metrics)
+	for _, v := range list {
+		byID[v.ID] = v
+	}
+	assert.Equal(t, int64(11), *byID["req"].Delta)
+	assert.Equal(t, 15.0, *byID["queue"].Value)
+	assert.Equal(t, 2.0, *byID["users"].Value)
+	assert.Equal(t, 5.5, *byID["latency.mean"].Value)
+	assert.Equal(t, 1.0, *byID["latency.min"].Value)
+	assert.Equal(t, 10.0, *byID["latency.max"].Value)
+	assert.Equal(t, 5.0, *byID["latency.p50"].Value)
+	assert.Equal(t, 10.0, *byID["latency.p99"].Value)
+	assert.Equal(t, int64(10), *byID["latency.count"].Delta)
+
+	list, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "queue", list[0].ID)
+}
+
+func TestStatsdCollectSampledCounter(t *testing.T) {
+	c := newStatsdCollector()
+	c.handle("hits:1|c|@0.4")
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(2), *list[0].Delta)
+
+	c.handle("hits:1|c|@0.4")
+	list, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(3), *list[0].Delta, "fractional remainder is carried to the next collect")
+}
+
+func TestStatsdListener(t *testing.T) {
+	isolateStats(t)
+	cfg := &agentutils.AgentConfig{
+		PollInterval: time.Hour,
+		Collectors: map[string]agentutils.CollectorConfig{
+			"statsd": {Enabled: true, PollInterval: 10 * time.Millisecond, Options: json.RawMessage(`{"udp": "127.0.0.1:0", "tcp": "127.0.0.1:0", "prefix": "app."}`)},
+		},
+	}
+	c, err := NewCollector("statsd", cfg, cfg.Collectors["statsd"].Options)
+	require.NoError(t, err)
+	sc := c.(*statsdCollector)
+	repo := NewRepo()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, sc.Run(ctx))
+	}()
+	go CollectWorker(ctx, wg, c, 10*time.Millisecond, repo)
+	require.Eventually(t, func() bool {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return len(sc.addrs) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	udp, err := net.Dial("udp", sc.addrs[0].String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("requests:2|c\nrequests:3|c"))
+	require.NoError(t, err)
+	tcp, err := net.Dial("tcp", sc.addrs[1].String())
+	require.NoError(t, err)
+	defer tcp.Close()
+	_, err = tcp.Write([]byte("requests:5|c\nqueue:7|g\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		_, ok := repo.db["app.queue"]
+		return ok && repo.deltas["app.requests"] == 10
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	list := repo.batch(cfg)
+	assert.Len(t, list, 2)
+	assert.Empty(t, repo.deltas)
+	repo.requeue(list)
+	assert.Equal(t, int64(10), repo.deltas["app.requests"])
+	assert.NotContains(t, repo.retry, "app.requests")
+}
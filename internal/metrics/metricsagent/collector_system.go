@@ -0,0 +1,97 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// getVirtualMemoryMetrics - собирает метрики памяти: TotalMemory и FreeMemory.
+func getVirtualMemoryMetrics() ([]metrics.Metrics, error) {
+	var result []metrics.Metrics
+	vmem, err := mem.VirtualMemory()
+	if err != nil {
+		log.Error().Err(err).Msg("failed get virtual memory")
+		return nil, err
+	}
+	result = append(result, getTotalMemory(vmem))
+	result = append(result, getFreeMemory(vmem))
+	return result, nil
+}
+
+// getTotalMemory - создает и заполняет метрику TotalMemory.
+func getTotalMemory(vmem *mem.VirtualMemoryStat) metrics.Metrics {
+	m := metrics.Metrics{}
+	m.ID = "TotalMemory"
+	m.MType = "gauge"
+	valueTotal := float64(vmem.Total)
+	m.Value = &valueTotal
+	return m
+}
+
+// getFreeMemory - создает и заполняет метрику FreeMemory.
+func getFreeMemory(vmem *mem.VirtualMemoryStat) metrics.Metrics {
+	m := metrics.Metrics{}
+	m.ID = "FreeMemory"
+	m.MType = "gauge"
+	valueFree := float64(vmem.Free)
+	m.Value = &valueFree
+	return m
+}
+
+// getCPUMetrics - получает количество ядер процессора,создает метрики с названием "CPUutilization№" и заполняет их значением утилизации с последней проверки.
+func getCPUMetrics() ([]metrics.Metrics, error) {
+	var result []metrics.Metrics
+	totalCPU, err := cpu.Counts(true)
+	if err != nil {
+		log.Error().Err(err).Msg("failed get total cpu count")
+		return nil, err
+	}
+	CPUutil, err := cpu.Percent(0, true)
+	if err != nil {
+		log.Error().Err(err).Msg("failed get cpu util")
+		return nil, err
+	}
+	for i := 1; i <= totalCPU; i++ {
+		m := metrics.Metrics{}
+		m.ID = "CPUutilization" + strconv.Itoa(i)
+		m.MType = "gauge"
+		value := CPUutil[i-1]
+		m.Value = &value
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// collectSystemMetrics - считывает метрики ситсемы (память и ЦПУ). Возвращает собранные метрики и последнюю ошибку сбора.
+func collectSystemMetrics() ([]metrics.Metrics, error) {
+	virtualmemory, memErr := getVirtualMemoryMetrics()
+	cpumetrics, err := getCPUMetrics()
+	result := append(virtualmemory, cpumetrics...)
+	if err != nil {
+		return result, err
+	}
+	return result, memErr
+}
+
+// systemCollector - коллектор метрик памяти и загрузки процессора.
+type systemCollector struct{}
+
+func init() {
+	RegisterCollector("system", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		return systemCollector{}, nil
+	})
+}
+
+func (systemCollector) Name() string {
+	return "system"
+}
+
+func (systemCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	return collectSystemMetrics()
+}
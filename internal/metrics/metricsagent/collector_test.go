@@ -0,0 +1,214 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/shirou/gopsutil/v3/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCollector - коллектор, возвращающий одну метрику со значением из параметров.
+type testCollector struct {
+	Value float64 `json:"value"`
+}
+
+func init() {
+	RegisterCollector("test", func(cfg *agentutils.AgentConfig, options json.RawMessage) (Collector, error) {
+		c := &testCollector{Value: 1}
+		if err := decodeOptions(options, c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+func (c *testCollector) Name() string {
+	return "test"
+}
+
+func (c *testCollector) Collect(ctx context.Context) ([]metrics.Metrics, error) {
+	value := c.Value
+	return []metrics.Metrics{{ID: "TestValue", MType: "gauge", Value: &value}}, nil
+}
+
+// isolateStats - подменяет состояние воркеров на время теста, чтобы воркеры теста не влияли на статус агента в других тестах.
+func isolateStats(t *testing.T) {
+	stats := Stats
+	Stats = NewAgentStats()
+	t.Cleanup(func() {
+		Stats = stats
+	})
+}
+
+func TestCollectors(t *testing.T) {
+	assert.Subset(t, Collectors(), []string{"runtime", "system", "test"})
+	assert.Panics(t, func() {
+		RegisterCollector("test", nil)
+	})
+	_, err := NewCollector("unknown", &agentutils.AgentConfig{}, nil)
+	assert.Error(t, err)
+	_, err = NewCollector("test", &agentutils.AgentConfig{}, json.RawMessage(`{"another": 1}`))
+	assert.Error(t, err)
+	c, err := NewCollector("test", &agentutils.AgentConfig{}, json.RawMessage(`{"value": 7.77}`))
+	require.NoError(t, err)
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, 7.77, *list[0].Value)
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	c, err := NewCollector("runtime", &agentutils.AgentConfig{Metrics: map[string]string{"Alloc": "gauge"}}, nil)
+	require.NoError(t, err)
+	for i := int64(0); i < 2; i++ {
+		list, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		byID := make(map[string]metrics.Metrics)
+		for _, v := range list {
+			byID[v.ID] = v
+		}
+		assert.Len(t, byID, 3)
+		assert.Equal(t, i, *byID["PollCount"].Delta)
+	}
+}
+
+func TestStartCollectors(t *testing.T) {
+	isolateStats(t)
+	cfg := &agentutils.AgentConfig{
+		PollInterval: time.Hour,
+		Collectors: map[string]agentutils.CollectorConfig{
+			"test":    {Enabled: true, PollInterval: 10 * time.Millisecond, Options: json.RawMessage(`{"value": 2}`)},
+			"system":  {Enabled: false},
+			"unknown": {Enabled: true},
+		},
+	}
+	repo := NewRepo()
+	wg := &sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	StartCollectors(ctx, wg, cfg, repo)
+	assert.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		m, ok := repo.db["TestValue"]
+		return ok && *m.Value == 2
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Len(t, repo.db, 1)
+}
+
+func TestNameFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter nameFilter
+		names  []string
+		want   bool
+	}{
+		{
+			name:  "Test #1: empty filter",
+			names: []string{"eth0"},
+			want:  true,
+		},
+		{
+			name:   "Test #2: include",
+			filter: nameFilter{Include: []string{"eth*"}},
+			names:  []string{"eth0"},
+			want:   true,
+		},
+		{
+			name:   "Test #3: not included",
+			filter: nameFilter{Include: []string{"eth*"}},
+			names:  []string{"lo"},
+			want:   false,
+		},
+		{
+			name:   "Test #4: excluded by second name",
+			filter: nameFilter{Exclude: []string{"/dev/loop*"}},
+			names:  []string{"/snap/core", "/dev/loop1"},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.match(tt.names...))
+		})
+	}
+	assert.Error(t, nameFilter{Exclude: []string{"[a"}}.validate())
+}
+
+func TestMetricLabel(t *testing.T) {
+	assert.Equal(t, "root", metricLabel("/"))
+	assert.Equal(t, "var_lib", metricLabel("/var/lib"))
+	assert.Equal(t, "eth0.100", metricLabel("eth0.100"))
+}
+
+func TestHostCollectors(t *testing.T) {
+	for _, name := range []string{"load", "swap", "processes", "net"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCollector(name, &agentutils.AgentConfig{}, nil)
+			require.NoError(t, err)
+			list, err := c.Collect(context.Background())
+			require.NoError(t, err)
+			assert.NotEmpty(t, list)
+		})
+	}
+	_, err := NewCollector("load", &agentutils.AgentConfig{}, json.RawMessage(`{"include": ["a"]}`))
+	assert.Error(t, err)
+	c, err := NewCollector("net", &agentutils.AgentConfig{}, json.RawMessage(`{"include": ["lo"]}`))
+	require.NoError(t, err)
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	for _, v := range list {
+		assert.Contains(t, v.ID, ".lo")
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "agent.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600))
+	self, err := process.NewProcess(int32(os.Getpid()))
+	require.NoError(t, err)
+	exe, err := self.Name()
+	require.NoError(t, err)
+	options, err := json.Marshal(map[string]interface{}{
+		"processes": []ProcessMatch{
+			{Name: "by_pid", PidFile: pidFile},
+			{Name: "by_exe", Exe: exe},
+			{Name: "by_cmdline", Cmdline: regexp.QuoteMeta(os.Args[0])},
+			{Name: "missing", Cmdline: "^no-such-process-[0-9]+$"},
+		},
+	})
+	require.NoError(t, err)
+	c, err := NewCollector("process", &agentutils.AgentConfig{}, options)
+	require.NoError(t, err)
+	list, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	byID := make(map[string]float64)
+	for _, v := range list {
+		byID[v.ID] = *v.Value
+	}
+	for _, name := range []string{"by_pid", "by_exe", "by_cmdline"} {
+		assert.GreaterOrEqual(t, byID["Process."+name+".Count"], 1.0, name)
+		assert.Greater(t, byID["Process."+name+".RSS"], 0.0, name)
+		assert.Greater(t, byID["Process."+name+".Threads"], 0.0, name)
+	}
+	assert.Equal(t, 0.0, byID["Process.missing.Count"])
+
+	_, err = NewCollector("process", &agentutils.AgentConfig{}, json.RawMessage(`{"processes": [{"name": "bad", "exe": "a", "cmdline": "b"}]}`))
+	assert.Error(t, err)
+	_, err = NewCollector("process", &agentutils.AgentConfig{}, nil)
+	assert.Error(t, err)
+}
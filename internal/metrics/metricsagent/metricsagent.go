@@ -3,221 +3,169 @@ package metricsagent
 
 import (
 	"context"
-	rnd "crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
-	"math/rand"
 	"net/http"
-	"reflect"
-	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
 	"github.com/colzphml/yandex_project/internal/metrics"
 	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
-	cgrpc "github.com/colzphml/yandex_project/internal/scenarios/grpc"
 	"github.com/rs/zerolog"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
-// MetricRepo - хранилище метрик для сбора (потокобезопасное, так как есть 2 независимых коллектора - Runtime и System).
+// MetricRepo - хранилище метрик для сбора (потокобезопасное, так как коллекторы работают независимо друг от друга).
 type MetricRepo struct {
-	db map[string]metrics.Metrics
-	mu sync.Mutex
+	db     map[string]metrics.Metrics
+	retry  map[string]metrics.Metrics // метрики, которые сервер не сохранил из-за своей ошибки и которые нужно отправить повторно
+	deltas map[string]int64           // приращения счетчиков от слушающих коллекторов, накопленные с прошлой отправки
+	// агрегации gauge-метрик и значения, собранные для них с прошлой отправки
+	aggregations []aggregationRule
+	window       map[string][]float64
+	pipeline     *metrics.Pipeline // правила обработки собранных метрик
+	mu           sync.Mutex
 }
 
 // NewRepo - инициализирует хранилище метрик.
 func NewRepo() *MetricRepo {
 	r := MetricRepo{
-		db: make(map[string]metrics.Metrics),
+		db:     make(map[string]metrics.Metrics),
+		retry:  make(map[string]metrics.Metrics),
+		deltas: make(map[string]int64),
+		window: make(map[string][]float64),
 	}
 	return &r
 }
 
-var log = zerolog.New(agentutils.LogConfig()).With().Timestamp().Str("component", "metricsagent").Logger()
-
-// getRuntimeMetric - получает из runtime значение метрики fieldName и возвращает его с типом fieldType.
-func getRuntimeMetric(m *runtime.MemStats, fieldName string, fieldType string) (metrics.Metrics, error) {
-	var result metrics.Metrics
-	result.ID = fieldName
-	result.MType = fieldType
-	r := reflect.ValueOf(m)
-	if r.Kind() == reflect.Ptr {
-		r = r.Elem()
-	}
-	f := r.FieldByName(fieldName)
-	if !f.IsValid() {
-		return metrics.Metrics{}, errors.New("runtime not have this variable:" + fieldName + ", check config file")
-	}
-	switch t := r.FieldByName(fieldName).Type().Name(); {
-	case strings.Contains(t, "int") && fieldType == "gauge":
-		var v float64
-		v = float64(f.Uint())
-		result.Value = &v
-		return result, nil
-	case strings.Contains(t, "int") && fieldType == "counter":
-		var v int64
-		v = int64(f.Uint())
-		result.Delta = &v
-		return result, nil
-	case strings.Contains(t, "float") && fieldType == "gauge":
-		var v float64
-		v = float64(f.Float())
-		result.Value = &v
-		return result, nil
-	case strings.Contains(t, "float") && fieldType == "counter":
-		var v int64
-		v = int64(f.Float())
-		result.Delta = &v
-		return result, nil
-	default:
-		return metrics.Metrics{}, errors.New("not know type of variable: " + fieldType + ", check config file")
-	}
+// SetPipeline - задает правила обработки метрик, которые применяются при записи собранных метрик в хранилище. Агрегации настраиваются по именам метрик после обработки.
+func (repo *MetricRepo) SetPipeline(p *metrics.Pipeline) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.pipeline = p
 }
 
-// ReadRuntimeMetrics - считывает метрики из Runtime согласно описанию из конфига и сохраняет их в хранилище метрик для отправки.
-//
-// Так же добавляет 2 метрики: Количество запросов PollCount - counter, Слуучайное число RandomValue - gauge.
-func ReadRuntimeMetrics(repo *MetricRepo, metricsDescr map[string]string, runtime *runtime.MemStats, inc int64) {
+// Accumulate - записывает метрики слушающего коллектора: счетчики содержат приращения и суммируются до отправки, остальные метрики заменяют предыдущие значения.
+func (repo *MetricRepo) Accumulate(list []metrics.Metrics) {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	for k, v := range metricsDescr {
-		value, err := getRuntimeMetric(runtime, k, v)
-		if err != nil {
-			log.Error().Err(err).Msg("failed collect metric")
+	for _, v := range repo.pipeline.Apply(list) {
+		if v.MType == "counter" && v.Delta != nil {
+			repo.deltas[v.ID] += *v.Delta
 			continue
 		}
-		repo.db[k] = value
+		repo.db[v.ID] = v
+		repo.observe(v)
 	}
-	incMetrics := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &inc}
-	repo.db[incMetrics.ID] = incMetrics
-	randomValue := rand.Float64()
-	randMetrics := metrics.Metrics{ID: "RandomValue", MType: "gauge", Value: &randomValue}
-	repo.db[randMetrics.ID] = randMetrics
 }
 
-// CollectRuntimeWorker - воркер, который записывает метрики спустя каждый интервал. Отвечает за сбор метрик и штатное завершение потока при остановке работы.
-func CollectRuntimeWorker(ctx context.Context, wg *sync.WaitGroup, cfg *agentutils.AgentConfig, repo *MetricRepo) {
-	var runtimeState runtime.MemStats
-	var pollCouter int64
-	tickerPoll := time.NewTicker(cfg.PollInterval)
-	for {
-		select {
-		case <-tickerPoll.C:
-			runtime.ReadMemStats(&runtimeState)
-			ReadRuntimeMetrics(repo, cfg.Metrics, &runtimeState, pollCouter)
-			pollCouter++
-		case <-ctx.Done():
-			tickerPoll.Stop()
-			log.Info().Msg("stopped collectWorker Runtime")
-			wg.Done()
-			return
-		}
-	}
+// isIncrement - проверяет, что метрика - приращение счетчика от слушающего коллектора, а не значение из собранных метрик.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) isIncrement(m metrics.Metrics) bool {
+	_, ok := repo.db[m.ID]
+	return !ok && m.MType == "counter" && m.Delta != nil
 }
 
-// getVirtualMemoryMetrics - собирает метрики памяти: TotalMemory и FreeMemory.
-func getVirtualMemoryMetrics() ([]metrics.Metrics, error) {
-	var result []metrics.Metrics
-	vmem, err := mem.VirtualMemory()
-	if err != nil {
-		log.Error().Err(err).Msg("failed get virtual memory")
-		return nil, err
+// batch - формирует пакет метрик для отправки: собранные метрики, накопленные приращения счетчиков, агрегации gauge-метрик и метрики для повторной отправки, которые еще не были собраны заново.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) batch(cfg *agentutils.AgentConfig) []metrics.Metrics {
+	list := make([]metrics.Metrics, 0, len(repo.db)+len(repo.deltas)+len(repo.retry))
+	for _, v := range repo.db {
+		if !cfg.SignBatch {
+			v.FillHash(cfg.Key)
+		}
+		list = append(list, v)
 	}
-	result = append(result, getTotalMemory(vmem))
-	result = append(result, getFreeMemory(vmem))
-	return result, nil
-}
-
-// getTotalMemory - создает и заполняет метрику TotalMemory.
-func getTotalMemory(vmem *mem.VirtualMemoryStat) metrics.Metrics {
-	m := metrics.Metrics{}
-	m.ID = "TotalMemory"
-	m.MType = "gauge"
-	valueTotal := float64(vmem.Total)
-	m.Value = &valueTotal
-	return m
-}
-
-// getFreeMemory - создает и заполняет метрику FreeMemory.
-func getFreeMemory(vmem *mem.VirtualMemoryStat) metrics.Metrics {
-	m := metrics.Metrics{}
-	m.ID = "FreeMemory"
-	m.MType = "gauge"
-	valueFree := float64(vmem.Free)
-	m.Value = &valueFree
-	return m
-}
-
-// getCPUMetrics - получает количество ядер процессора,создает метрики с названием "CPUutilization№" и заполняет их значением утилизации с последней проверки.
-func getCPUMetrics() ([]metrics.Metrics, error) {
-	var result []metrics.Metrics
-	totalCPU, err := cpu.Counts(true)
-	if err != nil {
-		log.Error().Err(err).Msg("failed get total cpu count")
-		return nil, err
+	for k, v := range repo.retry {
+		if _, ok := repo.db[k]; !ok {
+			if !cfg.SignBatch {
+				v.FillHash(cfg.Key)
+			}
+			list = append(list, v)
+		}
+		delete(repo.retry, k)
 	}
-	CPUutil, err := cpu.Percent(0, true)
-	if err != nil {
-		log.Error().Err(err).Msg("failed get cpu util")
-		return nil, err
+	for k, d := range repo.deltas {
+		delta := d
+		v := metrics.Metrics{ID: k, MType: "counter", Delta: &delta}
+		if !cfg.SignBatch {
+			v.FillHash(cfg.Key)
+		}
+		list = append(list, v)
+		delete(repo.deltas, k)
 	}
-	for i := 1; i <= totalCPU; i++ {
-		m := metrics.Metrics{}
-		m.ID = "CPUutilization" + strconv.Itoa(i)
-		m.MType = "gauge"
-		value := CPUutil[i-1]
-		m.Value = &value
-		result = append(result, m)
+	for _, v := range repo.aggregate() {
+		if !cfg.SignBatch {
+			v.FillHash(cfg.Key)
+		}
+		list = append(list, v)
 	}
-	return result, nil
+	return list
 }
 
-// ReadSystemMetrics - считывает метрики ситсемы (память и ЦПУ) и сохраняет их в хранилище метрик для отправки.
-func ReadSystemMetrics(repo *MetricRepo) {
-	repo.mu.Lock()
-	defer repo.mu.Unlock()
-	virtualmemory, err := getVirtualMemoryMetrics()
-	if err != nil {
-		log.Error().Err(err)
-	} else {
-		for _, v := range virtualmemory {
-			repo.db[v.ID] = v
+// requeue - откладывает метрики неподтвержденного пакета для повторной отправки. Приращения счетчиков возвращаются к накопленным.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) requeue(list []metrics.Metrics) {
+	for _, v := range list {
+		if repo.isIncrement(v) {
+			repo.deltas[v.ID] += *v.Delta
+			continue
+		}
+		if _, ok := repo.retry[v.ID]; !ok {
+			repo.retry[v.ID] = v
 		}
 	}
-	cpumetrics, err := getCPUMetrics()
-	if err != nil {
-		log.Error().Err(err)
-		return
+}
+
+// handleBatchResult - разбирает ответ сервера на пакет метрик: отклоненные метрики логируются, а метрики, не сохраненные из-за ошибки сервера, откладываются для повторной отправки.
+//
+// Вызывается под блокировкой хранилища.
+func (repo *MetricRepo) handleBatchResult(sent []metrics.Metrics, result metrics.BatchResult) {
+	byID := make(map[string]metrics.Metrics, len(sent))
+	for _, v := range sent {
+		byID[v.ID] = v
 	}
-	for _, v := range cpumetrics {
-		repo.db[v.ID] = v
+	for _, v := range result.Items {
+		switch v.Status {
+		case metrics.StatusAccepted:
+		case metrics.StatusInternalError:
+			if m, ok := byID[v.ID]; ok {
+				if repo.isIncrement(m) {
+					repo.deltas[m.ID] += *m.Delta
+				} else {
+					repo.retry[v.ID] = m
+				}
+			}
+			log.Warn().Str("metric", v.ID).Str("error", v.Error).Msg("metric not saved by server, will retry")
+		default:
+			log.Error().Str("metric", v.ID).Str("status", v.Status).Str("error", v.Error).Msg("metric rejected by server")
+		}
 	}
+	log.Debug().Int("accepted", result.Accepted).Int("rejected", result.Rejected).Msg("batch sent")
 }
 
-// CollectSystemWorker - воркер, который записывает системные метрики спустя каждый интервал. Отвечает за сбор метрик и штатное завершение потока при остановке работы.
-func CollectSystemWorker(ctx context.Context, wg *sync.WaitGroup, cfg *agentutils.AgentConfig, repo *MetricRepo) {
-	tickerPoll := time.NewTicker(cfg.PollInterval)
-	for {
-		select {
-		case <-tickerPoll.C:
-			ReadSystemMetrics(repo)
-		case <-ctx.Done():
-			tickerPoll.Stop()
-			log.Info().Msg("stopped collectWorker System")
-			wg.Done()
-			return
-		}
+var log = zerolog.New(agentutils.LogConfig()).With().Timestamp().Str("component", "metricsagent").Logger()
+
+// signBody - рассчитывает подпись всего тела запроса, если агент настроен подписывать пакет целиком.
+func signBody(cfg *agentutils.AgentConfig, body []byte) string {
+	if !cfg.SignBatch || cfg.Key == "" {
+		return ""
+	}
+	hash, err := metrics.SignBody(body, cfg.Key)
+	if err != nil {
+		log.Error().Err(err).Msg("failed sign body")
+		return ""
 	}
+	return hash
 }
 
 // SendMetrics - формирует из метрики запрос на отправку данных серверу через URL path.
@@ -236,116 +184,180 @@ func SendMetrics(srv string, repo *MetricRepo, client *http.Client) {
 	}
 }
 
-// SendJSONMetrics - формирует из метрики запрос на отправку данных серверу через json-body.
-func SendJSONMetrics(cfg *agentutils.AgentConfig, repo *MetricRepo, client *http.Client) {
+// SendJSONMetrics - формирует из метрики запрос на отправку данных серверу через json-body. Возвращает последнюю ошибку отправки.
+func SendJSONMetrics(cfg *agentutils.AgentConfig, repo *MetricRepo, client *http.Client) error {
 	urlPrefix := "http://" + cfg.ServerAddress + "/update/"
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	for _, v := range repo.db {
-		v.FillHash(cfg.Key)
+	var lastErr error
+	list := repo.batch(cfg)
+	for i, v := range list {
 		postBody, err := json.Marshal(v)
 		if err != nil {
 			log.Error().Err(err).Msg("failed marshall json")
+			repo.requeue([]metrics.Metrics{v})
+			lastErr = err
 			continue
 		}
+		hash := signBody(cfg, postBody)
 		if cfg.PublicKey != nil {
-			postBody, err = rsa.EncryptOAEP(
-				sha256.New(),
-				rnd.Reader,
-				cfg.PublicKey,
-				postBody,
-				nil,
-			)
+			postBody, err = agentutils.EncryptRSA(cfg.PublicKey, postBody)
 			if err != nil {
 				log.Error().Err(err).Msg("failed encrypt body (list)")
-				return
+				repo.requeue([]metrics.Metrics{v})
+				lastErr = err
+				continue
 			}
 		}
-		err = agentutils.HTTPSendJSON(client, urlPrefix, postBody)
+		_, err = agentutils.HTTPSendJSON(client, urlPrefix, postBody, hash)
 		if err != nil {
 			log.Error().Err(err).Msg("failed send with body")
+			lastErr = err
+			if retryAfter(err) > 0 {
+				// сервер ограничил частоту запросов: остальные метрики отправляются после паузы
+				repo.requeue(list[i:])
+				return lastErr
+			}
+			if !retryable(err) {
+				log.Error().Str("metric", v.ID).Msg("metric rejected by server, dropped")
+				continue
+			}
+			repo.requeue([]metrics.Metrics{v})
 			continue
 		}
 	}
+	return lastErr
 }
 
 // SendListJSONMetrics - формирует body из набора метрик запрос на отправку данных серверу через array json.
-func SendListJSONMetrics(cfg *agentutils.AgentConfig, repo *MetricRepo, client *http.Client) {
+func SendListJSONMetrics(cfg *agentutils.AgentConfig, repo *MetricRepo, client *http.Client) error {
 	urlPrefix := "http://" + cfg.ServerAddress + "/updates/"
-	var list []metrics.Metrics
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	for _, v := range repo.db {
-		v.FillHash(cfg.Key)
-		list = append(list, v)
-	}
+	list := repo.batch(cfg)
 	postBody, err := json.Marshal(list)
 	if err != nil {
 		log.Error().Err(err).Msg("failed marshall json")
-		return
+		repo.requeue(list)
+		return err
+	}
+	hash := signBody(cfg, postBody)
+	if cfg.PublicKey != nil {
+		postBody, err = agentutils.EncryptRSA(cfg.PublicKey, postBody)
+		if err != nil {
+			log.Error().Err(err).Msg("failed encrypt body (list)")
+			repo.requeue(list)
+			return err
+		}
 	}
-	// if cfg.PublicKey != nil {
-	// 	postBody, err = rsa.EncryptOAEP(
-	// 		sha256.New(),
-	// 		rnd.Reader,
-	// 		cfg.PublicKey,
-	// 		postBody,
-	// 		nil,
-	// 	)
-	// 	if err != nil {
-	// 		log.Error().Err(err).Msg("failed encrypt body (list)")
-	// 		return
-	// 	}
-	// }
-	err = agentutils.HTTPSendJSON(client, urlPrefix, postBody)
+	respBody, err := agentutils.HTTPSendJSON(client, urlPrefix, postBody, hash)
 	if err != nil {
 		log.Error().Err(err).Msg("failed send with body (list)")
-		return
+		if !retryable(err) {
+			log.Error().Int("metrics", len(list)).Msg("batch rejected by server, dropped")
+			return err
+		}
+		repo.requeue(list)
+		return err
+	}
+	var result metrics.BatchResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		log.Error().Err(err).Msg("failed parse server response (list)")
+		return err
 	}
+	repo.handleBatchResult(list, result)
+	return nil
 }
 
-func SendGRPC(ctx context.Context, cfg *agentutils.AgentConfig, repo *MetricRepo, conn pb.MetricsClient) {
-	var result []*pb.Metric
-	repo.mu.Lock()
-	defer repo.mu.Unlock()
-	for _, v := range repo.db {
-		v.FillHash(cfg.Key)
-		result = append(result, cgrpc.ConvertMetrictoGRPC(v))
+// encryptRequest - шифрует запрос публичным ключом сервера, если он задан. Подпись рассчитывается до шифрования.
+func encryptRequest(cfg *agentutils.AgentConfig, req *pb.SaveListMetricsRequest) (*pb.SaveListMetricsRequest, error) {
+	if cfg.PublicKey == nil {
+		return req, nil
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
 	}
-	var req pb.SaveListMetricsRequest
-	req.Metric = result
-	md := metadata.New(map[string]string{"X-Real-IP": agentutils.GetLocalIP()})
-	ctx = metadata.NewOutgoingContext(ctx, md)
-	_, err := conn.SaveList(ctx, &req)
+	encrypted, err := agentutils.EncryptRSA(cfg.PublicKey, body)
 	if err != nil {
-		log.Error().Err(err).Msg("failed send via grpc")
-		return
+		return nil, err
+	}
+	return &pb.SaveListMetricsRequest{Encrypted: encrypted}, nil
+}
+
+// retryable - проверяет, что неотправленные метрики можно отправить повторно: ошибка соединения, ответ 5xx или 429. Повтор после остальных ответов сервера будет отклонен так же.
+func retryable(err error) bool {
+	var statusErr *agentutils.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError || statusErr.Code == http.StatusTooManyRequests
 	}
+	return true
+}
+
+// retryAfter - время, через которое сервер разрешил повторить запрос после отказа из-за ограничения частоты запросов: заголовок Retry-After ответа 429 или RetryInfo статуса ResourceExhausted. 0 - ошибка не связана с ограничением.
+func retryAfter(err error) time.Duration {
+	var statusErr *agentutils.StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Code != http.StatusTooManyRequests {
+			return 0
+		}
+		if statusErr.RetryAfter <= 0 {
+			return time.Second
+		}
+		return statusErr.RetryAfter
+	}
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return 0
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay.AsDuration() > 0 {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return time.Second
 }
 
 // SendWorker - воркер, который отправляет собранные на текущий момент метрики на сервер. Отвечает за отправку метрик и штатное завершение потока при остановке работы.
+//
+// Если указан адрес gRPC - метрики отправляются пакетами в долгоживущий поток StreamSave.
 func SendWorker(ctx context.Context, wg *sync.WaitGroup, cfg *agentutils.AgentConfig, repo *MetricRepo) {
 	tickerReport := time.NewTicker(cfg.ReportInterval)
 	client := &http.Client{}
-	var conn pb.MetricsClient
+	var stream *StreamSender
 	if cfg.ServerAddressGRPC != "" {
 		grpcconn, err := grpc.Dial(cfg.ServerAddressGRPC, grpc.WithTransportCredentials(insecure.NewCredentials()))
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed initialize server")
 		}
-		conn = pb.NewMetricsClient(grpcconn)
+		defer grpcconn.Close()
+		stream = NewStreamSender(cfg, repo, pb.NewMetricsClient(grpcconn))
 	}
+	Stats.Register(WorkerSend, cfg.ReportInterval)
+	// после отказа из-за ограничения частоты запросов отправка откладывается до notBefore, метрики копятся в хранилище
+	var notBefore time.Time
 	for {
 		select {
 		case <-tickerReport.C:
-			if cfg.ServerAddressGRPC != "" {
-				SendGRPC(ctx, cfg, repo, conn)
-			} else {
-				SendJSONMetrics(cfg, repo, client)
+			if wait := time.Until(notBefore); wait > 0 {
+				log.Warn().Dur("retry_after", wait).Msg("server rate limit, report skipped")
+				continue
+			}
+			start := time.Now()
+			switch {
+			case stream != nil:
+				// результат отправки в поток учитывается при получении подтверждения
+				stream.Send(ctx)
+			default:
+				err := SendListJSONMetrics(cfg, repo, client)
+				Stats.Observe(WorkerSend, time.Since(start), err)
+				notBefore = start.Add(retryAfter(err))
 			}
-			// SendListJSONMetrics(cfg, repo, client)
 		case <-ctx.Done():
 			tickerReport.Stop()
+			if stream != nil {
+				stream.Close()
+			}
 			log.Info().Msg("stopped sendWorker")
 			wg.Done()
 			return
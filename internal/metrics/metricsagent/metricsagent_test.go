@@ -1,12 +1,30 @@
 package metricsagent
 
 import (
-	"math/rand"
+	"context"
+	rnd "crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/middleware"
+	"github.com/colzphml/yandex_project/internal/scenarios/handlers"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 func BenchmarkGetRuntimeMetric(b *testing.B) {
@@ -29,26 +47,26 @@ func BenchmarkGetRuntimeMetric(b *testing.B) {
 
 }
 
-func BenchmarkReadRuntimeMetrics(b *testing.B) {
+func BenchmarkRuntimeCollector(b *testing.B) {
 	r := NewRepo()
-	metricsDescr := map[string]string{
+	c := &runtimeCollector{metricsDescr: map[string]string{
 		"Alloc":     "gauge",
 		"NextGC":    "gauge",
 		"HeapInuse": "gauge",
-	}
-	var runtimeState runtime.MemStats
-	rand.Seed(time.Now().UnixNano())
+	}}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ReadRuntimeMetrics(r, metricsDescr, &runtimeState, rand.Int63()%1000)
+		list, _ := c.Collect(context.Background())
+		r.Store(list)
 	}
 }
 
-func BenchmarkReadSystemMetrics(b *testing.B) {
+func BenchmarkSystemCollector(b *testing.B) {
 	r := NewRepo()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ReadSystemMetrics(r)
+		list, _ := systemCollector{}.Collect(context.Background())
+		r.Store(list)
 	}
 }
 
@@ -88,19 +106,25 @@ func (suite *MetricsAgentSuite) TestgetRuntimeMetricWrongType() {
 	suite.Error(err)
 }
 
-func (suite *MetricsAgentSuite) TestReadRuntimeMetrics() {
-	ReadRuntimeMetrics(suite.repo, suite.metricsDescr, suite.runtime, 1)
+func (suite *MetricsAgentSuite) TestRuntimeCollector() {
+	list, err := (&runtimeCollector{metricsDescr: suite.metricsDescr}).Collect(context.Background())
+	suite.NoError(err)
+	suite.repo.Store(list)
 	suite.Equal(5, len(suite.repo.db))
 }
 
-func (suite *MetricsAgentSuite) TestReadRuntimeMetricsInvalidName() {
+func (suite *MetricsAgentSuite) TestRuntimeCollectorInvalidName() {
 	suite.metricsDescr["another"] = "gauge"
-	ReadRuntimeMetrics(suite.repo, suite.metricsDescr, suite.runtime, 1)
+	list, err := (&runtimeCollector{metricsDescr: suite.metricsDescr}).Collect(context.Background())
+	suite.NoError(err)
+	suite.repo.Store(list)
 	suite.Equal(5, len(suite.repo.db))
 }
 
-func (suite *MetricsAgentSuite) TestReadSystemMetrics() {
-	ReadSystemMetrics(suite.repo)
+func (suite *MetricsAgentSuite) TestSystemCollector() {
+	list, err := systemCollector{}.Collect(context.Background())
+	suite.NoError(err)
+	suite.repo.Store(list)
 	suite.GreaterOrEqual(len(suite.repo.db), 3)
 	_, ok := suite.repo.db["TotalMemory"]
 	suite.Equal(true, ok)
@@ -110,6 +134,127 @@ func (suite *MetricsAgentSuite) TestReadSystemMetrics() {
 	suite.Equal(true, ok)
 }
 
+func (suite *MetricsAgentSuite) TestHandleBatchResult() {
+	value := 7.77
+	sent := []metrics.Metrics{
+		{ID: "Saved", MType: "gauge", Value: &value},
+		{ID: "Retry", MType: "gauge", Value: &value},
+		{ID: "Conflict", MType: "gauge", Value: &value},
+	}
+	result := metrics.BatchResult{}
+	result.Add(sent[0].Status(metrics.StatusAccepted, nil))
+	result.Add(sent[1].Status(metrics.StatusInternalError, nil))
+	result.Add(sent[2].Status(metrics.StatusTypeConflict, nil))
+	suite.repo.handleBatchResult(sent, result)
+	suite.Equal(1, len(suite.repo.retry))
+	_, ok := suite.repo.retry["Retry"]
+	suite.Equal(true, ok)
+	list := suite.repo.batch(&agentutils.AgentConfig{})
+	suite.Equal(1, len(list))
+	suite.Equal(0, len(suite.repo.retry))
+}
+
 func TestExampleTestSuite(t *testing.T) {
 	suite.Run(t, new(MetricsAgentSuite))
 }
+
+func TestRetryAfter(t *testing.T) {
+	limited, err := status.New(codes.ResourceExhausted, "too many requests").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(3 * time.Second)})
+	require.NoError(t, err)
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{name: "Test #1: no error"},
+		{name: "Test #2: other error", err: errors.New("connection refused")},
+		{name: "Test #3: other status", err: &agentutils.StatusError{Code: http.StatusInternalServerError}},
+		{name: "Test #4: 429 with Retry-After", err: &agentutils.StatusError{Code: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}, want: 5 * time.Second},
+		{name: "Test #5: 429 without Retry-After", err: &agentutils.StatusError{Code: http.StatusTooManyRequests}, want: time.Second},
+		{name: "Test #6: ResourceExhausted with RetryInfo", err: limited.Err(), want: 3 * time.Second},
+		{name: "Test #7: ResourceExhausted without RetryInfo", err: status.Error(codes.ResourceExhausted, "quota"), want: time.Second},
+		{name: "Test #8: other grpc code", err: status.Error(codes.Unavailable, "down")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, retryAfter(tt.err))
+		})
+	}
+}
+
+func TestSendJSONMetricsRateLimited(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		rw.Header().Set("Retry-After", "3")
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	cfg := &agentutils.AgentConfig{ServerAddress: strings.TrimPrefix(srv.URL, "http://")}
+	repo := NewRepo()
+	repo.Store([]metrics.Metrics{gauge("Alloc", 1), gauge("Frees", 2), gauge("Lookups", 3)})
+
+	err := SendJSONMetrics(cfg, repo, srv.Client())
+	assert.Equal(t, 3*time.Second, retryAfter(err))
+	assert.Equal(t, 1, requests, "sending stops after the first limited request")
+	repo.mu.Lock()
+	assert.Len(t, repo.batch(cfg), 3, "unsent metrics are kept for the next report")
+	repo.mu.Unlock()
+}
+
+func TestSendListJSONMetricsRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		wantRetry bool
+	}{
+		{
+			name:      "Test #1: server error",
+			code:      http.StatusInternalServerError,
+			wantRetry: true,
+		},
+		{
+			name:      "Test #2: rejected batch",
+			code:      http.StatusBadRequest,
+			wantRetry: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				http.Error(rw, "failed", tt.code)
+			}))
+			defer srv.Close()
+			cfg := &agentutils.AgentConfig{ServerAddress: strings.TrimPrefix(srv.URL, "http://")}
+			repo := NewRepo()
+			repo.Store([]metrics.Metrics{gauge("Alloc", 1)})
+
+			assert.Error(t, SendListJSONMetrics(cfg, repo, srv.Client()))
+			repo.mu.Lock()
+			_, retry := repo.retry["Alloc"]
+			repo.mu.Unlock()
+			assert.Equal(t, tt.wantRetry, retry)
+		})
+	}
+}
+
+func TestSendListJSONMetricsEncrypted(t *testing.T) {
+	pk, err := rsa.GenerateKey(rnd.Reader, 2048)
+	require.NoError(t, err)
+	serverCfg := &serverutils.ServerConfig{Key: "test", PrivateKey: pk, StoreInterval: time.Minute}
+	serverRepo, err := filerepo.NewMetricRepo(serverCfg)
+	require.NoError(t, err)
+	h := handlers.New(context.Background(), serverRepo, serverCfg)
+	srv := httptest.NewServer(middleware.RSAHandler(serverCfg)(middleware.BodySign(serverCfg)(http.HandlerFunc(h.SaveJSONArrayHandler))))
+	defer srv.Close()
+	cfg := &agentutils.AgentConfig{ServerAddress: strings.TrimPrefix(srv.URL, "http://"), Key: "test", SignBatch: true, PublicKey: &pk.PublicKey}
+	repo := NewRepo()
+	var list []metrics.Metrics
+	for _, name := range []string{"Alloc", "BuckHashSys", "Frees", "GCSys", "HeapAlloc", "HeapIdle", "HeapInuse", "Lookups"} {
+		list = append(list, gauge(name, 1))
+	}
+	repo.Store(list)
+
+	require.NoError(t, SendListJSONMetrics(cfg, repo, srv.Client()))
+	assert.Len(t, serverRepo.DB, len(list), "batch larger than one RSA block is decrypted by the server")
+}
@@ -0,0 +1,233 @@
+package metricsagent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+)
+
+// healthFactor - во сколько раз интервал воркера может быть превышен без успешного выполнения, прежде чем воркер считается неработающим.
+const healthFactor = 3
+
+// Имена воркеров агента в статусе.
+const (
+	WorkerSend = "send" // Отправка метрик на сервер
+)
+
+// Stats - состояние воркеров агента. Заполняется воркерами сбора и отправки, отдается локальным сервером статуса.
+var Stats = NewAgentStats()
+
+// workerState - время последнего успешного выполнения и последняя ошибка воркера.
+type workerState struct {
+	interval    time.Duration
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// AgentStats - потокобезопасное состояние воркеров агента: длительность и результат каждого выполнения.
+type AgentStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	registry *selfmetrics.Registry
+	workers  map[string]*workerState
+	pending  int
+}
+
+// NewAgentStats - создает пустое состояние воркеров.
+func NewAgentStats() *AgentStats {
+	return &AgentStats{
+		started:  time.Now(),
+		registry: selfmetrics.NewRegistry(),
+		workers:  make(map[string]*workerState),
+	}
+}
+
+// Register - регистрирует воркер с ожидаемым интервалом выполнения.
+func (s *AgentStats) Register(name string, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.worker(name).interval = interval
+}
+
+// Observe - учитывает выполнение воркера длительностью d.
+func (s *AgentStats) Observe(name string, d time.Duration, err error) {
+	s.registry.Observe(name, d, err != nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.worker(name)
+	if err != nil {
+		w.lastError = err.Error()
+		w.lastErrorAt = time.Now()
+		return
+	}
+	w.lastSuccess = time.Now()
+}
+
+// SetPending - запоминает количество пакетов, отправленных в поток и еще не подтвержденных сервером.
+func (s *AgentStats) SetPending(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = n
+}
+
+// worker - возвращает состояние воркера, создавая его при необходимости. Вызывается под блокировкой.
+func (s *AgentStats) worker(name string) *workerState {
+	w, ok := s.workers[name]
+	if !ok {
+		w = &workerState{}
+		s.workers[name] = w
+	}
+	return w
+}
+
+// WorkerStatus - состояние воркера в ответе сервера статуса.
+type WorkerStatus struct {
+	Interval    string     `json:"interval"`
+	Healthy     bool       `json:"healthy"`
+	Count       int64      `json:"count"`
+	Errors      int64      `json:"errors"`
+	AvgMs       float64    `json:"avg_ms"`
+	MaxMs       float64    `json:"max_ms"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// QueueStatus - метрики, ожидающие отправки.
+type QueueStatus struct {
+	Metrics        int `json:"metrics"`         // Собранные метрики
+	Retry          int `json:"retry"`           // Метрики для повторной отправки
+	PendingBatches int `json:"pending_batches"` // Неподтвержденные пакеты в потоке gRPC
+}
+
+// ConfigStatus - текущая конфигурация агента без секретов.
+type ConfigStatus struct {
+	ServerAddress     string `json:"address"`
+	ServerAddressGRPC string `json:"address_grpc,omitempty"`
+	PollInterval      string `json:"poll_interval"`
+	ReportInterval    string `json:"report_interval"`
+	SignBatch         bool   `json:"sign_batch"`
+	StreamWindow      int    `json:"stream_window"`
+	KeySet            bool   `json:"key_set"`
+	Encryption        bool   `json:"encryption"`
+	RuntimeMetrics    int    `json:"runtime_metrics"`
+}
+
+// AgentStatus - ответ сервера статуса агента.
+type AgentStatus struct {
+	Healthy       bool                    `json:"healthy"`
+	UptimeSeconds float64                 `json:"uptime_seconds"`
+	LastReport    *time.Time              `json:"last_report,omitempty"`
+	Workers       map[string]WorkerStatus `json:"workers"`
+	Queue         QueueStatus             `json:"queue"`
+	Config        ConfigStatus            `json:"config"`
+}
+
+// Status - формирует состояние агента на момент now.
+//
+// Воркер считается работающим, если с момента последнего успешного выполнения (или запуска агента) прошло не больше healthFactor интервалов.
+func (s *AgentStats) Status(now time.Time, cfg *agentutils.AgentConfig, repo *MetricRepo) AgentStatus {
+	calls := s.registry.Snapshot().Calls
+	s.mu.Lock()
+	result := AgentStatus{
+		Healthy:       true,
+		UptimeSeconds: now.Sub(s.started).Seconds(),
+		Workers:       make(map[string]WorkerStatus, len(s.workers)),
+		Queue:         QueueStatus{PendingBatches: s.pending},
+	}
+	for name, w := range s.workers {
+		since := s.started
+		stat := calls[name]
+		status := WorkerStatus{
+			Interval:  w.interval.String(),
+			Count:     stat.Count,
+			Errors:    stat.Errors,
+			AvgMs:     float64(stat.Avg()) / float64(time.Millisecond),
+			MaxMs:     float64(stat.Max) / float64(time.Millisecond),
+			LastError: w.lastError,
+		}
+		if !w.lastSuccess.IsZero() {
+			lastSuccess := w.lastSuccess
+			status.LastSuccess = &lastSuccess
+			since = lastSuccess
+		}
+		if !w.lastErrorAt.IsZero() {
+			lastErrorAt := w.lastErrorAt
+			status.LastErrorAt = &lastErrorAt
+		}
+		status.Healthy = w.interval <= 0 || now.Sub(since) <= healthFactor*w.interval
+		result.Healthy = result.Healthy && status.Healthy
+		result.Workers[name] = status
+	}
+	if send, ok := result.Workers[WorkerSend]; ok {
+		result.LastReport = send.LastSuccess
+	}
+	s.mu.Unlock()
+	repo.mu.Lock()
+	result.Queue.Metrics = len(repo.db) + len(repo.deltas)
+	result.Queue.Retry = len(repo.retry)
+	repo.mu.Unlock()
+	result.Config = ConfigStatus{
+		ServerAddress:     cfg.ServerAddress,
+		ServerAddressGRPC: cfg.ServerAddressGRPC,
+		PollInterval:      cfg.PollInterval.String(),
+		ReportInterval:    cfg.ReportInterval.String(),
+		SignBatch:         cfg.SignBatch,
+		StreamWindow:      cfg.StreamWindow,
+		KeySet:            cfg.Key != "",
+		Encryption:        cfg.PublicKey != nil,
+		RuntimeMetrics:    len(cfg.Metrics),
+	}
+	return result
+}
+
+// StatusHandler - отдает состояние агента.
+//
+// GET [/status] - состояние в формате JSON, GET [/healthz] - 200, если все воркеры работают, иначе 503.
+func StatusHandler(cfg *agentutils.AgentConfig, repo *MetricRepo) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		js, err := json.Marshal(Stats.Status(time.Now(), cfg, repo))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(js)
+	})
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		if !Stats.Status(time.Now(), cfg, repo).Healthy {
+			http.Error(rw, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte("ok"))
+	})
+	return mux
+}
+
+// StatusWorker - воркер локального сервера статуса агента на адресе cfg.StatusAddress. Останавливает сервер при завершении работы агента.
+func StatusWorker(ctx context.Context, wg *sync.WaitGroup, cfg *agentutils.AgentConfig, repo *MetricRepo) {
+	defer wg.Done()
+	srv := &http.Server{
+		Addr:    cfg.StatusAddress,
+		Handler: StatusHandler(cfg, repo),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("failed start status server")
+		return
+	}
+	log.Info().Msg("stopped status server")
+}
@@ -0,0 +1,65 @@
+package metricsagent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentStatsStatus(t *testing.T) {
+	cfg := &agentutils.AgentConfig{ServerAddress: "127.0.0.1:8080", Key: "secret", PollInterval: time.Second, ReportInterval: 10 * time.Second}
+	repo := NewRepo()
+	value := 7.77
+	repo.db["Alloc"] = metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+	stats := NewAgentStats()
+	stats.Register(WorkerCollectPrefix+"runtime", time.Second)
+	stats.Register(WorkerSend, 10*time.Second)
+	stats.Observe(WorkerCollectPrefix+"runtime", time.Millisecond, nil)
+	stats.Observe(WorkerSend, time.Millisecond, errors.New("connection refused"))
+	stats.SetPending(2)
+
+	status := stats.Status(time.Now(), cfg, repo)
+	assert.True(t, status.Healthy)
+	assert.Nil(t, status.LastReport)
+	assert.Equal(t, int64(1), status.Workers[WorkerSend].Errors)
+	assert.Equal(t, "connection refused", status.Workers[WorkerSend].LastError)
+	assert.Equal(t, QueueStatus{Metrics: 1, PendingBatches: 2}, status.Queue)
+	assert.True(t, status.Config.KeySet)
+
+	status = stats.Status(time.Now().Add(5*time.Second), cfg, repo)
+	assert.False(t, status.Healthy)
+	assert.False(t, status.Workers[WorkerCollectPrefix+"runtime"].Healthy)
+	assert.True(t, status.Workers[WorkerSend].Healthy)
+
+	stats.Observe(WorkerSend, time.Millisecond, nil)
+	status = stats.Status(time.Now(), cfg, repo)
+	require.NotNil(t, status.LastReport)
+}
+
+func TestStatusHandler(t *testing.T) {
+	cfg := &agentutils.AgentConfig{Key: "secret"}
+	srv := httptest.NewServer(StatusHandler(cfg, NewRepo()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var body map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Contains(t, body, "workers")
+	assert.NotContains(t, string(body["config"]), "secret")
+
+	health, err := http.Get(srv.URL + "/healthz")
+	require.NoError(t, err)
+	health.Body.Close()
+	assert.Equal(t, http.StatusOK, health.StatusCode)
+}
@@ -0,0 +1,248 @@
+package metricsagent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	cgrpc "github.com/colzphml/yandex_project/internal/scenarios/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// pendingBatch - отправленный в поток пакет, для которого еще не получено подтверждение.
+type pendingBatch struct {
+	list []metrics.Metrics
+	sent time.Time
+}
+
+// StreamSender - отправляет пакеты метрик в один долгоживущий поток StreamSave.
+//
+// Количество неподтвержденных пакетов ограничено окном cfg.StreamWindow: пока окно заполнено, новые пакеты не отправляются, а метрики остаются в хранилище до следующего отчета.
+type StreamSender struct {
+	cfg     *agentutils.AgentConfig
+	repo    *MetricRepo
+	client  pb.MetricsClient
+	mu      sync.Mutex
+	stream  pb.Metrics_StreamSaveClient
+	cancel  context.CancelFunc
+	pending map[uint64]pendingBatch
+	nextID  uint64
+	// время, до которого поток не переоткрывается после отказа сервера из-за ограничения частоты запросов
+	notBefore time.Time
+}
+
+// NewStreamSender - создает отправителя пакетов через поток StreamSave. Поток открывается при первой отправке.
+func NewStreamSender(cfg *agentutils.AgentConfig, repo *MetricRepo, client pb.MetricsClient) *StreamSender {
+	return &StreamSender{
+		cfg:     cfg,
+		repo:    repo,
+		client:  client,
+		pending: make(map[uint64]pendingBatch),
+	}
+}
+
+// Send - отправляет собранные метрики очередным пакетом в поток.
+//
+// Под блокировкой пакет только берется из хранилища и регистрируется как неподтвержденный: запись в поток может ждать, пока сервер не получит место в окне HTTP/2, а для этого receive должен продолжать разбирать подтверждения. Send и Close вызываются из одной горутины.
+func (s *StreamSender) Send(ctx context.Context) {
+	stream, req, ok := s.prepare(ctx)
+	if !ok {
+		return
+	}
+	if err := stream.Send(req); err != nil {
+		log.Error().Err(err).Msg("failed send via grpc stream")
+		Stats.Observe(WorkerSend, 0, err)
+		s.mu.Lock()
+		// если поток уже закрыт в receive, пакет возвращен в хранилище там
+		s.reset(stream)
+		s.mu.Unlock()
+	}
+}
+
+// prepare - открывает поток при необходимости, берет пакет из хранилища и регистрирует его как неподтвержденный. Возвращает false, если отправка пропускается.
+func (s *StreamSender) prepare(ctx context.Context) (pb.Metrics_StreamSaveClient, *pb.SaveListMetricsRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.window() {
+		if s.oldestPending() < s.ackTimeout() {
+			log.Warn().Int("pending", len(s.pending)).Msg("too many unacknowledged batches, report skipped")
+			return nil, nil, false
+		}
+		log.Warn().Msg("batches are not acknowledged for too long, reopen stream")
+		s.reset(s.stream)
+	}
+	if s.stream == nil {
+		if wait := time.Until(s.notBefore); wait > 0 {
+			log.Warn().Dur("retry_after", wait).Msg("server rate limit, report skipped")
+			return nil, nil, false
+		}
+		if err := s.open(ctx); err != nil {
+			log.Error().Err(err).Msg("failed open grpc stream")
+			Stats.Observe(WorkerSend, 0, err)
+			return nil, nil, false
+		}
+	}
+	s.repo.mu.Lock()
+	list := s.repo.batch(s.cfg)
+	s.repo.mu.Unlock()
+	s.nextID++
+	req, err := s.request(s.nextID, list)
+	if err != nil {
+		log.Error().Err(err).Msg("failed prepare grpc batch")
+		Stats.Observe(WorkerSend, 0, err)
+		s.repo.mu.Lock()
+		s.repo.requeue(list)
+		s.repo.mu.Unlock()
+		return nil, nil, false
+	}
+	s.pending[s.nextID] = pendingBatch{list: list, sent: time.Now()}
+	Stats.SetPending(len(s.pending))
+	return s.stream, req, true
+}
+
+// Close - закрывает поток. Неподтвержденные пакеты возвращаются в хранилище.
+func (s *StreamSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream != nil {
+		s.stream.CloseSend()
+	}
+	s.reset(s.stream)
+}
+
+// request - формирует запрос с пакетом метрик и, если требуется, подписывает его целиком и шифрует.
+func (s *StreamSender) request(id uint64, list []metrics.Metrics) (*pb.SaveListMetricsRequest, error) {
+	req := &pb.SaveListMetricsRequest{BatchId: id}
+	for _, v := range list {
+		req.Metric = append(req.Metric, cgrpc.ConvertMetrictoGRPC(v))
+	}
+	if s.cfg.SignBatch && s.cfg.Key != "" {
+		body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		req.Hash = signBody(s.cfg, body)
+	}
+	return encryptRequest(s.cfg, req)
+}
+
+// open - открывает поток и запускает чтение подтверждений. Вызывается под блокировкой.
+func (s *StreamSender) open(ctx context.Context) error {
+	md := metadata.New(map[string]string{"X-Real-IP": agentutils.GetLocalIP()})
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	stream, err := s.client.StreamSave(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s.stream = stream
+	s.cancel = cancel
+	go s.receive(stream)
+	return nil
+}
+
+// receive - читает подтверждения пакетов из потока до его закрытия.
+func (s *StreamSender) receive(stream pb.Metrics_StreamSaveClient) {
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Error().Err(err).Msg("grpc stream closed")
+			}
+			s.mu.Lock()
+			if wait := retryAfter(err); wait > 0 {
+				s.notBefore = time.Now().Add(wait)
+			}
+			if status.Code(err) == codes.InvalidArgument && s.stream == stream {
+				// сервер не смог расшифровать или разобрать пакет: его повторная отправка закончится так же
+				log.Error().Int("batches", len(s.pending)).Msg("unacknowledged batches rejected by server, dropped")
+				for id := range s.pending {
+					delete(s.pending, id)
+				}
+			}
+			s.reset(stream)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		batch, ok := s.pending[resp.BatchId]
+		delete(s.pending, resp.BatchId)
+		Stats.SetPending(len(s.pending))
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if resp.Error != "" {
+			Stats.Observe(WorkerSend, time.Since(batch.sent), errors.New(resp.Error))
+			if !retryableBatch(resp.Code) {
+				// повторная отправка того же пакета снова будет отклонена (например, неверная подпись)
+				log.Error().Str("error", resp.Error).Str("code", resp.Code).Uint64("batch", resp.BatchId).Int("metrics", len(batch.list)).Msg("batch rejected by server, dropped")
+				continue
+			}
+			log.Error().Str("error", resp.Error).Uint64("batch", resp.BatchId).Msg("batch not saved by server, will retry")
+			s.repo.mu.Lock()
+			s.repo.requeue(batch.list)
+			s.repo.mu.Unlock()
+			continue
+		}
+		Stats.Observe(WorkerSend, time.Since(batch.sent), nil)
+		s.repo.mu.Lock()
+		s.repo.handleBatchResult(batch.list, cgrpc.ConvertGRPCtoBatchResult(resp))
+		s.repo.mu.Unlock()
+	}
+}
+
+// reset - закрывает поток stream, если он текущий, и возвращает неподтвержденные пакеты в хранилище. Вызывается под блокировкой.
+func (s *StreamSender) reset(stream pb.Metrics_StreamSaveClient) {
+	if stream == nil || s.stream != stream {
+		return
+	}
+	s.cancel()
+	s.stream = nil
+	s.cancel = nil
+	s.repo.mu.Lock()
+	for id, batch := range s.pending {
+		s.repo.requeue(batch.list)
+		delete(s.pending, id)
+	}
+	s.repo.mu.Unlock()
+	Stats.SetPending(0)
+}
+
+// retryableBatch - проверяет по коду ошибки пакета, что пакет не сохранен из-за внутренней ошибки сервера и его можно отправить повторно. Пустой код (сервер без кодов ошибок) тоже считается внутренней ошибкой.
+func retryableBatch(code string) bool {
+	return code == "" || code == string(scenarios.CodeInternal)
+}
+
+// window - максимальное количество неподтвержденных пакетов.
+func (s *StreamSender) window() int {
+	if s.cfg.StreamWindow <= 0 {
+		return 1
+	}
+	return s.cfg.StreamWindow
+}
+
+// ackTimeout - время ожидания подтверждения, после которого поток считается зависшим.
+func (s *StreamSender) ackTimeout() time.Duration {
+	return 3 * s.cfg.ReportInterval
+}
+
+// oldestPending - время ожидания подтверждения самого старого неподтвержденного пакета.
+func (s *StreamSender) oldestPending() time.Duration {
+	var oldest time.Duration
+	for _, v := range s.pending {
+		if since := time.Since(v.sent); since > oldest {
+			oldest = since
+		}
+	}
+	return oldest
+}
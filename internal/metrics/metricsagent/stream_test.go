@@ -0,0 +1,175 @@
+package metricsagent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/middleware"
+	cgrpc "github.com/colzphml/yandex_project/internal/scenarios/grpc"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestStreamSender(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherPk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tests := []struct {
+		name       string
+		serverKey  string
+		privateKey *rsa.PrivateKey
+		cfg        agentutils.AgentConfig
+		wantSaved  bool
+		wantRetry  bool
+	}{
+		{
+			name:      "Test #1: metrics signed one by one",
+			serverKey: "test",
+			cfg:       agentutils.AgentConfig{Key: "test", StreamWindow: 2, ReportInterval: time.Second},
+			wantSaved: true,
+		},
+		{
+			name:      "Test #2: batch signed whole",
+			serverKey: "test",
+			cfg:       agentutils.AgentConfig{Key: "test", SignBatch: true, StreamWindow: 2, ReportInterval: time.Second},
+			wantSaved: true,
+		},
+		{
+			name:      "Test #3: wrong key",
+			serverKey: "test",
+			cfg:       agentutils.AgentConfig{Key: "another", SignBatch: true, StreamWindow: 2, ReportInterval: time.Second},
+			wantSaved: false,
+		},
+		{
+			name:       "Test #4: encrypted batch",
+			serverKey:  "test",
+			privateKey: pk,
+			cfg:        agentutils.AgentConfig{Key: "test", SignBatch: true, PublicKey: &pk.PublicKey, StreamWindow: 2, ReportInterval: time.Second},
+			wantSaved:  true,
+		},
+		{
+			name:       "Test #5: batch encrypted with another key",
+			serverKey:  "test",
+			privateKey: pk,
+			cfg:        agentutils.AgentConfig{Key: "test", SignBatch: true, PublicKey: &otherPk.PublicKey, StreamWindow: 2, ReportInterval: time.Second},
+			wantSaved:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCfg := &serverutils.ServerConfig{Key: tt.serverKey, PrivateKey: tt.privateKey, StoreInterval: time.Minute}
+			serverRepo, err := filerepo.NewMetricRepo(serverCfg)
+			require.NoError(t, err)
+			listener := bufconn.Listen(1024 * 1024)
+			srv := grpc.NewServer(middleware.GRPCServerOptions(serverCfg)...)
+			pb.RegisterMetricsServer(srv, &cgrpc.MetricsServer{Cfg: serverCfg, Repo: serverRepo})
+			go srv.Serve(listener)
+			defer srv.Stop()
+			conn, err := grpc.Dial("bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			repo := NewRepo()
+			value := 7.77
+			repo.db["Alloc"] = metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+			sender := NewStreamSender(&tt.cfg, repo, pb.NewMetricsClient(conn))
+			sender.Send(context.Background())
+			assert.Eventually(t, func() bool {
+				sender.mu.Lock()
+				defer sender.mu.Unlock()
+				return len(sender.pending) == 0
+			}, time.Second, 10*time.Millisecond)
+			sender.Close()
+
+			_, ok := serverRepo.DB["Alloc"]
+			assert.Equal(t, tt.wantSaved, ok)
+			repo.mu.Lock()
+			_, retry := repo.retry["Alloc"]
+			repo.mu.Unlock()
+			assert.Equal(t, tt.wantRetry, retry, "rejected batch is not resent")
+		})
+	}
+}
+
+// blockedStream - поток, запись в который ждет, пока сервер не освободит окно.
+type blockedStream struct {
+	pb.Metrics_StreamSaveClient
+	ctx     context.Context
+	release chan struct{}
+}
+
+func (s *blockedStream) Send(req *pb.SaveListMetricsRequest) error {
+	select {
+	case <-s.release:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *blockedStream) Recv() (*pb.SaveListMetricsResponse, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func (s *blockedStream) CloseSend() error {
+	return nil
+}
+
+// blockedClient - клиент, открывающий blockedStream.
+type blockedClient struct {
+	pb.MetricsClient
+	release chan struct{}
+}
+
+func (c *blockedClient) StreamSave(ctx context.Context, opts ...grpc.CallOption) (pb.Metrics_StreamSaveClient, error) {
+	return &blockedStream{ctx: ctx, release: c.release}, nil
+}
+
+func TestStreamSenderSendUnlocked(t *testing.T) {
+	client := &blockedClient{release: make(chan struct{})}
+	repo := NewRepo()
+	value := 7.77
+	repo.db["Alloc"] = metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+	sender := NewStreamSender(&agentutils.AgentConfig{StreamWindow: 2, ReportInterval: time.Second}, repo, client)
+	done := make(chan struct{})
+	go func() {
+		sender.Send(context.Background())
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		if !sender.mu.TryLock() {
+			return false
+		}
+		defer sender.mu.Unlock()
+		return len(sender.pending) == 1
+	}, time.Second, 10*time.Millisecond, "batch is registered and the lock is free while the write waits")
+
+	// поток закрыт в receive, пока запись ждет: пакет возвращается в хранилище один раз
+	sender.mu.Lock()
+	sender.reset(sender.stream)
+	sender.mu.Unlock()
+	<-done
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Contains(t, repo.retry, "Alloc")
+	assert.Empty(t, sender.pending)
+}
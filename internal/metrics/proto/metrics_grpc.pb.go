@@ -24,9 +24,12 @@ const _ = grpc.SupportPackageIsVersion7
 type MetricsClient interface {
 	Save(ctx context.Context, in *SaveMetricRequest, opts ...grpc.CallOption) (*SaveMetricResponse, error)
 	SaveList(ctx context.Context, in *SaveListMetricsRequest, opts ...grpc.CallOption) (*SaveListMetricsResponse, error)
+	StreamSave(ctx context.Context, opts ...grpc.CallOption) (Metrics_StreamSaveClient, error)
 	Get(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error)
+	GetMany(ctx context.Context, in *GetManyRequest, opts ...grpc.CallOption) (*GetManyResponse, error)
 	GetList(ctx context.Context, in *GetListMetricRequest, opts ...grpc.CallOption) (*GetListMetricResponse, error)
 	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Metrics_WatchClient, error)
 }
 
 type metricsClient struct {
@@ -55,6 +58,37 @@ func (c *metricsClient) SaveList(ctx context.Context, in *SaveListMetricsRequest
 	return out, nil
 }
 
+func (c *metricsClient) StreamSave(ctx context.Context, opts ...grpc.CallOption) (Metrics_StreamSaveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Metrics_ServiceDesc.Streams[0], "/metrics.Metrics/StreamSave", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsStreamSaveClient{stream}
+	return x, nil
+}
+
+type Metrics_StreamSaveClient interface {
+	Send(*SaveListMetricsRequest) error
+	Recv() (*SaveListMetricsResponse, error)
+	grpc.ClientStream
+}
+
+type metricsStreamSaveClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsStreamSaveClient) Send(m *SaveListMetricsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *metricsStreamSaveClient) Recv() (*SaveListMetricsResponse, error) {
+	m := new(SaveListMetricsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *metricsClient) Get(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error) {
 	out := new(GetMetricResponse)
 	err := c.cc.Invoke(ctx, "/metrics.Metrics/Get", in, out, opts...)
@@ -64,6 +98,15 @@ func (c *metricsClient) Get(ctx context.Context, in *GetMetricRequest, opts ...g
 	return out, nil
 }
 
+func (c *metricsClient) GetMany(ctx context.Context, in *GetManyRequest, opts ...grpc.CallOption) (*GetManyResponse, error) {
+	out := new(GetManyResponse)
+	err := c.cc.Invoke(ctx, "/metrics.Metrics/GetMany", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metricsClient) GetList(ctx context.Context, in *GetListMetricRequest, opts ...grpc.CallOption) (*GetListMetricResponse, error) {
 	out := new(GetListMetricResponse)
 	err := c.cc.Invoke(ctx, "/metrics.Metrics/GetList", in, out, opts...)
@@ -82,15 +125,50 @@ func (c *metricsClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.
 	return out, nil
 }
 
+func (c *metricsClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Metrics_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Metrics_ServiceDesc.Streams[1], "/metrics.Metrics/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Metrics_WatchClient interface {
+	Recv() (*Metric, error)
+	grpc.ClientStream
+}
+
+type metricsWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsWatchClient) Recv() (*Metric, error) {
+	m := new(Metric)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MetricsServer is the server API for Metrics service.
 // All implementations must embed UnimplementedMetricsServer
 // for forward compatibility
 type MetricsServer interface {
 	Save(context.Context, *SaveMetricRequest) (*SaveMetricResponse, error)
 	SaveList(context.Context, *SaveListMetricsRequest) (*SaveListMetricsResponse, error)
+	StreamSave(Metrics_StreamSaveServer) error
 	Get(context.Context, *GetMetricRequest) (*GetMetricResponse, error)
+	GetMany(context.Context, *GetManyRequest) (*GetManyResponse, error)
 	GetList(context.Context, *GetListMetricRequest) (*GetListMetricResponse, error)
 	Ping(context.Context, *PingRequest) (*PingResponse, error)
+	Watch(*WatchRequest, Metrics_WatchServer) error
 	mustEmbedUnimplementedMetricsServer()
 }
 
@@ -104,15 +182,24 @@ func (UnimplementedMetricsServer) Save(context.Context, *SaveMetricRequest) (*Sa
 func (UnimplementedMetricsServer) SaveList(context.Context, *SaveListMetricsRequest) (*SaveListMetricsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SaveList not implemented")
 }
+func (UnimplementedMetricsServer) StreamSave(Metrics_StreamSaveServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamSave not implemented")
+}
 func (UnimplementedMetricsServer) Get(context.Context, *GetMetricRequest) (*GetMetricResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
 }
+func (UnimplementedMetricsServer) GetMany(context.Context, *GetManyRequest) (*GetManyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMany not implemented")
+}
 func (UnimplementedMetricsServer) GetList(context.Context, *GetListMetricRequest) (*GetListMetricResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetList not implemented")
 }
 func (UnimplementedMetricsServer) Ping(context.Context, *PingRequest) (*PingResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
 }
+func (UnimplementedMetricsServer) Watch(*WatchRequest, Metrics_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
 func (UnimplementedMetricsServer) mustEmbedUnimplementedMetricsServer() {}
 
 // UnsafeMetricsServer may be embedded to opt out of forward compatibility for this service.
@@ -162,6 +249,32 @@ func _Metrics_SaveList_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Metrics_StreamSave_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MetricsServer).StreamSave(&metricsStreamSaveServer{stream})
+}
+
+type Metrics_StreamSaveServer interface {
+	Send(*SaveListMetricsResponse) error
+	Recv() (*SaveListMetricsRequest, error)
+	grpc.ServerStream
+}
+
+type metricsStreamSaveServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsStreamSaveServer) Send(m *SaveListMetricsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *metricsStreamSaveServer) Recv() (*SaveListMetricsRequest, error) {
+	m := new(SaveListMetricsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _Metrics_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetMetricRequest)
 	if err := dec(in); err != nil {
@@ -180,6 +293,24 @@ func _Metrics_Get_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Metrics_GetMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetManyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).GetMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/metrics.Metrics/GetMany",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).GetMany(ctx, req.(*GetManyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Metrics_GetList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetListMetricRequest)
 	if err := dec(in); err != nil {
@@ -216,6 +347,27 @@ func _Metrics_Ping_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Metrics_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsServer).Watch(m, &metricsWatchServer{stream})
+}
+
+type Metrics_WatchServer interface {
+	Send(*Metric) error
+	grpc.ServerStream
+}
+
+type metricsWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsWatchServer) Send(m *Metric) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Metrics_ServiceDesc is the grpc.ServiceDesc for Metrics service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -235,6 +387,10 @@ var Metrics_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Get",
 			Handler:    _Metrics_Get_Handler,
 		},
+		{
+			MethodName: "GetMany",
+			Handler:    _Metrics_GetMany_Handler,
+		},
 		{
 			MethodName: "GetList",
 			Handler:    _Metrics_GetList_Handler,
@@ -244,6 +400,18 @@ var Metrics_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _Metrics_Ping_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamSave",
+			Handler:       _Metrics_StreamSave_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Metrics_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "metrics.proto",
 }
@@ -0,0 +1,248 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+)
+
+// Действия правил обработки метрик.
+const (
+	RelabelDrop    = "drop"    // Отбросить метрики с подходящим именем
+	RelabelKeep    = "keep"    // Отбросить метрики с неподходящим именем
+	RelabelRename  = "rename"  // Заменить имя по шаблону Replacement (с группами $1, $2, ...)
+	RelabelPrefix  = "prefix"  // Добавить к имени Prefix
+	RelabelConvert = "convert" // Умножить значение на коэффициент единицы Unit или на Factor
+	RelabelType    = "type"    // Сменить тип на Type
+)
+
+// relabelUnits - коэффициенты перевода единиц для действия convert.
+var relabelUnits = map[string]float64{
+	"bytes_to_kib": 1.0 / (1 << 10),
+	"bytes_to_mib": 1.0 / (1 << 20),
+	"bytes_to_gib": 1.0 / (1 << 30),
+	"ns_to_us":     1e-3,
+	"ns_to_ms":     1e-6,
+	"ns_to_s":      1e-9,
+	"us_to_ms":     1e-3,
+	"us_to_s":      1e-6,
+	"ms_to_s":      1e-3,
+	"ratio_to_pct": 100,
+}
+
+// RelabelRule - правило обработки метрик.
+//
+// Regex проверяется по всему имени метрики. Для drop и keep Regex обязателен, для остальных действий пустой Regex означает, что правило применяется ко всем метрикам.
+type RelabelRule struct {
+	Action      string  `json:"action"`      // drop, keep, rename, prefix, convert или type
+	Regex       string  `json:"regex"`       // Регулярное выражение для имени метрики
+	Replacement string  `json:"replacement"` // Новое имя для rename
+	Prefix      string  `json:"prefix"`      // Префикс для prefix
+	Unit        string  `json:"unit"`        // Перевод единиц для convert, например bytes_to_mib
+	Factor      float64 `json:"factor"`      // Коэффициент для convert, если Unit не задан
+	Type        string  `json:"type"`        // Новый тип для type: gauge или counter
+	re          *regexp.Regexp
+	carry       *relabelCarry
+}
+
+// relabelCarry - дробные остатки приращений счетчиков после convert по именам метрик.
+//
+// Приращение счетчика после перевода единиц обычно дробное. Если округлять каждое приращение отдельно, сумма на сервере расходится с переведенной суммой исходных приращений (например, приращения по 1 КиБ в МиБ всегда округляются до 0). Поэтому отправляется целая часть, а остаток добавляется к следующему приращению той же метрики.
+type relabelCarry struct {
+	mu   sync.Mutex
+	rest map[string]float64
+}
+
+// relabelPending - изменение остатка метрики id, которое записывается в carry только после сохранения метрики.
+type relabelPending struct {
+	carry *relabelCarry
+	id    string
+	rest  float64
+}
+
+// take - возвращает целую часть суммы приращения и остатка метрики id. Остаток не меняется до commit.
+func (c *relabelCarry) take(id string, value float64) (int64, relabelPending) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	whole := math.Trunc(value + c.rest[id])
+	// в остаток добавляется неотправленная часть приращения: если между take и commit остаток изменился, сумма все равно сохраняется
+	return int64(whole), relabelPending{carry: c, id: id, rest: value - whole}
+}
+
+// commit - добавляет к остатку метрики неотправленную часть приращения.
+func (p relabelPending) commit() {
+	c := p.carry
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rest := c.rest[p.id] + p.rest; rest != 0 {
+		c.rest[p.id] = rest
+	} else {
+		delete(c.rest, p.id)
+	}
+}
+
+// compile - проверяет правило и компилирует регулярное выражение.
+func (r *RelabelRule) compile() error {
+	switch r.Action {
+	case RelabelDrop, RelabelKeep:
+		if r.Regex == "" {
+			return fmt.Errorf("relabel %s: regex required", r.Action)
+		}
+	case RelabelRename:
+		if r.Replacement == "" {
+			return fmt.Errorf("relabel %s: replacement required", r.Action)
+		}
+	case RelabelPrefix:
+		if r.Prefix == "" {
+			return fmt.Errorf("relabel %s: prefix required", r.Action)
+		}
+	case RelabelConvert:
+		if r.Unit != "" {
+			factor, ok := relabelUnits[r.Unit]
+			if !ok {
+				return fmt.Errorf("relabel %s: unknown unit %q", r.Action, r.Unit)
+			}
+			r.Factor = factor
+		}
+		if r.Factor == 0 {
+			return fmt.Errorf("relabel %s: unit or factor required", r.Action)
+		}
+		r.carry = &relabelCarry{rest: make(map[string]float64)}
+	case RelabelType:
+		if r.Type != "gauge" && r.Type != "counter" {
+			return fmt.Errorf("relabel %s: %w", r.Action, ErrUndefinedType)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", r.Action)
+	}
+	if r.Regex != "" {
+		re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("relabel %s: %w", r.Action, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// apply - применяет правило к метрике. Изменения остатков convert добавляются в pending. Возвращает false, если метрику нужно отбросить.
+func (r *RelabelRule) apply(m *Metrics, pending *[]relabelPending) bool {
+	matched := r.re == nil || r.re.MatchString(m.ID)
+	switch r.Action {
+	case RelabelDrop:
+		return !matched
+	case RelabelKeep:
+		return matched
+	}
+	if !matched {
+		return true
+	}
+	switch r.Action {
+	case RelabelRename:
+		if r.re == nil {
+			m.ID = r.Replacement
+			break
+		}
+		m.ID = r.re.ReplaceAllString(m.ID, r.Replacement)
+	case RelabelPrefix:
+		m.ID = r.Prefix + m.ID
+	case RelabelConvert:
+		switch {
+		case m.Value != nil:
+			value := *m.Value * r.Factor
+			m.Value = &value
+		case m.Delta != nil:
+			delta, rest := r.carry.take(m.ID, float64(*m.Delta)*r.Factor)
+			m.Delta = &delta
+			*pending = append(*pending, rest)
+		}
+	case RelabelType:
+		switch {
+		case r.Type == "counter" && m.Value != nil:
+			delta := int64(math.Round(*m.Value))
+			m.Delta, m.Value = &delta, nil
+		case r.Type == "gauge" && m.Delta != nil:
+			value := float64(*m.Delta)
+			m.Delta, m.Value = nil, &value
+		}
+		m.MType = r.Type
+	}
+	m.Hash = ""
+	return true
+}
+
+// Pipeline - упорядоченный набор правил обработки метрик: отбрасывание, переименование, перевод единиц и смена типа.
+//
+// Правила применяются по порядку, каждое следующее правило видит результат предыдущих. Пустой (nil) Pipeline не меняет метрики. Подпись измененной метрики сбрасывается.
+type Pipeline struct {
+	rules []RelabelRule
+}
+
+// NewPipeline - проверяет правила и создает из них Pipeline.
+func NewPipeline(rules []RelabelRule) (*Pipeline, error) {
+	p := &Pipeline{rules: make([]RelabelRule, len(rules))}
+	copy(p.rules, rules)
+	for i := range p.rules {
+		if err := p.rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Pipeline) UnmarshalJSON(data []byte) error {
+	var rules []RelabelRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	parsed, err := NewPipeline(rules)
+	if err != nil {
+		return err
+	}
+	*p = *parsed
+	return nil
+}
+
+// Process - применяет правила к метрике. Возвращает false, если метрику нужно отбросить.
+func (p *Pipeline) Process(m Metrics) (Metrics, bool) {
+	m, keep, commit := p.Prepare(m)
+	commit()
+	return m, keep
+}
+
+// Prepare - применяет правила к метрике, как Process, но остатки приращений convert запоминаются только при вызове commit.
+//
+// Сервер вызывает commit после сохранения метрики, чтобы приращение метрики, отклоненной квотой или хранилищем, не переносилось в следующее.
+func (p *Pipeline) Prepare(m Metrics) (result Metrics, keep bool, commit func()) {
+	var pending []relabelPending
+	commit = func() {
+		for _, v := range pending {
+			v.commit()
+		}
+	}
+	if p == nil {
+		return m, true, commit
+	}
+	for i := range p.rules {
+		if !p.rules[i].apply(&m, &pending) {
+			return m, false, commit
+		}
+	}
+	return m, true, commit
+}
+
+// Apply - применяет правила к списку метрик и возвращает оставшиеся метрики.
+func (p *Pipeline) Apply(list []Metrics) []Metrics {
+	if p == nil {
+		return list
+	}
+	result := make([]Metrics, 0, len(list))
+	for _, v := range list {
+		if m, ok := p.Process(v); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
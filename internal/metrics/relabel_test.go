@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "Test #1: correct rules", data: `[{"action":"drop","regex":"Heap.*"},{"action":"convert","unit":"bytes_to_mib"}]`},
+		{name: "Test #2: unknown action", data: `[{"action":"another"}]`, wantErr: true},
+		{name: "Test #3: drop without regex", data: `[{"action":"drop"}]`, wantErr: true},
+		{name: "Test #4: bad regex", data: `[{"action":"keep","regex":"("}]`, wantErr: true},
+		{name: "Test #5: unknown unit", data: `[{"action":"convert","unit":"bytes_to_pib"}]`, wantErr: true},
+		{name: "Test #6: wrong type", data: `[{"action":"type","type":"another"}]`, wantErr: true},
+		{name: "Test #7: not array", data: `{"action":"drop"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p *Pipeline
+			err := json.Unmarshal([]byte(tt.data), &p)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, p)
+		})
+	}
+}
+
+func TestPipeline_Apply(t *testing.T) {
+	p, err := NewPipeline([]RelabelRule{
+		{Action: RelabelDrop, Regex: "Random.*"},
+		{Action: RelabelKeep, Regex: "Alloc|PollCount|Mem_.*|Load1"},
+		{Action: RelabelRename, Regex: "Mem_(.*)", Replacement: "Memory.$1"},
+		{Action: RelabelConvert, Regex: "Alloc|Memory\\..*", Unit: "bytes_to_mib"},
+		{Action: RelabelType, Regex: "PollCount", Type: "gauge"},
+		{Action: RelabelPrefix, Prefix: "host1."},
+	})
+	require.NoError(t, err)
+	alloc, mem, load, random := 3.0*(1<<20), float64(1<<30), 0.5, 0.1
+	poll := int64(5)
+	list := []Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &alloc, Hash: "old"},
+		{ID: "Mem_Total", MType: "gauge", Value: &mem},
+		{ID: "PollCount", MType: "counter", Delta: &poll},
+		{ID: "Load1", MType: "gauge", Value: &load},
+		{ID: "Load5", MType: "gauge", Value: &load},
+		{ID: "RandomValue", MType: "gauge", Value: &random},
+	}
+	got := p.Apply(list)
+	require.Len(t, got, 4)
+	assert.Equal(t, "host1.Alloc", got[0].ID)
+	assert.Equal(t, 3.0, *got[0].Value)
+	assert.Empty(t, got[0].Hash)
+	assert.Equal(t, "host1.Memory.Total", got[1].ID)
+	assert.Equal(t, 1024.0, *got[1].Value)
+	assert.Equal(t, Metrics{ID: "host1.PollCount", MType: "gauge", Value: got[2].Value}, got[2])
+	assert.Equal(t, 5.0, *got[2].Value)
+	assert.Equal(t, "host1.Load1", got[3].ID)
+	assert.Equal(t, 0.5, *got[3].Value)
+	// исходные метрики не меняются
+	assert.Equal(t, 3.0*(1<<20), alloc)
+	assert.Equal(t, "Alloc", list[0].ID)
+
+	var empty *Pipeline
+	assert.Equal(t, list, empty.Apply(list))
+}
+
+func TestPipeline_ConvertCounter(t *testing.T) {
+	p, err := NewPipeline([]RelabelRule{{Action: RelabelConvert, Regex: "Bytes.*", Unit: "bytes_to_kib"}})
+	require.NoError(t, err)
+	var total int64
+	for i := 0; i < 8; i++ {
+		delta := int64(384)
+		got, ok := p.Process(Metrics{ID: "BytesSent", MType: "counter", Delta: &delta})
+		require.True(t, ok)
+		total += *got.Delta
+	}
+	assert.Equal(t, int64(3), total, "remainder of each delta is carried to the next one")
+
+	delta := int64(512)
+	got, _ := p.Process(Metrics{ID: "BytesReceived", MType: "counter", Delta: &delta})
+	assert.Equal(t, int64(0), *got.Delta, "remainders are kept per metric")
+}
+
+func TestPipeline_PrepareCommit(t *testing.T) {
+	p, err := NewPipeline([]RelabelRule{{Action: RelabelConvert, Regex: "Bytes.*", Unit: "bytes_to_kib"}})
+	require.NoError(t, err)
+	delta := int64(768)
+	_, _, commit := p.Prepare(Metrics{ID: "BytesSent", MType: "counter", Delta: &delta})
+	got, _, _ := p.Prepare(Metrics{ID: "BytesSent", MType: "counter", Delta: &delta})
+	assert.Equal(t, int64(0), *got.Delta, "remainder is not kept before commit")
+	commit()
+	got, _, _ = p.Prepare(Metrics{ID: "BytesSent", MType: "counter", Delta: &delta})
+	assert.Equal(t, int64(1), *got.Delta)
+
+	var empty *Pipeline
+	_, keep, commit := empty.Prepare(Metrics{ID: "BytesSent", MType: "counter", Delta: &delta})
+	assert.True(t, keep)
+	commit()
+}
@@ -0,0 +1,350 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var log = zerolog.New(serverutils.LogConfig()).With().Timestamp().Str("component", "grpc").Logger()
+
+// requestIDKey - ключ метаданных с идентификатором запроса, аналог заголовка X-Request-Id.
+const requestIDKey = "x-request-id"
+
+// encryptedMessage - сообщение, которое может быть передано в зашифрованном виде.
+type encryptedMessage interface {
+	proto.Message
+	GetEncrypted() []byte
+}
+
+// GRPCServerOptions - цепочки перехватчиков для unary и потоковых вызовов gRPC.
+//
+// Порядок соответствует middleware HTTP: идентификатор запроса, журнал, метрики, восстановление после паники, адрес клиента из соединения, проверка подсети, ограничение частоты запросов, расшифровка, проверка подписи.
+func GRPCServerOptions(cfg *serverutils.ServerConfig) []grpc.ServerOption {
+	limiter := NewRateLimiter(cfg.RateLimits)
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			RequestIDGRPCInterceptor,
+			LoggerGRPCInterceptor,
+			MetricsGRPCInterceptor,
+			RecoverGRPCInterceptor,
+			ClientIPGRPCInterceptor(cfg),
+			SubNetGRPCInterceptor(cfg),
+			RateLimitGRPCInterceptor(limiter),
+			RSAGRPCInterceptor(cfg),
+			SignGRPCInterceptor(cfg),
+		),
+		grpc.ChainStreamInterceptor(
+			RequestIDGRPCStreamInterceptor,
+			LoggerGRPCStreamInterceptor,
+			MetricsGRPCStreamInterceptor,
+			RecoverGRPCStreamInterceptor,
+			ClientIPGRPCStreamInterceptor(cfg),
+			SubNetGRPCStreamInterceptor(cfg),
+			RateLimitGRPCStreamInterceptor(limiter),
+			RSAGRPCStreamInterceptor(cfg),
+		),
+	}
+}
+
+// contextStream - поток с подмененным контекстом.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context - возвращает подмененный контекст.
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// decryptStream - поток, расшифровывающий входящие сообщения.
+type decryptStream struct {
+	grpc.ServerStream
+	cfg *serverutils.ServerConfig
+}
+
+// RecvMsg - читает сообщение из потока и расшифровывает его.
+func (s decryptStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return decrypt(s.cfg, m)
+}
+
+// metadataValue - возвращает первое значение ключа key из входящих метаданных.
+func metadataValue(ctx context.Context, key string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		values := md.Get(key)
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// requestID - берет идентификатор запроса из метаданных или генерирует новый и сохраняет его в контекст так же, как chi middleware.RequestID.
+func requestID(ctx context.Context) (context.Context, string) {
+	id := metadataValue(ctx, requestIDKey)
+	if id == "" {
+		id = fmt.Sprintf("grpc-%06d", chimiddleware.NextRequestID())
+	}
+	return context.WithValue(ctx, chimiddleware.RequestIDKey, id), id
+}
+
+// RequestIDGRPCInterceptor - передает идентификатор запроса в контекст и возвращает его клиенту в заголовке x-request-id.
+func RequestIDGRPCInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := requestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+	return handler(ctx, req)
+}
+
+// RequestIDGRPCStreamInterceptor - потоковый вариант RequestIDGRPCInterceptor.
+func RequestIDGRPCStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id := requestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(requestIDKey, id))
+	return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// logAccess - записывает в журнал результат вызова.
+func logAccess(ctx context.Context, method string, start time.Time, err error) {
+	event := log.Info()
+	if status.Code(err) == codes.Internal || status.Code(err) == codes.Unknown {
+		event = log.Error()
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	event.
+		Str("request_id", chimiddleware.GetReqID(ctx)).
+		Str("method", method).
+		Str("peer", addr).
+		Str("real_ip", metadataValue(ctx, "X-Real-IP")).
+		Str("code", status.Code(err).String()).
+		Dur("duration", time.Since(start)).
+		Err(err).
+		Msg("grpc call")
+}
+
+// LoggerGRPCInterceptor - журнал вызовов gRPC.
+func LoggerGRPCInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logAccess(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// LoggerGRPCStreamInterceptor - потоковый вариант LoggerGRPCInterceptor. Запись делается при завершении потока.
+func LoggerGRPCStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logAccess(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+// MetricsGRPCInterceptor - учитывает количество и длительность вызовов по методам в selfmetrics.Default.
+func MetricsGRPCInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	selfmetrics.Default.Observe("grpc "+info.FullMethod, time.Since(start), err != nil)
+	return resp, err
+}
+
+// MetricsGRPCStreamInterceptor - потоковый вариант MetricsGRPCInterceptor. Длительность считается до завершения потока.
+func MetricsGRPCStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	selfmetrics.Default.Observe("grpc "+info.FullMethod, time.Since(start), err != nil)
+	return err
+}
+
+// recovered - записывает в журнал панику и превращает ее в ошибку Internal.
+func recovered(ctx context.Context, method string, p interface{}) error {
+	log.Error().
+		Str("request_id", chimiddleware.GetReqID(ctx)).
+		Str("method", method).
+		Interface("panic", p).
+		Bytes("stack", debug.Stack()).
+		Msg("grpc handler panic")
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// RecoverGRPCInterceptor - восстанавливает работу после паники в обработчике и возвращает клиенту Internal.
+func RecoverGRPCInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resp, err = nil, recovered(ctx, info.FullMethod, p)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// RecoverGRPCStreamInterceptor - потоковый вариант RecoverGRPCInterceptor.
+func RecoverGRPCStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recovered(ss.Context(), info.FullMethod, p)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// grpcRouteGroup - группа маршрутов метода gRPC.
+func grpcRouteGroup(fullMethod string) string {
+	switch fullMethod[strings.LastIndex(fullMethod, "/")+1:] {
+	case "Save", "SaveList", "StreamSave":
+		return RouteGroupUpdate
+	case "Get", "GetMany", "GetList", "Watch":
+		return RouteGroupValue
+	default:
+		return RouteGroupRoot
+	}
+}
+
+// grpcClientContext - помечает контекст вызова адресом клиента (clientIP) по метаданным X-Real-IP и адресу соединения.
+func grpcClientContext(ctx context.Context, cfg *serverutils.ServerConfig) context.Context {
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	return scenarios.WithClient(ctx, clientIP(cfg, metadataValue(ctx, "X-Real-IP"), addr))
+}
+
+// ClientIPGRPCInterceptor - аналог ClientIP для unary вызовов gRPC.
+func ClientIPGRPCInterceptor(cfg *serverutils.ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(grpcClientContext(ctx, cfg), req)
+	}
+}
+
+// ClientIPGRPCStreamInterceptor - потоковый вариант ClientIPGRPCInterceptor.
+func ClientIPGRPCStreamInterceptor(cfg *serverutils.ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, contextStream{ServerStream: ss, ctx: grpcClientContext(ss.Context(), cfg)})
+	}
+}
+
+// checkSubNet - проверяет адрес клиента из ClientIPGRPCInterceptor по разрешенным и запрещенным подсетям группы метода.
+func checkSubNet(ctx context.Context, cfg *serverutils.ServerConfig, fullMethod string) error {
+	if !hasAccessRules(cfg) {
+		return nil
+	}
+	iptag := scenarios.Client(ctx)
+	if len(iptag) == 0 {
+		return status.Error(codes.Unauthenticated, "missing ip")
+	}
+	ip := parseIP(iptag)
+	if ip == nil {
+		return status.Error(codes.Unauthenticated, "missing ip")
+	}
+	if !allowedIP(cfg, grpcRouteGroup(fullMethod), ip) {
+		return status.Error(codes.Unauthenticated, "ip not in trusted")
+	}
+	return nil
+}
+
+// SubNetGRPCInterceptor - проверяет, что запрос пришел из доверенной подсети.
+func SubNetGRPCInterceptor(cfg *serverutils.ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkSubNet(ctx, cfg, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// SubNetGRPCStreamInterceptor - потоковый вариант SubNetGRPCInterceptor. Проверка делается при открытии потока.
+func SubNetGRPCStreamInterceptor(cfg *serverutils.ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSubNet(ss.Context(), cfg, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// decrypt - расшифровывает сообщение, если оно поддерживает шифрование.
+//
+// Если у сервера есть приватный ключ, такие сообщения принимаются только в зашифрованном виде - так же, как запросы HTTP через RSAHandler.
+func decrypt(cfg *serverutils.ServerConfig, m interface{}) error {
+	msg, ok := m.(encryptedMessage)
+	if !ok {
+		return nil
+	}
+	encrypted := msg.GetEncrypted()
+	switch {
+	case cfg.PrivateKey == nil && len(encrypted) == 0:
+		return nil
+	case cfg.PrivateKey == nil:
+		return status.Error(codes.InvalidArgument, "server has no private key for encrypted message")
+	case len(encrypted) == 0:
+		return status.Error(codes.InvalidArgument, "message must be encrypted")
+	}
+	body, err := serverutils.DecryptRSA(cfg.PrivateKey, encrypted)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "failed decrypt message")
+	}
+	if err := proto.Unmarshal(body, msg); err != nil {
+		return status.Error(codes.InvalidArgument, "failed parse decrypted message")
+	}
+	return nil
+}
+
+// RSAGRPCInterceptor - расшифровывает запрос приватным ключом сервера.
+func RSAGRPCInterceptor(cfg *serverutils.ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := decrypt(cfg, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// RSAGRPCStreamInterceptor - потоковый вариант RSAGRPCInterceptor: расшифровывается каждое входящее сообщение.
+func RSAGRPCStreamInterceptor(cfg *serverutils.ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, decryptStream{ServerStream: ss, cfg: cfg})
+	}
+}
+
+// SignGRPCInterceptor - проверяет подпись всего сообщения из метаданных HashSHA256.
+//
+// Подпись рассчитывается от детерминированно сериализованного сообщения. Если подпись не передана или ключ не задан - проверяются подписи отдельных метрик.
+func SignGRPCInterceptor(cfg *serverutils.ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if cfg.Key == "" {
+			return handler(ctx, req)
+		}
+		hash := metadataValue(ctx, metrics.HashHeader)
+		msg, ok := req.(proto.Message)
+		if hash == "" || !ok {
+			return handler(ctx, req)
+		}
+		body, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		equal, err := metrics.CompareBodyHash(body, cfg.Key, hash)
+		if err != nil || !equal {
+			selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+			return nil, status.Error(codes.InvalidArgument, "message signature is wrong")
+		}
+		return handler(scenarios.WithSignedBody(ctx), req)
+	}
+}
@@ -0,0 +1,312 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/agent/agentutils"
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// testStream - серверный поток для проверки потоковых перехватчиков.
+type testStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+	recv   []proto.Message
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	proto.Merge(m.(proto.Message), s.recv[0])
+	s.recv = s.recv[1:]
+	return nil
+}
+
+func TestRequestIDGRPCInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/Ping"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return chimiddleware.GetReqID(ctx), nil
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDKey, "test-id"))
+	id, err := RequestIDGRPCInterceptor(ctx, nil, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "test-id", id)
+	id, err = RequestIDGRPCInterceptor(context.Background(), nil, info, handler)
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	ss := &testStream{ctx: ctx}
+	err = RequestIDGRPCStreamInterceptor(nil, ss, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		assert.Equal(t, "test-id", chimiddleware.GetReqID(stream.Context()))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-id"}, ss.header.Get(requestIDKey))
+}
+
+func TestRecoverGRPCInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/Get"}
+	resp, err := RecoverGRPCInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("test")
+	})
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	ss := &testStream{ctx: context.Background()}
+	err = RecoverGRPCStreamInterceptor(nil, ss, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		panic("test")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestMetricsGRPCInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/Test"}
+	before := selfmetrics.Default.Snapshot().Calls["grpc /metrics.Metrics/Test"]
+	MetricsGRPCInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "test")
+	})
+	after := selfmetrics.Default.Snapshot().Calls["grpc /metrics.Metrics/Test"]
+	assert.Equal(t, before.Count+1, after.Count)
+	assert.Equal(t, before.Errors+1, after.Errors)
+}
+
+func TestSubNetGRPCStreamInterceptor(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	cfg := &serverutils.ServerConfig{TrustedSubnet: subnet}
+	tests := []struct {
+		name     string
+		realIP   string
+		wantCode codes.Code
+	}{
+		{
+			name:     "Test #1: trusted ip",
+			realIP:   "192.168.1.10",
+			wantCode: codes.OK,
+		},
+		{
+			name:     "Test #2: untrusted ip",
+			realIP:   "10.0.0.1",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "Test #3: without ip",
+			wantCode: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+			if tt.realIP != "" {
+				md.Set("X-Real-IP", tt.realIP)
+			}
+			ss := &testStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+			info := &grpc.StreamServerInfo{}
+			err := ClientIPGRPCStreamInterceptor(cfg)(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+				return SubNetGRPCStreamInterceptor(cfg)(srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+					return nil
+				})
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestSubNetGRPCInterceptor(t *testing.T) {
+	cfg := &serverutils.ServerConfig{
+		AllowedSubnets: mustSubnets(t, "2001:db8::/32"),
+		RouteAccess: map[string]serverutils.Access{
+			RouteGroupValue: {Allow: mustSubnets(t, "192.168.1.0/24")},
+		},
+		TrustPeer: true,
+	}
+	tests := []struct {
+		name     string
+		method   string
+		realIP   string
+		peer     string
+		wantCode codes.Code
+	}{
+		{
+			name:     "Test #1: ipv6 peer",
+			method:   "/metrics.Metrics/Save",
+			peer:     "[2001:db8::1]:5000",
+			wantCode: codes.OK,
+		},
+		{
+			name:     "Test #2: spoofed X-Real-IP is replaced by peer",
+			method:   "/metrics.Metrics/Save",
+			realIP:   "2001:db8::1",
+			peer:     "10.0.0.1:5000",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "Test #3: route group allow",
+			method:   "/metrics.Metrics/GetMany",
+			peer:     "192.168.1.10:5000",
+			wantCode: codes.OK,
+		},
+		{
+			name:     "Test #4: route group allow replaces common allow",
+			method:   "/metrics.Metrics/Get",
+			peer:     "[2001:db8::1]:5000",
+			wantCode: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+			if tt.realIP != "" {
+				md.Set("X-Real-IP", tt.realIP)
+			}
+			addr, err := net.ResolveTCPAddr("tcp", tt.peer)
+			require.NoError(t, err)
+			ctx := peer.NewContext(metadata.NewIncomingContext(context.Background(), md), &peer.Peer{Addr: addr})
+			info := &grpc.UnaryServerInfo{FullMethod: tt.method}
+			_, err = ClientIPGRPCInterceptor(cfg)(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return SubNetGRPCInterceptor(cfg)(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, nil
+				})
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestSignGRPCInterceptor(t *testing.T) {
+	cfg := &serverutils.ServerConfig{Key: "secret"}
+	req := &pb.SaveListMetricsRequest{BatchId: 1, Metric: []*pb.Metric{{Id: "Alloc"}}}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+	valid, err := metrics.SignBody(body, cfg.Key)
+	require.NoError(t, err)
+	wrong, err := metrics.SignBody(body, "other")
+	require.NoError(t, err)
+	tests := []struct {
+		name       string
+		hash       string
+		wantCode   codes.Code
+		wantSigned bool
+	}{
+		{
+			name:       "Test #1: valid signature",
+			hash:       valid,
+			wantCode:   codes.OK,
+			wantSigned: true,
+		},
+		{
+			name:     "Test #2: wrong signature",
+			hash:     wrong,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "Test #3: without signature",
+			wantCode: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+			if tt.hash != "" {
+				md.Set(metrics.HashHeader, tt.hash)
+			}
+			var signed bool
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+			_, err := SignGRPCInterceptor(cfg)(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/SaveList"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				signed = scenarios.SignedBody(ctx)
+				return nil, nil
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			assert.Equal(t, tt.wantSigned, signed)
+		})
+	}
+}
+
+func TestRSAGRPCInterceptor(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	plain := &pb.SaveListMetricsRequest{BatchId: 7}
+	for i := 0; i < 50; i++ {
+		plain.Metric = append(plain.Metric, &pb.Metric{Id: "Alloc", Mtype: "gauge", Value: float64(i)})
+	}
+	body, err := proto.Marshal(plain)
+	require.NoError(t, err)
+	encrypted, err := agentutils.EncryptRSA(&pk.PublicKey, body)
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		key      *rsa.PrivateKey
+		req      *pb.SaveListMetricsRequest
+		wantCode codes.Code
+	}{
+		{
+			name:     "Test #1: encrypted message",
+			key:      pk,
+			req:      &pb.SaveListMetricsRequest{Encrypted: encrypted},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "Test #2: plain message with key",
+			key:      pk,
+			req:      proto.Clone(plain).(*pb.SaveListMetricsRequest),
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "Test #3: plain message without key",
+			req:      proto.Clone(plain).(*pb.SaveListMetricsRequest),
+			wantCode: codes.OK,
+		},
+		{
+			name:     "Test #4: encrypted message without key",
+			req:      &pb.SaveListMetricsRequest{Encrypted: encrypted},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &serverutils.ServerConfig{PrivateKey: tt.key}
+			info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/SaveList"}
+			_, err := RSAGRPCInterceptor(cfg)(context.Background(), tt.req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				assert.True(t, proto.Equal(plain, req.(proto.Message)))
+				return nil, nil
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+	t.Run("Test #5: encrypted stream", func(t *testing.T) {
+		cfg := &serverutils.ServerConfig{PrivateKey: pk}
+		ss := &testStream{ctx: context.Background(), recv: []proto.Message{&pb.SaveListMetricsRequest{Encrypted: encrypted}}}
+		err := RSAGRPCStreamInterceptor(cfg)(nil, ss, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			var req pb.SaveListMetricsRequest
+			require.NoError(t, stream.RecvMsg(&req))
+			assert.True(t, proto.Equal(plain, &req))
+			return nil
+		})
+		assert.NoError(t, err)
+	})
+}
@@ -4,19 +4,19 @@ package middleware
 import (
 	"bytes"
 	"compress/gzip"
-	"context"
-	"crypto"
-	"crypto/rsa"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/scenarios/handlers"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
 )
 
 // gzipWriter - новый writer для использования с gzip
@@ -30,6 +30,16 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush - реализация интерфейса http.Flusher: сжатые данные сразу отправляются клиенту (нужно для потоковых ответов).
+func (w gzipWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // GzipHandle - middleware для подмены writer на другой с использованием gzip. Устанавливает header "Content-Encoding" на "gzip"
 func GzipHandle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -49,6 +59,8 @@ func GzipHandle(next http.Handler) http.Handler {
 }
 
 // RSAHandler - middleware для расшифровки данных
+//
+// Тело запроса зашифровано по блокам размера ключа (agentutils.EncryptRSA), поэтому пакет метрик может быть больше одного блока RSA.
 func RSAHandler(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -58,12 +70,12 @@ func RSAHandler(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
 			}
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(rw, err.Error(), http.StatusBadRequest)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't read body", err))
 				return
 			}
-			decryptedBytes, err := cfg.PrivateKey.Decrypt(nil, body, &rsa.OAEPOptions{Hash: crypto.SHA256})
+			decryptedBytes, err := serverutils.DecryptRSA(cfg.PrivateKey, body)
 			if err != nil {
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't decrypt body", err))
 				return
 			}
 			reader := io.NopCloser(bytes.NewBuffer(decryptedBytes))
@@ -73,55 +85,160 @@ func RSAHandler(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
 	}
 }
 
-// SubNet - middleware для проверки доверенных устройств
+// BodySign - middleware для проверки подписи всего тела запроса из заголовка HashSHA256.
+//
+// Если заголовок не передан или ключ не задан - проверяются подписи отдельных метрик.
+func BodySign(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			hash := r.Header.Get(metrics.HashHeader)
+			if cfg.Key == "" || hash == "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't read body", err))
+				return
+			}
+			ok, err := metrics.CompareBodyHash(body, cfg.Key, hash)
+			if err != nil || !ok {
+				selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadSignature, "", "body signature is wrong", err))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewBuffer(body))
+			next.ServeHTTP(rw, r.WithContext(scenarios.WithSignedBody(r.Context())))
+		})
+	}
+}
+
+// Metrics - middleware для учета количества и длительности запросов по маршрутам в selfmetrics.Default. Ошибкой считается ответ с кодом 4xx и 5xx.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chimiddleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unknown"
+		}
+		selfmetrics.Default.Observe("http "+r.Method+" "+route, time.Since(start), ww.Status() >= http.StatusBadRequest)
+	})
+}
+
+// Группы маршрутов с отдельными ограничениями доступа и частоты запросов.
+const (
+	RouteGroupUpdate = "update" // Сохранение метрик: /update*, Save, SaveList, StreamSave
+	RouteGroupValue  = "value"  // Чтение метрик: /value*, Get, GetMany, GetList, Watch
+	RouteGroupRoot   = "root"   // Остальные маршруты: /, /ping, /watch, /debug/*, Ping, сервисы здоровья и рефлексии
+)
+
+// routeGroup - группа маршрута HTTP по пути запроса.
+func routeGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/update"):
+		return RouteGroupUpdate
+	case strings.HasPrefix(path, "/value"):
+		return RouteGroupValue
+	default:
+		return RouteGroupRoot
+	}
+}
+
+// hasAccessRules - проверяет, что в конфигурации задано хотя бы одно ограничение доступа по подсетям.
+func hasAccessRules(cfg *serverutils.ServerConfig) bool {
+	if cfg.TrustedSubnet != nil || len(cfg.AllowedSubnets) > 0 || len(cfg.DeniedSubnets) > 0 {
+		return true
+	}
+	for _, access := range cfg.RouteAccess {
+		if len(access.Allow) > 0 || len(access.Deny) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIP - проверяет доступ адреса к группе маршрутов group.
+//
+// Запрещенные подсети группы и общие запрещенные подсети проверяются первыми. Затем адрес должен входить в разрешенные подсети группы, а если они не заданы - в общие разрешенные подсети и TrustedSubnet. Пустой список разрешенных подсетей разрешает все адреса.
+func allowedIP(cfg *serverutils.ServerConfig, group string, ip net.IP) bool {
+	access := cfg.RouteAccess[group]
+	if cfg.DeniedSubnets.Contains(ip) || access.Deny.Contains(ip) {
+		return false
+	}
+	if len(access.Allow) > 0 {
+		return access.Allow.Contains(ip)
+	}
+	if cfg.TrustedSubnet == nil && len(cfg.AllowedSubnets) == 0 {
+		return true
+	}
+	return cfg.AllowedSubnets.Contains(ip) || (cfg.TrustedSubnet != nil && cfg.TrustedSubnet.Contains(ip))
+}
+
+// hostOnly - адрес без порта.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// parseIP - разбирает адрес IPv4 или IPv6. Квадратные скобки и зона IPv6 (fe80::1%eth0) отбрасываются.
+func parseIP(value string) net.IP {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if i := strings.IndexByte(value, '%'); i >= 0 {
+		value = value[:i]
+	}
+	return net.ParseIP(value)
+}
+
+// clientIP - адрес клиента: при включенном cfg.TrustPeer - адрес соединения peerAddr, чтобы клиент не мог подставить чужой адрес, иначе - realIP из X-Real-IP.
+// Если X-Real-IP не передан или не разбирается, используется адрес соединения, иначе все такие клиенты попали бы в одно ограничение частоты и одну квоту. Пустая строка - адрес неизвестен.
+//
+// По этому адресу проверяются подсети, ограничивается частота запросов и считаются квоты метрик в HTTP и gRPC.
+func clientIP(cfg *serverutils.ServerConfig, realIP, peerAddr string) string {
+	if cfg.TrustPeer || parseIP(realIP) == nil {
+		return hostOnly(peerAddr)
+	}
+	return realIP
+}
+
+// ClientIP - middleware, которое определяет адрес клиента (clientIP) и сохраняет его в контексте запроса (scenarios.WithClient).
+//
+// Должно стоять до chimiddleware.RealIP: он заменяет RemoteAddr значением заголовков True-Client-IP и X-Forwarded-For, которые передает клиент.
+func ClientIP(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ip := clientIP(cfg, r.Header.Get("X-Real-IP"), r.RemoteAddr)
+			next.ServeHTTP(rw, r.WithContext(scenarios.WithClient(r.Context(), ip)))
+		})
+	}
+}
+
+// SubNet - middleware для проверки доверенных устройств: адрес клиента из ClientIP проверяется по разрешенным и запрещенным подсетям группы маршрута.
 func SubNet(cfg *serverutils.ServerConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-			if cfg.TrustedSubnet == nil {
+			if !hasAccessRules(cfg) {
 				next.ServeHTTP(rw, r)
 				return
 			}
-			realIP := r.Header.Get("X-Real-IP")
+			realIP := scenarios.Client(r.Context())
 			if realIP == "" {
-				http.Error(rw, "headers not contain X-Real-IP", http.StatusBadRequest)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "headers not contain X-Real-IP", nil))
 				return
 			}
-			ip := net.ParseIP(realIP)
+			ip := parseIP(realIP)
 			if ip == nil {
-				http.Error(rw, "cannot parse X-Real-IP", http.StatusBadRequest)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "cannot parse X-Real-IP", nil))
 				return
 			}
-			if !cfg.TrustedSubnet.Contains(ip) {
-				http.Error(rw, "request not from trusteed IP", http.StatusBadRequest)
+			if !allowedIP(cfg, routeGroup(r.URL.Path), ip) {
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "request not from trusteed IP", nil))
 				return
 			}
 			next.ServeHTTP(rw, r)
 		})
 	}
 }
-
-func SubNetGRPCInterceptor(cfg *serverutils.ServerConfig) grpc.UnaryServerInterceptor {
-	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		if cfg.TrustedSubnet == nil {
-			return handler(ctx, req)
-		}
-		var iptag string
-		if md, ok := metadata.FromIncomingContext(ctx); ok {
-			values := md.Get("X-Real-IP")
-			if len(values) > 0 {
-				iptag = values[0]
-			}
-		}
-		if len(iptag) == 0 {
-			return nil, status.Error(codes.Unauthenticated, "missing ip")
-		}
-		ip := net.ParseIP(iptag)
-		if ip == nil {
-			return nil, status.Error(codes.Unauthenticated, "missing ip")
-		}
-		if !cfg.TrustedSubnet.Contains(ip) {
-			return nil, status.Error(codes.Unauthenticated, "ip not in trusted")
-		}
-		return handler(ctx, req)
-	}
-}
@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodySign(t *testing.T) {
+	cfg := &serverutils.ServerConfig{Key: "secret"}
+	body := `[{"id":"Alloc","type":"gauge","value":1}]`
+	valid, err := metrics.SignBody([]byte(body), cfg.Key)
+	require.NoError(t, err)
+	wrong, err := metrics.SignBody([]byte(body), "other")
+	require.NoError(t, err)
+	tests := []struct {
+		name       string
+		hash       string
+		wantCode   int
+		wantSigned bool
+	}{
+		{
+			name:       "Test #1: valid signature",
+			hash:       valid,
+			wantCode:   http.StatusOK,
+			wantSigned: true,
+		},
+		{
+			name:     "Test #2: wrong signature",
+			hash:     wrong,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #3: not hex signature",
+			hash:     "not hex",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #4: without signature",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var signed bool
+			var got string
+			handler := BodySign(cfg)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				signed = scenarios.SignedBody(r.Context())
+				data, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				got = string(data)
+				rw.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+			if tt.hash != "" {
+				r.Header.Set(metrics.HashHeader, tt.hash)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantSigned, signed)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, body, got, "body is available to the handler after the check")
+			} else {
+				assert.Equal(t, scenarios.CodeBadSignature, problemCode(t, w))
+			}
+		})
+	}
+}
+
+// problemCode - проверяет, что ответ - ошибка в формате application/problem+json, и возвращает ее код.
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) scenarios.ErrorCode {
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	var body struct {
+		Status int                 `json:"status"`
+		Code   scenarios.ErrorCode `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, w.Code, body.Status)
+	return body.Code
+}
+
+// mustSubnets - разбирает подсети для теста.
+func mustSubnets(t *testing.T, value string) serverutils.Subnets {
+	subnets, err := serverutils.ParseSubnets(value)
+	require.NoError(t, err)
+	return subnets
+}
+
+func TestSubNet(t *testing.T) {
+	cfg := &serverutils.ServerConfig{
+		AllowedSubnets: mustSubnets(t, "192.168.1.0/24, fd00::/8"),
+		DeniedSubnets:  mustSubnets(t, "192.168.1.13"),
+		RouteAccess: map[string]serverutils.Access{
+			RouteGroupValue:  {Allow: mustSubnets(t, "10.0.0.0/8")},
+			RouteGroupUpdate: {Deny: mustSubnets(t, "fd00:bad::/32")},
+		},
+	}
+	handler := ClientIP(cfg)(SubNet(cfg)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})))
+	tests := []struct {
+		name     string
+		path     string
+		realIP   string
+		wantCode int
+	}{
+		{
+			name:     "Test #1: allowed ipv4",
+			path:     "/update/",
+			realIP:   "192.168.1.10",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Test #2: denied address inside allowed subnet",
+			path:     "/update/",
+			realIP:   "192.168.1.13",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #3: allowed ipv6",
+			path:     "/",
+			realIP:   "fd00::1",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Test #4: ipv6 denied for route group",
+			path:     "/updates/",
+			realIP:   "fd00:bad::1",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #5: route group allow replaces common allow",
+			path:     "/value/",
+			realIP:   "10.1.2.3",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Test #6: common allow does not apply to route group with own allow",
+			path:     "/value/",
+			realIP:   "192.168.1.10",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #7: route group allow is limited to its routes",
+			path:     "/ping",
+			realIP:   "10.1.2.3",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #8: without ip",
+			path:     "/",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Test #9: ipv6 with zone in brackets",
+			path:     "/",
+			realIP:   "[fd00::1%eth0]",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, scenarios.CodeBadRequest, problemCode(t, w))
+			}
+		})
+	}
+}
+
+func TestSubNetWithoutRules(t *testing.T) {
+	handler := SubNet(&serverutils.ServerConfig{})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestClientIPTrustPeer(t *testing.T) {
+	cfg := &serverutils.ServerConfig{AllowedSubnets: mustSubnets(t, "192.168.1.0/24"), TrustPeer: true}
+	handler := ClientIP(cfg)(SubNet(cfg)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})))
+	tests := []struct {
+		name       string
+		realIP     string
+		remoteAddr string
+		wantCode   int
+	}{
+		{
+			name:       "Test #1: spoofed X-Real-IP",
+			realIP:     "192.168.1.10",
+			remoteAddr: "10.0.0.1:1234",
+			wantCode:   http.StatusBadRequest,
+		},
+		{
+			name:       "Test #2: trusted peer without X-Real-IP",
+			remoteAddr: "192.168.1.10:1234",
+			wantCode:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trustPeer bool
+		want      string
+	}{
+		{
+			name: "Test #1: X-Real-IP",
+			want: "192.168.1.10",
+		},
+		{
+			name:      "Test #2: peer address",
+			trustPeer: true,
+			want:      "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			// RealIP стоит после ClientIP, как в сервере, и переписывает RemoteAddr по заголовкам клиента
+			handler := ClientIP(&serverutils.ServerConfig{TrustPeer: tt.trustPeer})(chimiddleware.RealIP(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got = scenarios.Client(r.Context())
+			})))
+			r := httptest.NewRequest(http.MethodPost, "/update/", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("X-Real-IP", "192.168.1.10")
+			r.Header.Set("True-Client-IP", "172.16.0.1")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
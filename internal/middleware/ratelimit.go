@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/scenarios/handlers"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ratePruneInterval - интервал удаления состояний клиентов, которые восстановили весь запас запросов.
+const ratePruneInterval = time.Minute
+
+// bucket - состояние ограничения одного клиента.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateGroup - ограничение частоты запросов группы маршрутов по клиентам.
+type rateGroup struct {
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	items  map[string]*bucket
+	pruned time.Time
+}
+
+// allow - тратит один запрос из запаса клиента key. Если запас исчерпан, возвращает время до появления следующего запроса.
+func (g *rateGroup) allow(key string, now time.Time) (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.pruned) > ratePruneInterval {
+		g.prune(now)
+	}
+	b, ok := g.items[key]
+	if !ok {
+		b = &bucket{tokens: g.burst, last: now}
+		g.items[key] = b
+	}
+	b.tokens = g.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / g.rate * float64(time.Second))
+}
+
+// refill - запас запросов клиента на момент now.
+func (g *rateGroup) refill(b *bucket, now time.Time) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		return math.Min(g.burst, b.tokens+elapsed*g.rate)
+	}
+	return b.tokens
+}
+
+// prune - удаляет клиентов с полным запасом: их состояние не отличается от нового. Вызывается под блокировкой.
+func (g *rateGroup) prune(now time.Time) {
+	for key, b := range g.items {
+		if g.refill(b, now) >= g.burst {
+			delete(g.items, key)
+		}
+	}
+	g.pruned = now
+}
+
+// RateLimiter - ограничение частоты запросов клиентов по алгоритму token bucket отдельно для каждой группы маршрутов.
+type RateLimiter struct {
+	groups map[string]*rateGroup
+	now    func() time.Time
+}
+
+// NewRateLimiter - создает ограничение частоты запросов по настройкам групп. Группы без настроек или с нулевой частотой не ограничиваются.
+func NewRateLimiter(limits map[string]serverutils.RateLimit) *RateLimiter {
+	l := &RateLimiter{
+		groups: make(map[string]*rateGroup),
+		now:    time.Now,
+	}
+	for name, limit := range limits {
+		if limit.Rate <= 0 {
+			continue
+		}
+		burst := float64(limit.Burst)
+		if burst <= 0 {
+			burst = math.Ceil(limit.Rate)
+		}
+		l.groups[name] = &rateGroup{rate: limit.Rate, burst: burst, items: make(map[string]*bucket)}
+	}
+	return l
+}
+
+// Allow - проверяет, что клиент key не превысил ограничение группы group. Если превысил, возвращает время, через которое можно повторить запрос.
+func (l *RateLimiter) Allow(group, key string) (bool, time.Duration) {
+	g, ok := l.groups[group]
+	if !ok {
+		return true, 0
+	}
+	allowed, wait := g.allow(key, l.now())
+	if !allowed {
+		selfmetrics.Default.Add(selfmetrics.RateLimited, 1)
+	}
+	return allowed, wait
+}
+
+// retryAfterSeconds - значение заголовка Retry-After: целое число секунд, не меньше 1.
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// RateLimit - middleware, ограничивающее частоту запросов клиента к группе маршрутов group.
+//
+// Клиент определяется по адресу из ClientIP. При превышении ограничения отвечает 429 с кодом rate_limited и заголовком Retry-After.
+func RateLimit(l *RateLimiter, group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if ok, wait := l.Allow(group, scenarios.Client(r.Context())); !ok {
+				retryAfter := retryAfterSeconds(wait)
+				rw.Header().Set("Retry-After", retryAfter)
+				handlers.WriteError(rw, r, scenarios.NewError(scenarios.CodeRateLimited, "", "too many requests", nil).WithDetail("retry_after", retryAfter))
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// checkRate - проверяет ограничение частоты вызовов. При превышении возвращает ResourceExhausted с временем до повтора в деталях статуса (RetryInfo).
+func checkRate(ctx context.Context, l *RateLimiter, fullMethod string) error {
+	ok, wait := l.Allow(grpcRouteGroup(fullMethod), scenarios.Client(ctx))
+	if ok {
+		return nil
+	}
+	st, err := status.New(codes.ResourceExhausted, "too many requests").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return st.Err()
+}
+
+// rateStream - поток, в котором ограничивается частота входящих сообщений.
+type rateStream struct {
+	grpc.ServerStream
+	limiter *RateLimiter
+	method  string
+}
+
+// RecvMsg - читает сообщение из потока, если клиент не превысил ограничение.
+func (s rateStream) RecvMsg(m interface{}) error {
+	if err := checkRate(s.Context(), s.limiter, s.method); err != nil {
+		return err
+	}
+	return s.ServerStream.RecvMsg(m)
+}
+
+// RateLimitGRPCInterceptor - ограничивает частоту вызовов клиента по группам методов так же, как RateLimit для маршрутов HTTP.
+func RateLimitGRPCInterceptor(l *RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkRate(ctx, l, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// RateLimitGRPCStreamInterceptor - потоковый вариант RateLimitGRPCInterceptor: ограничивается открытие потока и каждое входящее сообщение.
+func RateLimitGRPCStreamInterceptor(l *RateLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkRate(ss.Context(), l, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, rateStream{ServerStream: ss, limiter: l, method: info.FullMethod})
+	}
+}
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// testLimiter - ограничение с управляемыми часами.
+func testLimiter(limits map[string]serverutils.RateLimit) (*RateLimiter, *time.Time) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(limits)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, now := testLimiter(map[string]serverutils.RateLimit{
+		RouteGroupUpdate: {Rate: 2, Burst: 3},
+		RouteGroupValue:  {Rate: 0.5},
+	})
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow(RouteGroupUpdate, "10.0.0.1")
+		require.True(t, ok)
+	}
+	ok, wait := l.Allow(RouteGroupUpdate, "10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.Allow(RouteGroupUpdate, "10.0.0.2")
+	assert.True(t, ok, "clients are limited separately")
+	ok, _ = l.Allow(RouteGroupRoot, "10.0.0.1")
+	assert.True(t, ok, "group without limit")
+
+	*now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		ok, _ = l.Allow(RouteGroupUpdate, "10.0.0.1")
+		require.True(t, ok)
+	}
+	ok, _ = l.Allow(RouteGroupUpdate, "10.0.0.1")
+	assert.False(t, ok)
+
+	// burst по умолчанию - частота, округленная вверх, но не меньше одного запроса
+	ok, _ = l.Allow(RouteGroupValue, "10.0.0.1")
+	assert.True(t, ok)
+	ok, wait = l.Allow(RouteGroupValue, "10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+
+	*now = now.Add(2 * ratePruneInterval)
+	l.Allow(RouteGroupUpdate, "10.0.0.3")
+	assert.Len(t, l.groups[RouteGroupUpdate].items, 1, "idle clients are pruned")
+}
+
+func TestRateLimit(t *testing.T) {
+	l, _ := testLimiter(map[string]serverutils.RateLimit{RouteGroupUpdate: {Rate: 0.25, Burst: 1}})
+	handler := ClientIP(&serverutils.ServerConfig{})(RateLimit(l, RouteGroupUpdate)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})))
+	tests := []struct {
+		name       string
+		realIP     string
+		remoteAddr string
+		wantCode   int
+		retryAfter string
+	}{
+		{
+			name:       "Test #1: first request",
+			realIP:     "192.168.1.10",
+			remoteAddr: "127.0.0.1:1000",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "Test #2: same X-Real-IP",
+			realIP:     "192.168.1.10",
+			remoteAddr: "127.0.0.1:1001",
+			wantCode:   http.StatusTooManyRequests,
+			retryAfter: "4",
+		},
+		{
+			name:       "Test #3: another X-Real-IP from same host",
+			realIP:     "192.168.1.11",
+			remoteAddr: "127.0.0.1:1002",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "Test #4: X-Real-IP from another host",
+			realIP:     "192.168.1.11",
+			remoteAddr: "127.0.0.2:1003",
+			wantCode:   http.StatusTooManyRequests,
+			retryAfter: "4",
+		},
+		{
+			name:       "Test #5: without X-Real-IP",
+			remoteAddr: "127.0.0.3:1004",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "Test #6: without X-Real-IP from another host",
+			remoteAddr: "127.0.0.4:1005",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "Test #7: without X-Real-IP from same host",
+			remoteAddr: "127.0.0.4:1006",
+			wantCode:   http.StatusTooManyRequests,
+			retryAfter: "4",
+		},
+		{
+			name:       "Test #8: invalid X-Real-IP",
+			realIP:     "unknown",
+			remoteAddr: "127.0.0.5:1007",
+			wantCode:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/update/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			if tt.wantCode == http.StatusTooManyRequests {
+				assert.Equal(t, scenarios.CodeRateLimited, problemCode(t, w))
+			}
+		})
+	}
+}
+
+func TestRateLimitGRPCInterceptor(t *testing.T) {
+	l, _ := testLimiter(map[string]serverutils.RateLimit{RouteGroupUpdate: {Rate: 1, Burst: 1}})
+	ctx := scenarios.WithClient(context.Background(), "192.168.1.10")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	interceptor := RateLimitGRPCInterceptor(l)
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/Save"}, handler)
+	require.NoError(t, err)
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/Get"}, handler)
+	require.NoError(t, err, "other group is not limited")
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/SaveList"}, handler)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, info.RetryDelay.AsDuration())
+}
+
+func TestRateLimitGRPCStreamInterceptor(t *testing.T) {
+	l, _ := testLimiter(map[string]serverutils.RateLimit{RouteGroupUpdate: {Rate: 1, Burst: 2}})
+	ss := &testStream{
+		ctx:  scenarios.WithClient(context.Background(), "192.168.1.10"),
+		recv: []proto.Message{&pb.SaveListMetricsRequest{BatchId: 1}, &pb.SaveListMetricsRequest{BatchId: 2}},
+	}
+	info := &grpc.StreamServerInfo{FullMethod: "/metrics.Metrics/StreamSave"}
+	err := RateLimitGRPCStreamInterceptor(l)(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		var req pb.SaveListMetricsRequest
+		require.NoError(t, stream.RecvMsg(&req))
+		assert.Equal(t, uint64(1), req.BatchId)
+		return stream.RecvMsg(&req)
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "opening the stream and the first message use the whole burst")
+}
@@ -0,0 +1,91 @@
+package scenarios
+
+import (
+	"errors"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// ErrorCode - машиночитаемый код ошибки сценария. Транспорты (HTTP, gRPC) сопоставляют его со своими кодами ответа.
+type ErrorCode string
+
+// Коды ошибок при работе с данными
+const (
+	CodeBadRequest     ErrorCode = "bad_request"     // Некорректный запрос
+	CodeParseError     ErrorCode = "parse_error"     // Метрику не удалось разобрать
+	CodeBadSignature   ErrorCode = "bad_signature"   // Подпись метрики не совпала
+	CodeTypeConflict   ErrorCode = "type_conflict"   // Метрика уже сохранена с другим типом
+	CodeNotFound       ErrorCode = "not_found"       // Метрика не найдена
+	CodeNotImplemented ErrorCode = "not_implemented" // Тип метрики не поддерживается
+	CodeQuotaExceeded  ErrorCode = "quota_exceeded"  // Превышено ограничение на количество метрик
+	CodeRateLimited    ErrorCode = "rate_limited"    // Превышено ограничение частоты запросов
+	CodeInternal       ErrorCode = "internal"        // Внутренняя ошибка сервера
+)
+
+// Error - ошибка сценария: код, описание для клиента, метрика, к которой относится ошибка, и дополнительные сведения.
+type Error struct {
+	Code     ErrorCode         // Код ошибки
+	Message  string            // Описание ошибки для клиента
+	MetricID string            // Имя метрики, к которой относится ошибка
+	Details  map[string]string // Дополнительные сведения об ошибке
+	Err      error             // Исходная ошибка
+}
+
+// NewError - создает ошибку сценария.
+func NewError(code ErrorCode, metricID string, message string, err error) *Error {
+	return &Error{
+		Code:     code,
+		Message:  message,
+		MetricID: metricID,
+		Err:      err,
+	}
+}
+
+// Error - реализация интерфейса error.
+func (e *Error) Error() string {
+	result := string(e.Code) + ": " + e.Message
+	if e.MetricID != "" {
+		result += " (metric " + e.MetricID + ")"
+	}
+	if e.Err != nil {
+		result += ": " + e.Err.Error()
+	}
+	return result
+}
+
+// Unwrap - возвращает исходную ошибку.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithDetail - добавляет к ошибке дополнительное сведение.
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// AsError - приводит любую ошибку к ошибке сценария. Ошибки, не описанные в сценариях, считаются внутренними.
+func AsError(err error) *Error {
+	var se *Error
+	if errors.As(err, &se) {
+		return se
+	}
+	return NewError(CodeInternal, "", "internal server error", err)
+}
+
+// MetricError - преобразует ошибку разбора метрики из пакета metrics в ошибку сценария.
+func MetricError(metricID string, err error) *Error {
+	switch {
+	case errors.Is(err, metrics.ErrUndefinedType):
+		return NewError(CodeNotImplemented, metricID, "type of metric undefined", err)
+	case errors.Is(err, metrics.ErrWrongType):
+		return NewError(CodeTypeConflict, metricID, "metric have another type", err)
+	case errors.Is(err, metrics.ErrParseMetric):
+		return NewError(CodeParseError, metricID, "can't parse metric", err)
+	default:
+		return NewError(CodeInternal, metricID, "internal server error", err)
+	}
+}
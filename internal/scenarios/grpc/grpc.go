@@ -4,29 +4,57 @@ package grpc
 import (
 	"context"
 	"errors"
+	"io"
+	"strings"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
 	"github.com/colzphml/yandex_project/internal/metrics"
 	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
 	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
 	"github.com/colzphml/yandex_project/internal/storage"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func errMapping(err error) codes.Code {
-	switch {
-	case errors.Is(err, scenarios.ErrStatusBadRequest):
+	switch scenarios.AsError(err).Code {
+	case scenarios.CodeBadRequest, scenarios.CodeParseError, scenarios.CodeBadSignature, scenarios.CodeTypeConflict:
 		return codes.InvalidArgument
-	case errors.Is(err, scenarios.ErrStatusNotFound):
+	case scenarios.CodeNotFound:
 		return codes.NotFound
-	case errors.Is(err, scenarios.ErrStatusNotImplemented):
+	case scenarios.CodeNotImplemented:
 		return codes.Unimplemented
+	case scenarios.CodeQuotaExceeded, scenarios.CodeRateLimited:
+		return codes.ResourceExhausted
 	default:
 		return codes.Internal
 	}
 }
 
+// statusError - превращает ошибку сценария в статус gRPC. Код ошибки, метрика и дополнительные сведения передаются в деталях статуса (ErrorInfo).
+func statusError(err error) error {
+	se := scenarios.AsError(err)
+	info := &errdetails.ErrorInfo{
+		Reason:   strings.ToUpper(string(se.Code)),
+		Domain:   "metrics",
+		Metadata: make(map[string]string, len(se.Details)+1),
+	}
+	for k, v := range se.Details {
+		info.Metadata[k] = v
+	}
+	if se.MetricID != "" {
+		info.Metadata["metric_id"] = se.MetricID
+	}
+	st, detailsErr := status.New(errMapping(se), se.Message).WithDetails(info)
+	if detailsErr != nil {
+		return status.Error(errMapping(se), se.Message)
+	}
+	return st.Err()
+}
+
 func ConvertGRPCtoMetric(in *pb.Metric) (metrics.Metrics, error) {
 	metric := metrics.Metrics{
 		ID:    in.Id,
@@ -41,7 +69,7 @@ func ConvertGRPCtoMetric(in *pb.Metric) (metrics.Metrics, error) {
 		value := in.Delta
 		metric.Delta = &value
 	default:
-		return metrics.Metrics{}, metrics.ErrWrongType
+		return metrics.Metrics{}, metrics.ErrUndefinedType
 	}
 	return metric, nil
 }
@@ -65,6 +93,40 @@ func ConvertMetrictoGRPC(in metrics.Metrics) *pb.Metric {
 	return &result
 }
 
+// ConvertBatchResulttoGRPC - превращает результат обработки пакета метрик в ответ gRPC.
+func ConvertBatchResulttoGRPC(in metrics.BatchResult) *pb.SaveListMetricsResponse {
+	result := pb.SaveListMetricsResponse{
+		Accepted: int32(in.Accepted),
+		Rejected: int32(in.Rejected),
+	}
+	for _, v := range in.Items {
+		result.Items = append(result.Items, &pb.MetricStatus{
+			Id:     v.ID,
+			Mtype:  v.MType,
+			Status: v.Status,
+			Error:  v.Error,
+		})
+	}
+	return &result
+}
+
+// ConvertGRPCtoBatchResult - превращает ответ gRPC в результат обработки пакета метрик.
+func ConvertGRPCtoBatchResult(in *pb.SaveListMetricsResponse) metrics.BatchResult {
+	result := metrics.BatchResult{
+		Accepted: int(in.Accepted),
+		Rejected: int(in.Rejected),
+	}
+	for _, v := range in.Items {
+		result.Items = append(result.Items, metrics.ItemStatus{
+			ID:     v.Id,
+			MType:  v.Mtype,
+			Status: v.Status,
+			Error:  v.Error,
+		})
+	}
+	return result
+}
+
 type MetricsServer struct {
 	pb.UnimplementedMetricsServer
 	Repo storage.Repositorier
@@ -73,54 +135,160 @@ type MetricsServer struct {
 
 func (s *MetricsServer) Save(ctx context.Context, in *pb.SaveMetricRequest) (*pb.SaveMetricResponse, error) {
 	var resp pb.SaveMetricResponse
+	if in.Metric == nil {
+		return nil, statusError(scenarios.NewError(scenarios.CodeBadRequest, "", "metric is empty", nil))
+	}
 	metric, err := ConvertGRPCtoMetric(in.Metric)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(scenarios.MetricError(in.Metric.Id, err))
 	}
 	err = scenarios.SaveMetric(ctx, s.Repo, s.Cfg, metric, true)
 	if err != nil {
-		return nil, status.Error(errMapping(err), err.Error())
+		return nil, statusError(err)
 	}
 	return &resp, nil
 
 }
 func (s *MetricsServer) SaveList(ctx context.Context, in *pb.SaveListMetricsRequest) (*pb.SaveListMetricsResponse, error) {
+	result, err := s.saveList(ctx, in)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return ConvertBatchResulttoGRPC(result), nil
+}
+
+// StreamSave - принимает пакеты метрик в открытом агентом потоке и подтверждает каждый пакет ответом с тем же batch_id.
+//
+// Ошибка обработки пакета не закрывает поток: она передается агенту в полях error и code подтверждения.
+func (s *MetricsServer) StreamSave(stream pb.Metrics_StreamSaveServer) error {
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ctx := stream.Context()
+		var resp *pb.SaveListMetricsResponse
+		signed, err := s.checkBatchHash(in)
+		if signed {
+			ctx = scenarios.WithSignedBody(ctx)
+		}
+		if err == nil {
+			var result metrics.BatchResult
+			result, err = s.saveList(ctx, in)
+			resp = ConvertBatchResulttoGRPC(result)
+		}
+		if err != nil {
+			resp = &pb.SaveListMetricsResponse{Error: err.Error(), Code: string(scenarios.AsError(err).Code)}
+		}
+		resp.BatchId = in.BatchId
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// checkBatchHash - проверяет подпись всего пакета из потока StreamSave. Возвращает true, если подпись передана и верна.
+func (s *MetricsServer) checkBatchHash(in *pb.SaveListMetricsRequest) (bool, error) {
+	if s.Cfg.Key == "" || in.Hash == "" {
+		return false, nil
+	}
+	unsigned := proto.Clone(in).(*pb.SaveListMetricsRequest)
+	unsigned.Hash = ""
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+	if err != nil {
+		return false, scenarios.NewError(scenarios.CodeInternal, "", "can't check signature", err)
+	}
+	ok, err := metrics.CompareBodyHash(body, s.Cfg.Key, in.Hash)
+	if err != nil || !ok {
+		selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+		return false, scenarios.NewError(scenarios.CodeBadSignature, "", "batch signature is wrong", err)
+	}
+	return true, nil
+}
+
+// saveList - сохраняет пакет метрик из запроса gRPC. Метрики, которые не удалось разобрать, отклоняются со статусом parse_error.
+func (s *MetricsServer) saveList(ctx context.Context, in *pb.SaveListMetricsRequest) (metrics.BatchResult, error) {
 	var ms []metrics.Metrics
-	var resp pb.SaveListMetricsResponse
+	var parseErrors []metrics.ItemStatus
 	for _, v := range in.Metric {
 		m, err := ConvertGRPCtoMetric(v)
 		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+			parseErrors = append(parseErrors, metrics.ItemStatus{
+				ID:     v.Id,
+				MType:  v.Mtype,
+				Status: metrics.StatusParseError,
+				Error:  err.Error(),
+			})
+			continue
 		}
 		ms = append(ms, m)
 	}
-	_, err := scenarios.SaveArrayMetric(ctx, s.Repo, s.Cfg, ms)
+	result, err := scenarios.SaveArrayMetric(ctx, s.Repo, s.Cfg, ms)
 	if err != nil {
-		return nil, status.Error(errMapping(err), err.Error())
+		return metrics.BatchResult{}, err
 	}
-	return &resp, nil
+	for _, v := range parseErrors {
+		result.Add(v)
+	}
+	return result, nil
+}
+
+// getMetric - возвращает метрику по имени и типу через scenarios.GetMetric. Если задан ключ, метрика подписывается.
+func (s *MetricsServer) getMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.Metric, error) {
+	if in.GetMetricName() == "" || in.GetMtype() == "" {
+		return nil, scenarios.NewError(scenarios.CodeBadRequest, in.GetMetricName(), "metric name and type are required", nil)
+	}
+	metricValue, err := scenarios.GetMetric(ctx, s.Repo, s.Cfg, in.MetricName, in.Mtype, true)
+	if err != nil {
+		return nil, err
+	}
+	return ConvertMetrictoGRPC(metricValue), nil
 }
 
+// Get - возвращает метрику по имени и типу.
 func (s *MetricsServer) Get(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
-	var resp pb.GetMetricResponse
-	metricValue, err := s.Repo.GetValue(ctx, in.MetricName)
+	metric, err := s.getMetric(ctx, in)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err)
 	}
-	resp.Metric = &pb.Metric{
-		Id:    metricValue.ID,
-		Mtype: metricValue.MType,
-		Value: *metricValue.Value,
-		Delta: *metricValue.Delta,
+	return &pb.GetMetricResponse{Metric: metric}, nil
+}
+
+// GetMany - возвращает несколько метрик за один вызов. Ошибка по отдельной метрике не прерывает обработку остальных и возвращается в ее результате.
+func (s *MetricsServer) GetMany(ctx context.Context, in *pb.GetManyRequest) (*pb.GetManyResponse, error) {
+	resp := pb.GetManyResponse{Items: make([]*pb.GetManyItem, 0, len(in.Metric))}
+	for _, v := range in.Metric {
+		item := &pb.GetManyItem{
+			MetricName: v.GetMetricName(),
+			Mtype:      v.GetMtype(),
+		}
+		metric, err := s.getMetric(ctx, v)
+		if err != nil {
+			se := scenarios.AsError(err)
+			if se.Code == scenarios.CodeInternal {
+				return nil, statusError(err)
+			}
+			item.Code = string(se.Code)
+			item.Error = se.Message
+		}
+		item.Metric = metric
+		resp.Items = append(resp.Items, item)
 	}
 	return &resp, nil
 }
 
+// GetList - возвращает все метрики. Если задан ключ, метрики подписываются.
 func (s *MetricsServer) GetList(ctx context.Context, in *pb.GetListMetricRequest) (*pb.GetListMetricResponse, error) {
 	var resp pb.GetListMetricResponse
 	var result []*pb.Metric
 	metricList := s.Repo.ListMetrics(ctx)
 	for _, v := range metricList {
+		if err := v.FillHash(s.Cfg.Key); err != nil {
+			return nil, statusError(scenarios.NewError(scenarios.CodeInternal, v.ID, "can't sign metric", err))
+		}
 		result = append(result, ConvertMetrictoGRPC(v))
 	}
 	resp.Metric = result
@@ -137,3 +305,29 @@ func (s *MetricsServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingR
 	resp.Ping = true
 	return &resp, nil
 }
+
+// Watch - отправляет в поток каждое принятое сервером обновление метрики, подходящее под фильтр по имени и типу.
+func (s *MetricsServer) Watch(in *pb.WatchRequest, stream pb.Metrics_WatchServer) error {
+	filter, err := scenarios.NewFilter(in.Name, in.Mtype)
+	if err != nil {
+		return statusError(err)
+	}
+	updates, unsubscribe := scenarios.Updates.Subscribe(filter)
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case m, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			if err := m.FillHash(s.Cfg.Key); err != nil {
+				return statusError(err)
+			}
+			if err := stream.Send(ConvertMetrictoGRPC(m)); err != nil {
+				return err
+			}
+		}
+	}
+}
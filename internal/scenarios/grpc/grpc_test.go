@@ -0,0 +1,137 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServer - создает сервер метрик с хранилищем в памяти, в котором есть метрики Alloc и PollCount.
+func newTestServer(t *testing.T, key string) *MetricsServer {
+	cfg := &serverutils.ServerConfig{Key: key, StoreInterval: time.Minute}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	value := 7.77
+	delta := int64(7)
+	repo.DB["Alloc"] = metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+	repo.DB["PollCount"] = metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
+	return &MetricsServer{Cfg: cfg, Repo: repo}
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		req        *pb.GetMetricRequest
+		wantCode   codes.Code
+		wantMetric *pb.Metric
+		wantReason string
+	}{
+		{
+			name:       "Test #1: gauge",
+			req:        &pb.GetMetricRequest{MetricName: "Alloc", Mtype: "gauge"},
+			wantCode:   codes.OK,
+			wantMetric: &pb.Metric{Id: "Alloc", Mtype: "gauge", Value: 7.77},
+		},
+		{
+			name:       "Test #2: counter",
+			req:        &pb.GetMetricRequest{MetricName: "PollCount", Mtype: "counter"},
+			wantCode:   codes.OK,
+			wantMetric: &pb.Metric{Id: "PollCount", Mtype: "counter", Delta: 7},
+		},
+		{
+			name:       "Test #3: wrong type",
+			req:        &pb.GetMetricRequest{MetricName: "Alloc", Mtype: "counter"},
+			wantCode:   codes.NotFound,
+			wantReason: "NOT_FOUND",
+		},
+		{
+			name:       "Test #4: unknown metric",
+			req:        &pb.GetMetricRequest{MetricName: "Unknown", Mtype: "gauge"},
+			wantCode:   codes.NotFound,
+			wantReason: "NOT_FOUND",
+		},
+		{
+			name:       "Test #5: without type",
+			req:        &pb.GetMetricRequest{MetricName: "Alloc"},
+			wantCode:   codes.InvalidArgument,
+			wantReason: "BAD_REQUEST",
+		},
+		{
+			name:       "Test #6: signed metric",
+			key:        "test",
+			req:        &pb.GetMetricRequest{MetricName: "Alloc", Mtype: "gauge"},
+			wantCode:   codes.OK,
+			wantMetric: &pb.Metric{Id: "Alloc", Mtype: "gauge", Value: 7.77},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.key)
+			resp, err := s.Get(context.Background(), tt.req)
+			st, _ := status.FromError(err)
+			require.Equal(t, tt.wantCode, st.Code())
+			if tt.wantCode != codes.OK {
+				require.Len(t, st.Details(), 1)
+				assert.Equal(t, tt.wantReason, st.Details()[0].(*errdetails.ErrorInfo).Reason)
+				return
+			}
+			if tt.key != "" {
+				m, err := ConvertGRPCtoMetric(resp.Metric)
+				require.NoError(t, err)
+				ok, err := m.CompareHash(tt.key)
+				require.NoError(t, err)
+				assert.True(t, ok)
+				resp.Metric.Hash = ""
+			}
+			assert.Equal(t, tt.wantMetric.String(), resp.Metric.String())
+		})
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	s := newTestServer(t, "test")
+	resp, err := s.GetMany(context.Background(), &pb.GetManyRequest{Metric: []*pb.GetMetricRequest{
+		{MetricName: "Alloc", Mtype: "gauge"},
+		{MetricName: "Alloc", Mtype: "counter"},
+		{MetricName: "PollCount", Mtype: "counter"},
+		{MetricName: "PollCount"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, resp.Items, 4)
+	wantCodes := []string{"", "not_found", "", "bad_request"}
+	for i, v := range resp.Items {
+		assert.Equal(t, wantCodes[i], v.Code)
+		if v.Code != "" {
+			assert.Nil(t, v.Metric)
+			assert.NotEmpty(t, v.Error)
+			continue
+		}
+		assert.Equal(t, v.MetricName, v.Metric.Id)
+		assert.NotEmpty(t, v.Metric.Hash)
+	}
+}
+
+func TestGetList(t *testing.T) {
+	s := newTestServer(t, "test")
+	resp, err := s.GetList(context.Background(), &pb.GetListMetricRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Metric, 2)
+	for _, v := range resp.Metric {
+		m, err := ConvertGRPCtoMetric(v)
+		require.NoError(t, err)
+		ok, err := m.CompareHash("test")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,55 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/colzphml/yandex_project/internal/metrics/proto"
+	"github.com/colzphml/yandex_project/internal/storage"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthServer - стандартный сервис проверки здоровья gRPC, статус которого определяется доступностью хранилища (Repositorier.Ping).
+type HealthServer struct {
+	*health.Server
+	Repo storage.Repositorier
+}
+
+// NewHealthServer - создает сервис проверки здоровья для хранилища.
+func NewHealthServer(repo storage.Repositorier) *HealthServer {
+	return &HealthServer{
+		Server: health.NewServer(),
+		Repo:   repo,
+	}
+}
+
+// Check - проверяет доступность хранилища и возвращает актуальный статус сервиса.
+func (h *HealthServer) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.Update(ctx)
+	return h.Server.Check(ctx, in)
+}
+
+// Update - обновляет статус сервера и сервиса метрик по результату проверки хранилища.
+func (h *HealthServer) Update(ctx context.Context) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := h.Repo.Ping(ctx); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.SetServingStatus("", status)
+	h.SetServingStatus(pb.Metrics_ServiceDesc.ServiceName, status)
+}
+
+// Run - периодически обновляет статус, чтобы подписчики Watch узнавали о недоступности хранилища без вызова Check.
+func (h *HealthServer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Update(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
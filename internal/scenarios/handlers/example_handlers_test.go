@@ -25,6 +25,17 @@ type Metrics struct {
 	Hash  string   `json:"hash,omitempty"`
 }
 
+type Problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	MetricID string            `json:"metric_id,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
 func HTTPGet(client *http.Client, url string, format string) (int, []byte, error) {
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -84,6 +95,7 @@ func HTTPServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage
 	h := handlers.New(ctx, repo, cfg)
 	r := chi.NewRouter()
 	r.Use(middleware.GzipHandle)
+	r.Use(middleware.ClientIP(cfg))
 	r.Use(middleware.SubNet(cfg))
 	r.Use(chimiddleware.RequestID)
 	r.Use(chimiddleware.RealIP)
@@ -95,7 +107,7 @@ func HTTPServer(ctx context.Context, cfg *serverutils.ServerConfig, repo storage
 		r.Use(middleware.RSAHandler(cfg))
 		r.Post("/", h.SaveJSONHandler)
 	})
-	r.Post("/updates/", h.SaveJSONArrayHandler)
+	r.With(middleware.RSAHandler(cfg)).Post("/updates/", h.SaveJSONArrayHandler)
 	r.Post("/value/", h.GetJSONValueHandler)
 	r.Get("/ping", h.PingHandler)
 	r.Get("/", h.ListMetricsHandler)
@@ -187,6 +199,23 @@ func Example() {
 	}
 	fmt.Printf("Name: %s, Type: %s, Value %v\n", m3.ID, m3.MType, *m3.Value)
 
+	// Get JSON metric with another type: error is returned as application/problem+json
+	url = "http://localhost:8080/value/"
+	postBodyM1, err = json.Marshal(Metrics{ID: "Custom1", MType: "counter"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	body, err = HTTPSendJSON(client, url, postBodyM1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var p Problem
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Status: %d, Code: %s, Metric: %s, Stored type: %s\n", p.Status, p.Code, p.MetricID, p.Details["stored_type"])
+
 	// Ping
 	url = "http://localhost:8080/ping"
 	code, _, err := HTTPGet(client, url, "text/plain")
@@ -209,5 +238,6 @@ func Example() {
 
 	// Output:
 	// Name: Custom1, Type: gauge, Value 77.7
+	// Status: 404, Code: not_found, Metric: Custom1, Stored type: gauge
 	// ping is OK
 }
@@ -4,16 +4,18 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
 	"github.com/colzphml/yandex_project/internal/metrics"
 	"github.com/colzphml/yandex_project/internal/metrics/metricsserver"
 	"github.com/colzphml/yandex_project/internal/scenarios"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
 	"github.com/colzphml/yandex_project/internal/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
@@ -21,6 +23,9 @@ import (
 
 var log = zerolog.New(serverutils.LogConfig()).With().Timestamp().Str("component", "handlers").Logger()
 
+// watchKeepAlive - интервал отправки комментария в поток Server-Sent Events, чтобы промежуточные прокси не закрывали соединение.
+const watchKeepAlive = 15 * time.Second
+
 type Handlers struct {
 	repo storage.Repositorier
 	cfg  *serverutils.ServerConfig
@@ -34,19 +39,62 @@ func New(ctx context.Context, repo storage.Repositorier, cfg *serverutils.Server
 	return result
 }
 
+// problem - описание ошибки в формате application/problem+json (RFC 7807), дополненное кодом ошибки сценария.
+type problem struct {
+	Type     string              `json:"type"`                // тип ошибки
+	Title    string              `json:"title"`               // краткое описание статуса ответа
+	Status   int                 `json:"status"`              // код статуса ответа
+	Detail   string              `json:"detail,omitempty"`    // описание ошибки для клиента
+	Instance string              `json:"instance,omitempty"`  // путь запроса, при обработке которого возникла ошибка
+	Code     scenarios.ErrorCode `json:"code"`                // код ошибки сценария
+	MetricID string              `json:"metric_id,omitempty"` // имя метрики, к которой относится ошибка
+	Details  map[string]string   `json:"details,omitempty"`   // дополнительные сведения об ошибке
+}
+
 func errMapping(err error) int {
-	switch {
-	case errors.Is(err, scenarios.ErrStatusBadRequest):
+	switch scenarios.AsError(err).Code {
+	case scenarios.CodeBadRequest, scenarios.CodeParseError, scenarios.CodeBadSignature, scenarios.CodeTypeConflict:
 		return http.StatusBadRequest
-	case errors.Is(err, scenarios.ErrStatusNotFound):
+	case scenarios.CodeNotFound:
 		return http.StatusNotFound
-	case errors.Is(err, scenarios.ErrStatusNotImplemented):
+	case scenarios.CodeNotImplemented:
 		return http.StatusNotImplemented
+	case scenarios.CodeQuotaExceeded:
+		return http.StatusForbidden
+	case scenarios.CodeRateLimited:
+		return http.StatusTooManyRequests
 	default:
 		return http.StatusInternalServerError
 	}
 }
 
+// WriteError - отвечает на запрос ошибкой в формате application/problem+json. Используется и в middleware, чтобы все ошибки HTTP отдавались в одном формате.
+func WriteError(rw http.ResponseWriter, r *http.Request, err error) {
+	se := scenarios.AsError(err)
+	code := errMapping(se)
+	if code == http.StatusInternalServerError {
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("request failed")
+	}
+	js, err := json.Marshal(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   se.Message,
+		Instance: r.URL.Path,
+		Code:     se.Code,
+		MetricID: se.MetricID,
+		Details:  se.Details,
+	})
+	if err != nil {
+		http.Error(rw, se.Message, code)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(code)
+	rw.Write(js)
+}
+
 // SaveHandler - хэндлер, сохраняющий метрику из URL.
 //
 // POST [/update/{metric_type}/{metric_name}/{metric_value}].
@@ -56,21 +104,17 @@ func (h Handlers) SaveHandler(rw http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "metric_type")
 	metricValue := chi.URLParam(r, "metric_value")
 	if metricName == "" || metricValue == "" {
-		http.Error(rw, "can't parse metric: "+r.URL.Path, http.StatusNotFound)
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeNotFound, metricName, "can't parse metric", nil))
 		return
 	}
 	mValue, err := metricsserver.ConvertToMetric(metricName, metricType, metricValue)
-	switch {
-	case errors.Is(err, metrics.ErrParseMetric):
-		http.Error(rw, err.Error()+" "+r.URL.Path, http.StatusBadRequest)
-		return
-	case errors.Is(err, metrics.ErrUndefinedType):
-		http.Error(rw, err.Error()+" "+r.URL.Path, http.StatusNotImplemented)
+	if err != nil {
+		WriteError(rw, r, scenarios.MetricError(metricName, err))
 		return
 	}
 	err = scenarios.SaveMetric(ctx, h.repo, h.cfg, mValue, false)
 	if err != nil {
-		http.Error(rw, err.Error()+" "+r.URL.Path, errMapping(err))
+		WriteError(rw, r, err)
 		return
 	}
 	rw.Header().Set("Content-Type", "text/plain")
@@ -85,12 +129,12 @@ func (h Handlers) SaveJSONHandler(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var m metrics.Metrics
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(rw, "can't decode metric: "+r.URL.Path, http.StatusBadRequest)
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't decode metric", err))
 		return
 	}
 	err := scenarios.SaveMetric(ctx, h.repo, h.cfg, m, true)
 	if err != nil {
-		http.Error(rw, err.Error()+" "+r.URL.Path, errMapping(err))
+		WriteError(rw, r, err)
 		return
 	}
 	rw.Header().Set("Content-Type", "text/plain")
@@ -100,23 +144,42 @@ func (h Handlers) SaveJSONHandler(rw http.ResponseWriter, r *http.Request) {
 
 // SaveJSONArrayHandler - хэндлер, сохраняющий массив метрик из body в формате JSON. Проверяет подпись данных.
 //
+// Возвращает JSON со статусом обработки каждой метрики: отклоненные метрики не мешают сохранению остальных.
+//
 // POST [/updates/].
 func (h Handlers) SaveJSONArrayHandler(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	var m []metrics.Metrics
-	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(rw, "can't decode metric: "+r.URL.Path, http.StatusBadRequest)
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't decode metrics", err))
 		return
 	}
-	count, err := scenarios.SaveArrayMetric(ctx, h.repo, h.cfg, m)
+	m := make([]metrics.Metrics, 0, len(raw))
+	var parseErrors []metrics.ItemStatus
+	for _, v := range raw {
+		var metric metrics.Metrics
+		if err := json.Unmarshal(v, &metric); err != nil {
+			parseErrors = append(parseErrors, metric.Status(metrics.StatusParseError, err))
+			continue
+		}
+		m = append(m, metric)
+	}
+	result, err := scenarios.SaveArrayMetric(ctx, h.repo, h.cfg, m)
 	if err != nil {
-		http.Error(rw, err.Error(), errMapping(err))
+		WriteError(rw, r, err)
 		return
 	}
-	rw.Header().Set("Content-Type", "text/plain")
+	for _, v := range parseErrors {
+		result.Add(v)
+	}
+	js, err := json.Marshal(result)
+	if err != nil {
+		WriteError(rw, r, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	fmt.Fprintf(rw, "Metric saved, count: %d", count)
-	//rw.Write([]byte("Metric saved, count: " + strconv.Itoa(count)))
+	rw.Write(js)
 }
 
 // ListMetricsHandler - возвращает список сохраненных метрик с их значением.
@@ -133,8 +196,7 @@ func (h Handlers) ListMetricsHandler(rw http.ResponseWriter, r *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 	_, err := io.WriteString(rw, strings.Join(result, "<br>"))
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		log.Error().Err(err).Msg("failed write metrics list")
 	}
 }
 
@@ -147,7 +209,7 @@ func (h Handlers) GetValueHandler(rw http.ResponseWriter, r *http.Request) {
 	mType := chi.URLParam(r, "metric_type")
 	metricValue, err := scenarios.GetMetric(ctx, h.repo, h.cfg, mName, mType, false)
 	if err != nil {
-		http.Error(rw, err.Error(), errMapping(err))
+		WriteError(rw, r, err)
 		return
 	}
 	rw.Header().Set("Content-Type", "text/plain")
@@ -163,21 +225,60 @@ func (h Handlers) GetJSONValueHandler(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var m metrics.Metrics
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(rw, "can't decode metric: "+r.URL.Path, http.StatusBadRequest)
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "can't decode metric", err))
 		return
 	}
 	metricValue, err := scenarios.GetMetric(ctx, h.repo, h.cfg, m.ID, m.MType, true)
 	if err != nil {
-		http.Error(rw, err.Error(), errMapping(err))
+		WriteError(rw, r, err)
+		return
+	}
+	js, err := json.Marshal(metricValue)
+	if err != nil {
+		WriteError(rw, r, err)
 		return
 	}
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	js, err := json.Marshal(metricValue)
+	rw.Write(js)
+}
+
+// SelfMetricsHandler - возвращает внутренние метрики сервера: статистику запросов по маршрутам и методам gRPC, вызовов хранилища и счетчики событий.
+//
+// GET [/debug/metrics].
+func (h Handlers) SelfMetricsHandler(rw http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(selfmetrics.Default.Snapshot())
+	if err != nil {
+		WriteError(rw, r, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(js)
+}
+
+// CardinalityHandler - возвращает отчет об ограничениях на количество метрик: общее количество метрик, ограничения и клиентов, создавших больше всего метрик.
+//
+// Параметр запроса top - количество клиентов в отчете, по умолчанию 10.
+//
+// GET [/debug/cardinality].
+func (h Handlers) CardinalityHandler(rw http.ResponseWriter, r *http.Request) {
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			WriteError(rw, r, scenarios.NewError(scenarios.CodeBadRequest, "", "top must be a positive number", err))
+			return
+		}
+		top = n
+	}
+	js, err := json.Marshal(scenarios.Quotas.Report(r.Context(), h.repo, h.cfg, top))
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		WriteError(rw, r, err)
 		return
 	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
 	rw.Write(js)
 }
 
@@ -188,7 +289,7 @@ func (h Handlers) PingHandler(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	err := h.repo.Ping(ctx)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeInternal, "", "storage is not available", err))
 		return
 	}
 	rw.Header().Set("Content-Type", "text/plain")
@@ -196,3 +297,55 @@ func (h Handlers) PingHandler(rw http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(rw, "ok")
 	//rw.Write([]byte("ok"))
 }
+
+// WatchHandler - отправляет клиенту поток Server-Sent Events с каждым принятым сервером обновлением метрики, подходящим под фильтр.
+//
+// Параметры запроса: name - регулярное выражение для имени метрики, type - тип метрики.
+//
+// GET [/watch].
+func (h Handlers) WatchHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		WriteError(rw, r, scenarios.NewError(scenarios.CodeInternal, "", "streaming is not supported", nil))
+		return
+	}
+	filter, err := scenarios.NewFilter(r.URL.Query().Get("name"), r.URL.Query().Get("type"))
+	if err != nil {
+		WriteError(rw, r, err)
+		return
+	}
+	updates, unsubscribe := scenarios.Updates.Subscribe(filter)
+	defer unsubscribe()
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+		case m, ok := <-updates:
+			if !ok {
+				return
+			}
+			if err := m.FillHash(h.cfg.Key); err != nil {
+				log.Error().Err(err).Msg("failed sign metric update")
+				continue
+			}
+			js, err := json.Marshal(m)
+			if err != nil {
+				log.Error().Err(err).Msg("failed marshal metric update")
+				continue
+			}
+			fmt.Fprintf(rw, "event: metric\ndata: %s\n\n", js)
+			flusher.Flush()
+		}
+	}
+}
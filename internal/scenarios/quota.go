@@ -0,0 +1,211 @@
+package scenarios
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	"github.com/colzphml/yandex_project/internal/storage"
+)
+
+// unknownClient - клиент, адрес которого не удалось определить.
+const unknownClient = "unknown"
+
+// WithClient - помечает контекст запроса адресом клиента (host или host:port). По адресу считаются метрики, созданные клиентом.
+func WithClient(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientKey, addr)
+}
+
+// Client - адрес клиента из контекста запроса, пустая строка - адрес не определен.
+func Client(ctx context.Context) string {
+	addr, _ := ctx.Value(clientKey).(string)
+	return addr
+}
+
+// clientGroup - клиент из контекста запроса: адрес, приведенный к подсети с префиксом из конфигурации.
+func clientGroup(ctx context.Context, cfg *serverutils.ServerConfig) string {
+	addr := Client(ctx)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return unknownClient
+	}
+	bits, prefix := 128, cfg.QuotaPrefixV6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, cfg.QuotaPrefixV4
+	}
+	if prefix <= 0 || prefix > bits {
+		prefix = bits
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return network.String()
+}
+
+// checkIDLength - проверяет длину имени метрики по ограничению хранилища.
+func checkIDLength(cfg *serverutils.ServerConfig, id string) *Error {
+	if cfg.MaxIDLength <= 0 || utf8.RuneCountInString(id) <= cfg.MaxIDLength {
+		return nil
+	}
+	return NewError(CodeBadRequest, id, "metric name is too long", nil).
+		WithDetail("max_id_length", strconv.Itoa(cfg.MaxIDLength))
+}
+
+// QuotaTracker - учет разных имен метрик в хранилище и клиентов, которые их создали, для ограничений MaxMetrics и MaxClientMetrics.
+//
+// Метрики, которые уже были в хранилище при первом обращении, учитываются в общем количестве, но не относятся ни к одному клиенту. Новое имя резервируется до сохранения и освобождается, если сохранить метрику не удалось. Обновления уже известных метрик не ограничиваются.
+type QuotaTracker struct {
+	mu       sync.Mutex
+	loaded   bool
+	owners   map[string]string // клиент, создавший метрику, по имени метрики
+	counts   map[string]int    // количество созданных метрик по клиенту
+	rejected map[string]int64  // количество отклоненных новых метрик по клиенту
+}
+
+// Quotas - учет метрик сервера для ограничений на их количество.
+var Quotas = NewQuotaTracker()
+
+// NewQuotaTracker - создает пустой учет метрик.
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{
+		owners:   make(map[string]string),
+		counts:   make(map[string]int),
+		rejected: make(map[string]int64),
+	}
+}
+
+// load - однократно учитывает метрики, уже сохраненные в хранилище. Внутренние метрики сервера не учитываются.
+//
+// Вызывается под блокировкой.
+func (q *QuotaTracker) load(ctx context.Context, repo storage.Repositorier) {
+	if q.loaded {
+		return
+	}
+	q.loaded = true
+	for _, v := range repo.ListMetrics(ctx) {
+		if !strings.HasPrefix(v.ID, selfmetrics.Prefix) {
+			if _, ok := q.owners[v.ID]; !ok {
+				q.owners[v.ID] = ""
+			}
+		}
+	}
+}
+
+// reserve - резервирует имя новой метрики за клиентом. Возвращает true, если имя новое и его нужно освободить при неудачном сохранении.
+func (q *QuotaTracker) reserve(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, id string) (bool, error) {
+	client := clientGroup(ctx, cfg)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load(ctx, repo)
+	if _, ok := q.owners[id]; ok {
+		return false, nil
+	}
+	var err *Error
+	switch {
+	case cfg.MaxMetrics > 0 && len(q.owners) >= cfg.MaxMetrics:
+		err = NewError(CodeQuotaExceeded, id, "too many metrics on server", nil).
+			WithDetail("scope", "server").
+			WithDetail("limit", strconv.Itoa(cfg.MaxMetrics))
+	case cfg.MaxClientMetrics > 0 && q.counts[client] >= cfg.MaxClientMetrics:
+		err = NewError(CodeQuotaExceeded, id, "too many metrics from client", nil).
+			WithDetail("scope", "client").
+			WithDetail("client", client).
+			WithDetail("limit", strconv.Itoa(cfg.MaxClientMetrics))
+	}
+	if err != nil {
+		q.rejected[client]++
+		selfmetrics.Default.Add(selfmetrics.QuotaRejected, 1)
+		return false, err
+	}
+	q.owners[id] = client
+	q.counts[client]++
+	return true, nil
+}
+
+// release - освобождает зарезервированное имя метрики, которую не удалось сохранить.
+func (q *QuotaTracker) release(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	client, ok := q.owners[id]
+	if !ok {
+		return
+	}
+	delete(q.owners, id)
+	if client == "" {
+		return
+	}
+	if q.counts[client]--; q.counts[client] <= 0 {
+		delete(q.counts, client)
+	}
+}
+
+// QuotaClient - количество метрик, созданных клиентом, и отклоненных новых метрик клиента.
+type QuotaClient struct {
+	Client   string `json:"client"`   // Адрес или подсеть клиента
+	Metrics  int    `json:"metrics"`  // Количество созданных метрик
+	Rejected int64  `json:"rejected"` // Количество отклоненных новых метрик
+}
+
+// QuotaReport - отчет об использовании ограничений на количество метрик.
+type QuotaReport struct {
+	Metrics          int           `json:"metrics"`            // Количество разных метрик в хранилище
+	MaxMetrics       int           `json:"max_metrics"`        // Ограничение на количество метрик, 0 - без ограничения
+	MaxClientMetrics int           `json:"max_client_metrics"` // Ограничение на количество метрик клиента, 0 - без ограничения
+	MaxIDLength      int           `json:"max_id_length"`      // Ограничение на длину имени метрики, 0 - без ограничения
+	Rejected         int64         `json:"rejected"`           // Количество отклоненных новых метрик
+	Top              []QuotaClient `json:"top"`                // Клиенты, создавшие больше всего метрик или получившие больше всего отказов
+}
+
+// Report - отчет с top клиентами, создавшими больше всего метрик.
+func (q *QuotaTracker) Report(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, top int) QuotaReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load(ctx, repo)
+	result := QuotaReport{
+		Metrics:          len(q.owners),
+		MaxMetrics:       cfg.MaxMetrics,
+		MaxClientMetrics: cfg.MaxClientMetrics,
+		MaxIDLength:      cfg.MaxIDLength,
+		Top:              make([]QuotaClient, 0, len(q.counts)),
+	}
+	clients := make(map[string]*QuotaClient)
+	client := func(name string) *QuotaClient {
+		c, ok := clients[name]
+		if !ok {
+			c = &QuotaClient{Client: name}
+			clients[name] = c
+		}
+		return c
+	}
+	for name, n := range q.counts {
+		client(name).Metrics = n
+	}
+	for name, n := range q.rejected {
+		client(name).Rejected = n
+		result.Rejected += n
+	}
+	for _, c := range clients {
+		result.Top = append(result.Top, *c)
+	}
+	sort.Slice(result.Top, func(i, j int) bool {
+		a, b := result.Top[i], result.Top[j]
+		if a.Metrics != b.Metrics {
+			return a.Metrics > b.Metrics
+		}
+		if a.Rejected != b.Rejected {
+			return a.Rejected > b.Rejected
+		}
+		return a.Client < b.Client
+	})
+	if top > 0 && len(result.Top) > top {
+		result.Top = result.Top[:top]
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package scenarios
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// isolateQuotas - подменяет учет метрик на время теста.
+func isolateQuotas(t *testing.T) {
+	quotas := Quotas
+	Quotas = NewQuotaTracker()
+	t.Cleanup(func() {
+		Quotas = quotas
+	})
+}
+
+func TestClientGroup(t *testing.T) {
+	cfg := &serverutils.ServerConfig{QuotaPrefixV4: 24, QuotaPrefixV6: 64}
+	tests := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{name: "Test #1: ipv4 with port", addr: "10.0.1.17:5432", want: "10.0.1.0/24"},
+		{name: "Test #2: ipv4", addr: "10.0.1.200", want: "10.0.1.0/24"},
+		{name: "Test #3: ipv6 with port", addr: "[2001:db8:1:2::7]:80", want: "2001:db8:1:2::/64"},
+		{name: "Test #4: not address", addr: "agent", want: unknownClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, clientGroup(WithClient(context.Background(), tt.addr), cfg))
+		})
+	}
+	assert.Equal(t, "10.0.1.17/32", clientGroup(WithClient(context.Background(), "10.0.1.17"), &serverutils.ServerConfig{}))
+}
+
+func TestQuotas(t *testing.T) {
+	isolateQuotas(t)
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute, MaxMetrics: 4, MaxClientMetrics: 2, MaxIDLength: 10}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	value := 1.0
+	gauge := func(id string) metrics.Metrics {
+		return metrics.Metrics{ID: id, MType: "gauge", Value: &value}
+	}
+	// метрика из хранилища учитывается в общем количестве
+	require.NoError(t, repo.SaveMetric(context.Background(), gauge("Existing")))
+	agent1 := WithClient(context.Background(), "10.0.0.1:1000")
+	agent2 := WithClient(context.Background(), "10.0.0.2:1000")
+
+	result, err := SaveArrayMetric(agent1, repo, cfg, []metrics.Metrics{gauge("A1"), gauge("A2"), gauge("A3"), gauge("A1"), gauge(strings.Repeat("x", 11))})
+	require.NoError(t, err)
+	statuses := make(map[string]string)
+	for _, v := range result.Items {
+		statuses[v.ID] = v.Status
+	}
+	assert.Equal(t, map[string]string{
+		"A1":                    metrics.StatusAccepted,
+		"A2":                    metrics.StatusAccepted,
+		"A3":                    metrics.StatusQuotaExceeded,
+		strings.Repeat("x", 11): metrics.StatusParseError,
+	}, statuses)
+
+	// обновление известной метрики не ограничивается
+	require.NoError(t, SaveMetric(agent1, repo, cfg, gauge("A2"), false))
+	require.NoError(t, SaveMetric(agent2, repo, cfg, gauge("B1"), false))
+	err = SaveMetric(agent2, repo, cfg, gauge("B2"), false)
+	se := AsError(err)
+	require.Equal(t, CodeQuotaExceeded, se.Code)
+	assert.Equal(t, "server", se.Details["scope"])
+	assert.NotContains(t, repo.DB, "B2")
+
+	report := Quotas.Report(context.Background(), repo, cfg, 1)
+	assert.Equal(t, 4, report.Metrics)
+	assert.Equal(t, int64(2), report.Rejected)
+	assert.Equal(t, []QuotaClient{{Client: "10.0.0.1/32", Metrics: 2, Rejected: 1}}, report.Top)
+	assert.Len(t, Quotas.Report(context.Background(), repo, cfg, 10).Top, 2)
+}
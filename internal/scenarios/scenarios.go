@@ -4,82 +4,231 @@ package scenarios
 import (
 	"context"
 	"errors"
-	"fmt"
+	"strings"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
 	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
 	"github.com/colzphml/yandex_project/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
-// Ошибки при работе с данными
-var (
-	ErrStatusNotFound            = errors.New("status not found (404)")
-	ErrStatusBadRequest          = errors.New("wrong request (400)")
-	ErrStatusNotImplemented      = errors.New("wrong type (501)")
-	ErrStatusInternalServerError = errors.New("internal server error(500)")
+// ctxKey - тип ключей контекста, которые использует пакет.
+type ctxKey int
+
+// Ключи контекста пакета.
+const (
+	signedBodyKey ctxKey = iota // признак проверенной подписи всего тела запроса
+	clientKey                   // адрес клиента, отправившего метрики
 )
 
-func SaveMetric(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, metric metrics.Metrics, sign bool) error {
-	if sign {
+// WithSignedBody - помечает контекст запроса: подпись всего тела уже проверена, поэтому подписи отдельных метрик не проверяются.
+func WithSignedBody(ctx context.Context) context.Context {
+	return context.WithValue(ctx, signedBodyKey, true)
+}
+
+// SignedBody - возвращает true, если подпись всего тела запроса уже проверена.
+func SignedBody(ctx context.Context) bool {
+	signed, _ := ctx.Value(signedBodyKey).(bool)
+	return signed
+}
+
+// errReservedName - ошибка сохранения метрики с зарезервированным для внутренних метрик сервера префиксом имени.
+var errReservedName = errors.New("metric name prefix " + selfmetrics.Prefix + " is reserved")
+
+// SaveMetric - сохраняет отдельную метрику. При sign == true проверяет подпись метрики, если не была проверена подпись всего тела запроса.
+//
+// Перед сохранением к метрике применяются правила обработки из конфигурации. Отброшенная правилами метрика считается принятой. Новая метрика сверх ограничений на количество метрик отклоняется с кодом quota_exceeded.
+func SaveMetric(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, metric metrics.Metrics, sign bool) (err error) {
+	defer func() {
+		if err != nil {
+			selfmetrics.Default.Add(selfmetrics.IngestRejected, 1)
+			return
+		}
+		selfmetrics.Default.Add(selfmetrics.IngestAccepted, 1)
+	}()
+	if err := metric.Validate(); err != nil {
+		return MetricError(metric.ID, err)
+	}
+	if strings.HasPrefix(metric.ID, selfmetrics.Prefix) {
+		return NewError(CodeBadRequest, metric.ID, errReservedName.Error(), nil)
+	}
+	if sign && !SignedBody(ctx) {
 		compareHash, err := metric.CompareHash(cfg.Key)
 		if err != nil {
-			return ErrStatusInternalServerError
+			selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+			return NewError(CodeBadSignature, metric.ID, "can't check signature", err)
 		}
 		if !compareHash {
-			return fmt.Errorf("signature is wrong: %w", ErrStatusBadRequest)
+			selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+			return NewError(CodeBadSignature, metric.ID, "signature is wrong", nil)
 		}
 	}
-	err := repo.SaveMetric(ctx, metric)
+	id := metric.ID
+	metric, keep, commit := cfg.Relabel.Prepare(metric)
+	if !keep {
+		return nil
+	}
+	// правила могут переименовать метрику в зарезервированное имя
+	if strings.HasPrefix(metric.ID, selfmetrics.Prefix) {
+		return NewError(CodeBadRequest, id, errReservedName.Error(), nil)
+	}
+	if err := checkIDLength(cfg, metric.ID); err != nil {
+		return err
+	}
+	reserved, err := Quotas.reserve(ctx, repo, cfg, metric.ID)
 	if err != nil {
-		return ErrStatusBadRequest
+		return err
 	}
+	err = repo.SaveMetric(ctx, metric)
+	if err != nil {
+		if reserved {
+			Quotas.release(metric.ID)
+		}
+		return MetricError(id, err)
+	}
+	commit()
+	Updates.Publish(storedValues(ctx, repo, metric)...)
 	if cfg.StoreInterval.Nanoseconds() == 0 {
 		err = repo.DumpMetrics(ctx, cfg)
 		if err != nil {
-			return ErrStatusInternalServerError
+			return NewError(CodeInternal, "", "can't dump metrics", err)
 		}
 	}
 	return nil
 }
 
-func SaveArrayMetric(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, metrics []metrics.Metrics) (int, error) {
-	for _, v := range metrics {
-		compareHash, err := v.CompareHash(cfg.Key)
+// storedValues - значения сохраненных метрик для рассылки подписчикам. В запросе для счетчика передается приращение, поэтому его значение читается из хранилища. Если подписчиков нет, хранилище не читается.
+func storedValues(ctx context.Context, repo storage.Repositorier, list ...metrics.Metrics) []metrics.Metrics {
+	if !Updates.Active() {
+		return nil
+	}
+	result := make([]metrics.Metrics, 0, len(list))
+	for _, m := range list {
+		if m.MType == "counter" {
+			stored, err := repo.GetValue(ctx, m.ID)
+			if err != nil {
+				log.Error().Err(err).Str("metric", m.ID).Msg("can't read saved counter for watch")
+				continue
+			}
+			m = stored
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// SaveArrayMetric - сохраняет пакет метрик и возвращает статус обработки по каждой метрике.
+//
+// Метрики с ошибкой разбора или неверной подписью отклоняются, к остальным применяются правила обработки из конфигурации и они сохраняются. Отброшенные правилами метрики считаются принятыми. Новые метрики сверх ограничений на количество метрик отклоняются со статусом quota_exceeded.
+func SaveArrayMetric(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, metricList []metrics.Metrics) (result metrics.BatchResult, err error) {
+	defer func() {
 		if err != nil {
-			return 0, ErrStatusInternalServerError
+			selfmetrics.Default.Add(selfmetrics.IngestRejected, int64(len(metricList)))
+			return
 		}
-		if !compareHash {
-			return 0, ErrStatusBadRequest
+		selfmetrics.Default.Add(selfmetrics.IngestAccepted, int64(result.Accepted))
+		selfmetrics.Default.Add(selfmetrics.IngestRejected, int64(result.Rejected))
+	}()
+	valid := make([]metrics.Metrics, 0, len(metricList))
+	origin := make([]metrics.Metrics, 0, len(metricList))
+	reserved := make([]bool, 0, len(metricList))
+	commits := make([]func(), 0, len(metricList))
+	for _, v := range metricList {
+		if err := v.Validate(); err != nil {
+			result.Add(v.Status(metrics.StatusParseError, err))
+			continue
+		}
+		if strings.HasPrefix(v.ID, selfmetrics.Prefix) {
+			result.Add(v.Status(metrics.StatusParseError, errReservedName))
+			continue
+		}
+		if !SignedBody(ctx) {
+			compareHash, err := v.CompareHash(cfg.Key)
+			if err != nil {
+				selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+				result.Add(v.Status(metrics.StatusBadSignature, err))
+				continue
+			}
+			if !compareHash {
+				selfmetrics.Default.Add(selfmetrics.SignatureFailures, 1)
+				result.Add(v.Status(metrics.StatusBadSignature, errors.New("signature is wrong")))
+				continue
+			}
+		}
+		m, keep, commit := cfg.Relabel.Prepare(v)
+		if !keep {
+			result.Add(v.Status(metrics.StatusAccepted, nil))
+			continue
+		}
+		if strings.HasPrefix(m.ID, selfmetrics.Prefix) {
+			result.Add(v.Status(metrics.StatusParseError, errReservedName))
+			continue
 		}
+		if err := checkIDLength(cfg, m.ID); err != nil {
+			result.Add(v.Status(metrics.StatusParseError, err))
+			continue
+		}
+		isNew, err := Quotas.reserve(ctx, repo, cfg, m.ID)
+		if err != nil {
+			result.Add(v.Status(metrics.StatusQuotaExceeded, err))
+			continue
+		}
+		valid = append(valid, m)
+		origin = append(origin, v)
+		reserved = append(reserved, isNew)
+		commits = append(commits, commit)
+	}
+	if len(valid) == 0 {
+		return result, nil
 	}
-	count, err := repo.SaveListMetric(ctx, metrics)
+	statuses, err := repo.SaveListMetric(ctx, valid)
 	if err != nil {
+		for i, v := range valid {
+			if reserved[i] {
+				Quotas.release(v.ID)
+			}
+		}
 		log.Error().Err(err).Msg("can't save metric")
-		return 0, ErrStatusBadRequest
+		return metrics.BatchResult{}, NewError(CodeInternal, "", "can't save metrics", err)
+	}
+	accepted := make([]metrics.Metrics, 0, len(statuses))
+	for i, v := range statuses {
+		// статус возвращается под именем и типом из запроса, чтобы клиент сопоставил его с отправленной метрикой
+		v.ID, v.MType = origin[i].ID, origin[i].MType
+		result.Add(v)
+		if v.Status == metrics.StatusAccepted {
+			accepted = append(accepted, valid[i])
+			commits[i]()
+		} else if reserved[i] {
+			Quotas.release(valid[i].ID)
+		}
 	}
+	Updates.Publish(storedValues(ctx, repo, accepted...)...)
 	if cfg.StoreInterval.Nanoseconds() == 0 {
 		err = repo.DumpMetrics(ctx, cfg)
 		if err != nil {
-			return 0, ErrStatusInternalServerError
+			return metrics.BatchResult{}, NewError(CodeInternal, "", "can't dump metrics", err)
 		}
 	}
-	return count, nil
+	return result, nil
 }
 
+// GetMetric - возвращает метрику по имени и типу. При sign == true заполняет подпись метрики.
 func GetMetric(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig, name string, mtype string, sign bool) (metrics.Metrics, error) {
 	metricValue, err := repo.GetValue(ctx, name)
 	if err != nil {
-		return metrics.Metrics{}, ErrStatusNotFound
+		return metrics.Metrics{}, NewError(CodeNotFound, name, "metric not found", err)
 	}
 	if metricValue.MType != mtype {
-		return metrics.Metrics{}, fmt.Errorf("this metric have another type: %w", ErrStatusNotFound)
+		return metrics.Metrics{}, NewError(CodeNotFound, name, "this metric have another type", nil).
+			WithDetail("requested_type", mtype).
+			WithDetail("stored_type", metricValue.MType)
 	}
 	if sign {
 		err = metricValue.FillHash(cfg.Key)
 		if err != nil {
-
-			return metrics.Metrics{}, ErrStatusInternalServerError
+			return metrics.Metrics{}, NewError(CodeInternal, name, "can't sign metric", err)
 		}
 	}
 	return metricValue, nil
@@ -0,0 +1,105 @@
+package scenarios
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveRelabel(t *testing.T) {
+	pipeline, err := metrics.NewPipeline([]metrics.RelabelRule{
+		{Action: metrics.RelabelDrop, Regex: "RandomValue"},
+		{Action: metrics.RelabelConvert, Regex: "Alloc", Unit: "bytes_to_mib"},
+		{Action: metrics.RelabelPrefix, Prefix: "agent1."},
+	})
+	require.NoError(t, err)
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute, Relabel: pipeline}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	alloc, random, load := float64(1<<21), 0.5, 1.5
+	poll := int64(3)
+
+	result, err := SaveArrayMetric(context.Background(), repo, cfg, []metrics.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &alloc},
+		{ID: "RandomValue", MType: "gauge", Value: &random},
+		{ID: "PollCount", MType: "counter", Delta: &poll},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Accepted)
+	var ids []string
+	for _, v := range result.Items {
+		ids = append(ids, v.ID)
+	}
+	assert.ElementsMatch(t, []string{"Alloc", "RandomValue", "PollCount"}, ids)
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "Load1", MType: "gauge", Value: &load}, false))
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "RandomValue", MType: "gauge", Value: &random}, false))
+
+	assert.Len(t, repo.DB, 3)
+	assert.Equal(t, 2.0, *repo.DB["agent1.Alloc"].Value)
+	assert.Equal(t, int64(3), *repo.DB["agent1.PollCount"].Delta)
+	assert.Equal(t, 1.5, *repo.DB["agent1.Load1"].Value)
+}
+
+func TestSaveRelabelReservedName(t *testing.T) {
+	pipeline, err := metrics.NewPipeline([]metrics.RelabelRule{{Action: metrics.RelabelPrefix, Regex: "Internal.*", Prefix: "_server."}})
+	require.NoError(t, err)
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute, Relabel: pipeline}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	value := 1.0
+
+	err = SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "InternalLoad", MType: "gauge", Value: &value}, false)
+	assert.Equal(t, CodeBadRequest, AsError(err).Code)
+	result, err := SaveArrayMetric(context.Background(), repo, cfg, []metrics.Metrics{{ID: "InternalLoad", MType: "gauge", Value: &value}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Rejected)
+	assert.Equal(t, metrics.StatusParseError, result.Items[0].Status)
+	assert.Empty(t, repo.DB)
+}
+
+func TestSaveRelabelCarryAfterSave(t *testing.T) {
+	isolateQuotas(t)
+	pipeline, err := metrics.NewPipeline([]metrics.RelabelRule{{Action: metrics.RelabelConvert, Regex: "Bytes.*", Unit: "bytes_to_kib"}})
+	require.NoError(t, err)
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute, Relabel: pipeline, MaxMetrics: 1}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	value := 1.0
+	rejected, accepted := int64(768), int64(512)
+
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "Load", MType: "gauge", Value: &value}, false))
+	assert.Error(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "BytesSent", MType: "counter", Delta: &rejected}, false))
+	result, err := SaveArrayMetric(context.Background(), repo, cfg, []metrics.Metrics{{ID: "BytesSent", MType: "counter", Delta: &rejected}})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.StatusQuotaExceeded, result.Items[0].Status)
+
+	cfg.MaxMetrics = 0
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "BytesSent", MType: "counter", Delta: &accepted}, false))
+	assert.Equal(t, int64(0), *repo.DB["BytesSent"].Delta, "remainder of rejected deltas is not carried")
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "BytesSent", MType: "counter", Delta: &accepted}, false))
+	assert.Equal(t, int64(1), *repo.DB["BytesSent"].Delta, "remainder of saved deltas is carried")
+}
+
+func TestSavePublishStoredCounter(t *testing.T) {
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	updates, unsubscribe := Updates.Subscribe(Filter{MType: "counter"})
+	defer unsubscribe()
+	first, second := int64(3), int64(4)
+
+	require.NoError(t, SaveMetric(context.Background(), repo, cfg, metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &first}, false))
+	_, err = SaveArrayMetric(context.Background(), repo, cfg, []metrics.Metrics{{ID: "PollCount", MType: "counter", Delta: &second}})
+	require.NoError(t, err)
+
+	got := <-updates
+	assert.Equal(t, int64(3), *got.Delta)
+	got = <-updates
+	assert.Equal(t, int64(7), *got.Delta, "subscriber gets the stored counter, not the delta from the request")
+}
@@ -0,0 +1,44 @@
+package scenarios
+
+import (
+	"context"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	"github.com/colzphml/yandex_project/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// StoreSelfMetrics - записывает текущие внутренние метрики сервера в хранилище под префиксом selfmetrics.Prefix.
+//
+// Метрики записываются в обход SaveArrayMetric: проверка подписи и запрет префикса для них не нужны, а подписчики Watch их не получают. Метрики с именем длиннее cfg.MaxIDLength не записываются.
+func StoreSelfMetrics(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig) error {
+	statuses, err := repo.SaveListMetric(ctx, selfmetrics.Default.Snapshot().Metrics(cfg.MaxIDLength))
+	if err != nil {
+		return NewError(CodeInternal, "", "can't save self metrics", err)
+	}
+	for _, v := range statuses {
+		if v.Status != metrics.StatusAccepted {
+			log.Warn().Str("metric", v.ID).Str("status", v.Status).Str("error", v.Error).Msg("self metric not saved")
+		}
+	}
+	return nil
+}
+
+// SelfMetricsWorker - периодически записывает внутренние метрики сервера в хранилище с интервалом cfg.SelfMetricsInterval.
+func SelfMetricsWorker(ctx context.Context, repo storage.Repositorier, cfg *serverutils.ServerConfig) {
+	ticker := time.NewTicker(cfg.SelfMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := StoreSelfMetrics(ctx, repo, cfg); err != nil {
+				log.Error().Err(err).Msg("failed store self metrics")
+			}
+		}
+	}
+}
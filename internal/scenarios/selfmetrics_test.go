@@ -0,0 +1,40 @@
+package scenarios
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+	"github.com/colzphml/yandex_project/internal/storage/filerepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreSelfMetrics(t *testing.T) {
+	cfg := &serverutils.ServerConfig{StoreInterval: time.Minute}
+	repo, err := filerepo.NewMetricRepo(cfg)
+	require.NoError(t, err)
+	value := 7.77
+	reserved := metrics.Metrics{ID: selfmetrics.Prefix + "Alloc", MType: "gauge", Value: &value}
+
+	err = SaveMetric(context.Background(), repo, cfg, reserved, false)
+	assert.Equal(t, CodeBadRequest, AsError(err).Code)
+	result, err := SaveArrayMetric(context.Background(), repo, cfg, []metrics.Metrics{reserved})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Rejected)
+	assert.Empty(t, repo.DB)
+
+	cfg.MaxIDLength = 30
+	require.NoError(t, StoreSelfMetrics(context.Background(), repo, cfg))
+	require.NotEmpty(t, repo.DB)
+	for k, v := range repo.DB {
+		assert.True(t, strings.HasPrefix(k, selfmetrics.Prefix))
+		assert.Equal(t, "gauge", v.MType)
+		assert.LessOrEqual(t, len(k), cfg.MaxIDLength, "configured id length limit applies to self metrics")
+	}
+	assert.Contains(t, repo.DB, selfmetrics.Prefix+"ingest.rejected.total")
+}
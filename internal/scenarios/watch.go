@@ -0,0 +1,128 @@
+package scenarios
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// watchBuffer - размер очереди обновлений одного подписчика. Если подписчик не успевает читать, новые обновления для него отбрасываются.
+const watchBuffer = 256
+
+// Updates - брокер принятых обновлений метрик. Заполняется из SaveMetric и SaveArrayMetric, на него подписываются потоки Watch.
+var Updates = NewBroker()
+
+// Filter - фильтр обновлений для подписчика.
+type Filter struct {
+	Name  *regexp.Regexp // Регулярное выражение для имени метрики, nil - любое имя
+	MType string         // Тип метрики, пустая строка - любой тип
+}
+
+// NewFilter - создает фильтр обновлений по регулярному выражению для имени и типу метрики.
+func NewFilter(name string, mtype string) (Filter, error) {
+	filter := Filter{MType: mtype}
+	if name != "" {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return Filter{}, NewError(CodeBadRequest, "", "can't parse name filter", err)
+		}
+		filter.Name = re
+	}
+	return filter, nil
+}
+
+// Match - проверяет, подходит ли метрика под фильтр.
+func (f Filter) Match(m metrics.Metrics) bool {
+	if f.MType != "" && f.MType != m.MType {
+		return false
+	}
+	if f.Name != nil && !f.Name.MatchString(m.ID) {
+		return false
+	}
+	return true
+}
+
+// subscriber - подписчик брокера.
+type subscriber struct {
+	filter  Filter
+	updates chan metrics.Metrics
+}
+
+// Broker - рассылает принятые обновления метрик подписчикам.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+// NewBroker - создает брокер обновлений метрик.
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Subscribe - подписывает на обновления, подходящие под фильтр. Возвращает канал обновлений и функцию отписки.
+//
+// Канал закрывается при отписке или закрытии брокера.
+func (b *Broker) Subscribe(filter Filter) (<-chan metrics.Metrics, func()) {
+	sub := &subscriber{
+		filter:  filter,
+		updates: make(chan metrics.Metrics, watchBuffer),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.updates)
+		return sub.updates, func() {}
+	}
+	b.subscribers[sub] = struct{}{}
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.updates)
+		}
+	}
+	return sub.updates, unsubscribe
+}
+
+// Active - проверяет, есть ли у брокера подписчики.
+func (b *Broker) Active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+// Publish - рассылает обновления подписчикам. Не блокируется на медленных подписчиках.
+func (b *Broker) Publish(list ...metrics.Metrics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		for _, m := range list {
+			if !sub.filter.Match(m) {
+				continue
+			}
+			m.Hash = ""
+			select {
+			case sub.updates <- m:
+			default:
+				log.Warn().Str("metric", m.ID).Msg("watch subscriber is too slow, update dropped")
+			}
+		}
+	}
+}
+
+// Close - закрывает каналы всех подписчиков. Используется при остановке сервера, чтобы завершить долгоживущие подписки.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.updates)
+	}
+}
@@ -0,0 +1,75 @@
+package scenarios
+
+import (
+	"testing"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	value := 7.77
+	delta := int64(7)
+	alloc := metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &value, Hash: "hash"}
+	poll := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
+	tests := []struct {
+		name    string
+		filter  string
+		mtype   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Test #1: without filter",
+			want: []string{"Alloc", "PollCount"},
+		},
+		{
+			name:   "Test #2: filter by name",
+			filter: "^Poll",
+			want:   []string{"PollCount"},
+		},
+		{
+			name:  "Test #3: filter by type",
+			mtype: "gauge",
+			want:  []string{"Alloc"},
+		},
+		{
+			name:    "Test #4: wrong regexp",
+			filter:  "(",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewFilter(tt.filter, tt.mtype)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			b := NewBroker()
+			updates, unsubscribe := b.Subscribe(filter)
+			b.Publish(alloc, poll)
+			unsubscribe()
+			var got []string
+			for m := range updates {
+				assert.Empty(t, m.Hash)
+				got = append(got, m.ID)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := NewBroker()
+	updates, unsubscribe := b.Subscribe(Filter{})
+	b.Close()
+	_, ok := <-updates
+	assert.False(t, ok)
+	unsubscribe()
+	updates, _ = b.Subscribe(Filter{})
+	_, ok = <-updates
+	assert.False(t, ok)
+}
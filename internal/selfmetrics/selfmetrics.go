@@ -0,0 +1,235 @@
+// Package selfmetrics содержит внутренние метрики работы сервера и агента: количество и длительность вызовов, счетчики событий.
+package selfmetrics
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/colzphml/yandex_project/internal/metrics"
+)
+
+// Prefix - зарезервированный префикс имен внутренних метрик в хранилище сервера. Клиенты не могут сохранять метрики с таким префиксом.
+const Prefix = "_server."
+
+// rateWindow - окно, за которое считается скорость событий счетчика, в секундах.
+const rateWindow = 60
+
+// Имена счетчиков событий.
+const (
+	IngestAccepted    = "ingest accepted"    // Принятые сервером метрики
+	IngestRejected    = "ingest rejected"    // Отклоненные сервером метрики
+	SignatureFailures = "signature failures" // Запросы и метрики с неверной подписью
+	QuotaRejected     = "quota rejected"     // Новые метрики, отклоненные из-за ограничений на количество метрик
+	RateLimited       = "rate limited"       // Запросы, отклоненные из-за ограничения частоты запросов клиента
+)
+
+// Default - реестр внутренних метрик сервера.
+var Default = NewRegistry()
+
+// Stat - статистика вызовов одной операции.
+type Stat struct {
+	Count  int64         // Количество вызовов
+	Errors int64         // Количество вызовов, завершившихся ошибкой
+	Total  time.Duration // Суммарная длительность вызовов
+	Max    time.Duration // Максимальная длительность вызова
+}
+
+// Avg - средняя длительность вызова.
+func (s Stat) Avg() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// MarshalJSON - сериализует статистику с длительностями в миллисекундах.
+func (s Stat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count   int64   `json:"count"`
+		Errors  int64   `json:"errors"`
+		AvgMs   float64 `json:"avg_ms"`
+		MaxMs   float64 `json:"max_ms"`
+		TotalMs float64 `json:"total_ms"`
+	}{
+		Count:   s.Count,
+		Errors:  s.Errors,
+		AvgMs:   milliseconds(s.Avg()),
+		MaxMs:   milliseconds(s.Max),
+		TotalMs: milliseconds(s.Total),
+	})
+}
+
+// Counter - значение счетчика событий.
+type Counter struct {
+	Total int64   `json:"total"` // Количество событий с момента запуска
+	Rate  float64 `json:"rate"`  // Среднее количество событий в секунду за последнюю минуту
+}
+
+// Snapshot - копия состояния реестра.
+type Snapshot struct {
+	Uptime   time.Duration      `json:"-"`
+	Calls    map[string]Stat    `json:"calls"`    // Статистика вызовов по операциям
+	Counters map[string]Counter `json:"counters"` // Счетчики событий
+}
+
+// MarshalJSON - сериализует копию состояния с временем работы в секундах.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	type snapshotAlias Snapshot
+	return json.Marshal(struct {
+		UptimeSeconds float64 `json:"uptime_seconds"`
+		snapshotAlias
+	}{
+		UptimeSeconds: s.Uptime.Seconds(),
+		snapshotAlias: snapshotAlias(s),
+	})
+}
+
+// counter - счетчик событий с поминутной скоростью по секундным интервалам.
+type counter struct {
+	total   int64
+	buckets [rateWindow]int64
+	seconds [rateWindow]int64
+}
+
+// add - учитывает n событий в момент now.
+func (c *counter) add(now time.Time, n int64) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	if c.seconds[i] != sec {
+		c.seconds[i] = sec
+		c.buckets[i] = 0
+	}
+	c.buckets[i] += n
+	c.total += n
+}
+
+// rate - среднее количество событий в секунду за последнюю минуту до момента now.
+func (c *counter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var sum int64
+	for i := range c.buckets {
+		if sec-c.seconds[i] < rateWindow {
+			sum += c.buckets[i]
+		}
+	}
+	return float64(sum) / rateWindow
+}
+
+// Registry - потокобезопасный реестр статистики вызовов и счетчиков событий.
+type Registry struct {
+	mu       sync.Mutex
+	started  time.Time
+	stats    map[string]*Stat
+	counters map[string]*counter
+}
+
+// NewRegistry - создает пустой реестр.
+func NewRegistry() *Registry {
+	return &Registry{
+		started:  time.Now(),
+		stats:    make(map[string]*Stat),
+		counters: make(map[string]*counter),
+	}
+}
+
+// Observe - учитывает вызов операции name длительностью d.
+func (r *Registry) Observe(name string, d time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stat, ok := r.stats[name]
+	if !ok {
+		stat = &Stat{}
+		r.stats[name] = stat
+	}
+	stat.Count++
+	if failed {
+		stat.Errors++
+	}
+	stat.Total += d
+	if d > stat.Max {
+		stat.Max = d
+	}
+}
+
+// Add - увеличивает счетчик событий name на n.
+func (r *Registry) Add(name string, n int64) {
+	if n == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.counters[name]
+	if !ok {
+		c = &counter{}
+		r.counters[name] = c
+	}
+	c.add(time.Now(), n)
+}
+
+// Snapshot - возвращает копию текущего состояния реестра.
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	result := Snapshot{
+		Uptime:   now.Sub(r.started),
+		Calls:    make(map[string]Stat, len(r.stats)),
+		Counters: make(map[string]Counter, len(r.counters)),
+	}
+	for k, v := range r.stats {
+		result.Calls[k] = *v
+	}
+	for k, v := range r.counters {
+		result.Counters[k] = Counter{Total: v.total, Rate: v.rate(now)}
+	}
+	return result
+}
+
+// placeholderRe - параметры в шаблонах маршрутов chi.
+var placeholderRe = regexp.MustCompile(`\{[^}]*\}`)
+
+// nameRe - символы, недопустимые в имени метрики.
+var nameRe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// MetricID - превращает имя операции или счетчика в имя метрики с префиксом Prefix, например "http POST /value/{metric_type}/{metric_name}" в "_server.http.POST.value._._".
+func MetricID(name string) string {
+	name = placeholderRe.ReplaceAllString(name, "_")
+	name = strings.Trim(nameRe.ReplaceAllString(name, "."), ".")
+	return Prefix + name
+}
+
+// Metrics - превращает копию состояния в набор метрик gauge для записи в хранилище сервера.
+//
+// Метрики с именем длиннее maxIDLength символов не возвращаются, 0 - без ограничения.
+func (s Snapshot) Metrics(maxIDLength int) []metrics.Metrics {
+	var result []metrics.Metrics
+	gauge := func(id string, value float64) {
+		if maxIDLength > 0 && utf8.RuneCountInString(id) > maxIDLength {
+			return
+		}
+		result = append(result, metrics.Metrics{ID: id, MType: "gauge", Value: &value})
+	}
+	gauge(Prefix+"uptime_seconds", s.Uptime.Seconds())
+	for k, v := range s.Calls {
+		id := MetricID(k)
+		gauge(id+".count", float64(v.Count))
+		gauge(id+".errors", float64(v.Errors))
+		gauge(id+".avg_ms", milliseconds(v.Avg()))
+		gauge(id+".max_ms", milliseconds(v.Max))
+	}
+	for k, v := range s.Counters {
+		id := MetricID(k)
+		gauge(id+".total", float64(v.Total))
+		gauge(id+".rate", v.Rate)
+	}
+	return result
+}
+
+// milliseconds - длительность в миллисекундах.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,83 @@
+package selfmetrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Observe("test", time.Second, false)
+	r.Observe("test", 3*time.Second, true)
+	r.Add(IngestAccepted, 30)
+	r.Add(IngestAccepted, 0)
+	snapshot := r.Snapshot()
+	assert.Equal(t, Stat{Count: 2, Errors: 1, Total: 4 * time.Second, Max: 3 * time.Second}, snapshot.Calls["test"])
+	assert.Equal(t, 2*time.Second, snapshot.Calls["test"].Avg())
+	assert.Equal(t, Counter{Total: 30, Rate: 0.5}, snapshot.Counters[IngestAccepted])
+	r.Observe("test", time.Second, false)
+	assert.Equal(t, int64(2), snapshot.Calls["test"].Count)
+}
+
+func TestCounterRate(t *testing.T) {
+	var c counter
+	now := time.Unix(1000, 0)
+	c.add(now, 60)
+	c.add(now.Add(30*time.Second), 60)
+	assert.Equal(t, 2.0, c.rate(now.Add(30*time.Second)))
+	assert.Equal(t, 1.0, c.rate(now.Add(70*time.Second)))
+	assert.Equal(t, 0.0, c.rate(now.Add(2*time.Minute)))
+	assert.Equal(t, int64(120), c.total)
+}
+
+func TestMetricID(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "http POST /update/{metric_type}/{metric_name}/{metric_value}", want: "_server.http.POST.update._._._"},
+		{name: "grpc /metrics.Metrics/SaveList", want: "_server.grpc.metrics.Metrics.SaveList"},
+		{name: "storage DumpMetrics", want: "_server.storage.DumpMetrics"},
+		{name: SignatureFailures, want: "_server.signature.failures"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MetricID(tt.name))
+		})
+	}
+}
+
+func TestSnapshotMetrics(t *testing.T) {
+	r := NewRegistry()
+	r.Observe("storage GetValue", 2*time.Millisecond, false)
+	r.Observe("grpc /grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", time.Millisecond, false)
+	r.Add(SignatureFailures, 3)
+	got := make(map[string]float64)
+	for _, v := range r.Snapshot().Metrics(50) {
+		assert.Equal(t, "gauge", v.MType)
+		assert.LessOrEqual(t, len(v.ID), 50)
+		got[v.ID] = *v.Value
+	}
+	assert.Contains(t, got, "_server.uptime_seconds")
+	assert.Equal(t, 1.0, got["_server.storage.GetValue.count"])
+	assert.Equal(t, 2.0, got["_server.storage.GetValue.max_ms"])
+	assert.Equal(t, 3.0, got["_server.signature.failures.total"])
+	assert.Len(t, got, 7)
+
+	js, err := json.Marshal(r.Snapshot())
+	require.NoError(t, err)
+	var parsed struct {
+		Calls map[string]struct {
+			Count int64   `json:"count"`
+			AvgMs float64 `json:"avg_ms"`
+		} `json:"calls"`
+		Counters map[string]Counter `json:"counters"`
+	}
+	require.NoError(t, json.Unmarshal(js, &parsed))
+	assert.Equal(t, 2.0, parsed.Calls["storage GetValue"].AvgMs)
+	assert.Equal(t, int64(3), parsed.Counters[SignatureFailures].Total)
+}
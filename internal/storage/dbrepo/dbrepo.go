@@ -85,7 +85,7 @@ func (m *MetricRepo) SaveMetric(ctx context.Context, metric metrics.Metrics) err
 		oldValue = metric.MType
 	}
 	if oldValue != metric.MType {
-		return metrics.ErrUndefinedType
+		return metrics.ErrWrongType
 	}
 	switch metric.MType {
 	case "gauge":
@@ -112,63 +112,76 @@ func (m *MetricRepo) SaveMetric(ctx context.Context, metric metrics.Metrics) err
 	return nil
 }
 
-func (m *MetricRepo) SaveListMetric(ctx context.Context, metricarray []metrics.Metrics) (int, error) {
-	counter := 0
+// SaveListMetric - сохраняет массив метрик в одной транзакции.
+//
+// Каждая метрика сохраняется в своей точке сохранения, поэтому ошибка по одной метрике не откатывает остальные.
+func (m *MetricRepo) SaveListMetric(ctx context.Context, metricarray []metrics.Metrics) ([]metrics.ItemStatus, error) {
+	result := make([]metrics.ItemStatus, 0, len(metricarray))
 	tx, err := m.Pool.Begin(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer tx.Rollback(ctx)
 	for _, metric := range metricarray {
-		var oldValue string
-		sqlBytes, err := SQL.ReadFile("sql/SQLSelectValueType.sql")
+		status, err := saveMetricTx(ctx, tx, metric)
 		if err != nil {
-			return 0, err
+			log.Error().Err(err).Str("metric", metric.ID).Msg("failed save metric")
 		}
-		sqlQuery := string(sqlBytes)
-		row := tx.QueryRow(ctx, sqlQuery, metric.ID)
-		err = row.Scan(&oldValue)
-		if err != nil {
-			if !errors.Is(err, pgx.ErrNoRows) {
-				log.Error().Err(err).Msg("failed get previous value")
-				continue
-			}
-			oldValue = metric.MType
+		result = append(result, metric.Status(status, err))
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Error().Err(err).Msg("update drivers: unable to commit")
+		return nil, err
+	}
+	return result, nil
+}
+
+// saveMetricTx - сохраняет метрику внутри точки сохранения транзакции и возвращает статус обработки.
+func saveMetricTx(ctx context.Context, tx pgx.Tx, metric metrics.Metrics) (string, error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return metrics.StatusInternalError, err
+	}
+	defer sp.Rollback(ctx)
+	var oldValue string
+	sqlBytes, err := SQL.ReadFile("sql/SQLSelectValueType.sql")
+	if err != nil {
+		return metrics.StatusInternalError, err
+	}
+	row := sp.QueryRow(ctx, string(sqlBytes), metric.ID)
+	err = row.Scan(&oldValue)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return metrics.StatusInternalError, err
 		}
-		if oldValue != metric.MType {
-			log.Error().Err(metrics.ErrUndefinedType).Msg("wrong metric type")
-			continue
+		oldValue = metric.MType
+	}
+	if oldValue != metric.MType {
+		return metrics.StatusTypeConflict, metrics.ErrWrongType
+	}
+	switch metric.MType {
+	case "gauge":
+		sqlBytes, err = SQL.ReadFile("sql/SQLInsertGaugeValue.sql")
+		if err != nil {
+			return metrics.StatusInternalError, err
 		}
-		switch metric.MType {
-		case "gauge":
-			sqlBytes, err := SQL.ReadFile("sql/SQLInsertGaugeValue.sql")
-			if err != nil {
-				return 0, err
-			}
-			sqlQuery := string(sqlBytes)
-			_, err = tx.Exec(ctx, sqlQuery, metric.ID, metric.Value)
-			if err != nil {
-				log.Error().Err(err).Msg("failed update gauge metric")
-				continue
-			}
-		case "counter":
-			sqlBytes, err := SQL.ReadFile("sql/SQLInsertCounterValue.sql")
-			if err != nil {
-				return 0, err
-			}
-			sqlQuery := string(sqlBytes)
-			_, err = tx.Exec(ctx, sqlQuery, metric.ID, metric.Delta)
-			if err != nil {
-				log.Error().Err(err).Msg("failed update counter metric")
-				continue
-			}
+		_, err = sp.Exec(ctx, string(sqlBytes), metric.ID, metric.Value)
+	case "counter":
+		sqlBytes, err = SQL.ReadFile("sql/SQLInsertCounterValue.sql")
+		if err != nil {
+			return metrics.StatusInternalError, err
 		}
-		counter++
+		_, err = sp.Exec(ctx, string(sqlBytes), metric.ID, metric.Delta)
+	default:
+		return metrics.StatusParseError, metrics.ErrUndefinedType
 	}
-	if err := tx.Commit(ctx); err != nil {
-		log.Error().Err(err).Msg("update drivers: unable to commit")
-		return 0, err
+	if err != nil {
+		return metrics.StatusInternalError, err
+	}
+	if err := sp.Commit(ctx); err != nil {
+		return metrics.StatusInternalError, err
 	}
-	return counter, nil
+	return metrics.StatusAccepted, nil
 }
 
 func (m *MetricRepo) ListMetrics(ctx context.Context) []metrics.Metrics {
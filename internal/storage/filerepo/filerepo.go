@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
 	"github.com/colzphml/yandex_project/internal/metrics"
@@ -23,6 +24,7 @@ var (
 
 type MetricRepo struct {
 	DB map[string]metrics.Metrics
+	mu sync.RWMutex // метрики сохраняются параллельно из обработчиков HTTP, gRPC и записи внутренних метрик сервера
 }
 
 func NewMetricRepo(cfg *serverutils.ServerConfig) (*MetricRepo, error) {
@@ -58,12 +60,16 @@ func (m *MetricRepo) DumpMetrics(ctx context.Context, cfg *serverutils.ServerCon
 			return err
 		}
 		defer file.Close()
+		m.mu.RLock()
+		defer m.mu.RUnlock()
 		return json.NewEncoder(file).Encode(m)
 	}
 	return nil
 }
 
 func (m *MetricRepo) SaveMetric(ctx context.Context, metric metrics.Metrics) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if v, ok := m.DB[metric.ID]; ok {
 		newValue, err := metricsserver.NewValue(v, metric)
 		if err != nil {
@@ -76,25 +82,30 @@ func (m *MetricRepo) SaveMetric(ctx context.Context, metric metrics.Metrics) err
 	return nil
 }
 
-func (m *MetricRepo) SaveListMetric(ctx context.Context, metricarray []metrics.Metrics) (int, error) {
-	counter := 0
+func (m *MetricRepo) SaveListMetric(ctx context.Context, metricarray []metrics.Metrics) ([]metrics.ItemStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]metrics.ItemStatus, 0, len(metricarray))
 	for _, metric := range metricarray {
 		if v, ok := m.DB[metric.ID]; ok {
 			newValue, err := metricsserver.NewValue(v, metric)
 			if err != nil {
 				log.Error().Err(err).Msg("trouble with calculate new value")
+				result = append(result, metric.Status(metrics.StatusTypeConflict, err))
 				continue
 			}
 			m.DB[metric.ID] = newValue
 		} else {
 			m.DB[metric.ID] = metric
 		}
-		counter++
+		result = append(result, metric.Status(metrics.StatusAccepted, nil))
 	}
-	return counter, nil
+	return result, nil
 }
 
 func (m *MetricRepo) ListMetrics(ctx context.Context) []metrics.Metrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	var list []metrics.Metrics
 	for _, v := range m.DB {
 		list = append(list, v)
@@ -106,6 +117,8 @@ func (m *MetricRepo) ListMetrics(ctx context.Context) []metrics.Metrics {
 }
 
 func (m *MetricRepo) GetValue(ctx context.Context, metricName string) (metrics.Metrics, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	v, ok := m.DB[metricName]
 	if !ok {
 		return metrics.Metrics{}, errors.New("metric not saved")
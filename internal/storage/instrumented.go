@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/colzphml/yandex_project/internal/app/server/serverutils"
+	"github.com/colzphml/yandex_project/internal/metrics"
+	"github.com/colzphml/yandex_project/internal/selfmetrics"
+)
+
+// instrumentedRepo - хранилище, которое учитывает количество и длительность вызовов каждого метода в selfmetrics.Default.
+type instrumentedRepo struct {
+	repo Repositorier
+}
+
+// Instrument - оборачивает хранилище учетом длительности вызовов его методов.
+func Instrument(repo Repositorier) Repositorier {
+	return instrumentedRepo{repo: repo}
+}
+
+// observe - учитывает вызов метода хранилища.
+func observe(method string, start time.Time, err error) {
+	selfmetrics.Default.Observe("storage "+method, time.Since(start), err != nil)
+}
+
+func (r instrumentedRepo) SaveMetric(ctx context.Context, metric metrics.Metrics) error {
+	start := time.Now()
+	err := r.repo.SaveMetric(ctx, metric)
+	observe("SaveMetric", start, err)
+	return err
+}
+
+func (r instrumentedRepo) SaveListMetric(ctx context.Context, list []metrics.Metrics) ([]metrics.ItemStatus, error) {
+	start := time.Now()
+	result, err := r.repo.SaveListMetric(ctx, list)
+	observe("SaveListMetric", start, err)
+	return result, err
+}
+
+func (r instrumentedRepo) ListMetrics(ctx context.Context) []metrics.Metrics {
+	start := time.Now()
+	result := r.repo.ListMetrics(ctx)
+	observe("ListMetrics", start, nil)
+	return result
+}
+
+func (r instrumentedRepo) GetValue(ctx context.Context, metricName string) (metrics.Metrics, error) {
+	start := time.Now()
+	result, err := r.repo.GetValue(ctx, metricName)
+	observe("GetValue", start, err)
+	return result, err
+}
+
+func (r instrumentedRepo) DumpMetrics(ctx context.Context, cfg *serverutils.ServerConfig) error {
+	start := time.Now()
+	err := r.repo.DumpMetrics(ctx, cfg)
+	observe("DumpMetrics", start, err)
+	return err
+}
+
+func (r instrumentedRepo) Close() {
+	r.repo.Close()
+}
+
+func (r instrumentedRepo) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := r.repo.Ping(ctx)
+	observe("Ping", start, err)
+	return err
+}
@@ -16,13 +16,13 @@ var log = zerolog.New(serverutils.LogConfig()).With().Timestamp().Str("component
 
 // Repositorier - интерфейс, описывающий работу с хранилищем метрик.
 type Repositorier interface {
-	SaveMetric(ctx context.Context, metric metrics.Metrics) error               // Сохранение отдельной метрики
-	SaveListMetric(ctx context.Context, metrics []metrics.Metrics) (int, error) // Сохранение массива метрик
-	ListMetrics(ctx context.Context) []metrics.Metrics                          // Получение списка метрик и их значений
-	GetValue(ctx context.Context, metricName string) (metrics.Metrics, error)   // Получает метрику по ее имени из хранилища
-	DumpMetrics(ctx context.Context, cfg *serverutils.ServerConfig) error       // Сохранение метрик из локальной памяти
-	Close()                                                                     // Закрытие хранилища
-	Ping(ctx context.Context) error                                             // Проверка доступности хранилища
+	SaveMetric(ctx context.Context, metric metrics.Metrics) error                                // Сохранение отдельной метрики
+	SaveListMetric(ctx context.Context, metrics []metrics.Metrics) ([]metrics.ItemStatus, error) // Сохранение массива метрик со статусом по каждой метрике в порядке массива
+	ListMetrics(ctx context.Context) []metrics.Metrics                                           // Получение списка метрик и их значений
+	GetValue(ctx context.Context, metricName string) (metrics.Metrics, error)                    // Получает метрику по ее имени из хранилища
+	DumpMetrics(ctx context.Context, cfg *serverutils.ServerConfig) error                        // Сохранение метрик из локальной памяти
+	Close()                                                                                      // Закрытие хранилища
+	Ping(ctx context.Context) error                                                              // Проверка доступности хранилища
 }
 
 // CreateRepo - создает хранилище на основе параметров сервера.
@@ -30,6 +30,8 @@ type Repositorier interface {
 // Если указан URL Postgres - используется ДБ.
 //
 // Если указан файл, но не указан URL Postgres - используется файл.
+//
+// Вызовы методов хранилища учитываются во внутренних метриках сервера.
 func CreateRepo(ctx context.Context, cfg *serverutils.ServerConfig) (Repositorier, *time.Ticker, error) {
 	var tickerSave *time.Ticker
 	tickerSave = &time.Ticker{}
@@ -45,7 +47,7 @@ func CreateRepo(ctx context.Context, cfg *serverutils.ServerConfig) (Repositorie
 			return nil, nil, err
 		}
 		log.Info().Msg("used db")
-		return repo, tickerSave, nil
+		return Instrument(repo), tickerSave, nil
 	//использование файла
 	case cfg.StoreFile != "":
 		repo, err := filerepo.NewMetricRepo(cfg)
@@ -55,13 +57,13 @@ func CreateRepo(ctx context.Context, cfg *serverutils.ServerConfig) (Repositorie
 		if cfg.StoreInterval.Seconds() != 0 {
 			tickerSave = time.NewTicker(cfg.StoreInterval)
 		}
-		return repo, tickerSave, nil
+		return Instrument(repo), tickerSave, nil
 	default:
 		repo, err := filerepo.NewMetricRepo(cfg)
 		if err != nil {
 			return nil, nil, err
 		}
 		log.Info().Msg("used file")
-		return repo, tickerSave, nil
+		return Instrument(repo), tickerSave, nil
 	}
 }